@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/aksenk/go-yandex-metrics/internal/agent/app"
 	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/certs"
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
 	"net/http"
 	"os"
@@ -29,6 +30,27 @@ func main() {
 	client := http.Client{
 		Timeout: time.Duration(cfg.ClientTimeout) * time.Second,
 	}
+	if cfg.ServerUseHTTPS {
+		reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCAFile, log)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificates: %v", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = reloader.ClientConfig(cfg.ServerAddr)
+		client.Transport = transport
+
+		// по SIGHUP перечитываем TLS сертификаты
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				log.Info("Received SIGHUP, reloading TLS certificates")
+				if err := reloader.Reload(); err != nil {
+					log.Errorf("Can not reload TLS certificates: %v", err)
+				}
+			}
+		}()
+	}
 
 	mainCtx, mainCancelCtx := context.WithCancel(context.Background())
 	exitSignal := make(chan os.Signal, 1)
@@ -57,7 +79,9 @@ func main() {
 		log.Fatalf("Error creating agent: %v", err)
 	}
 
-	agent.Run(mainCtx)
+	if err = agent.Run(mainCtx); err != nil {
+		log.Fatalf("Error running agent: %v", err)
+	}
 
 	<-mainCtx.Done()
 	log.Info("Shutdown completed")
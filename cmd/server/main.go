@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
 	"github.com/aksenk/go-yandex-metrics/internal/server/app"
 	"github.com/aksenk/go-yandex-metrics/internal/server/config"
@@ -24,16 +26,45 @@ func main() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
+	// флаги указываются до подкоманды: server -d DSN migrate up
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [command]\n\n", os.Args[0])
+		fmt.Fprint(flag.CommandLine.Output(), app.CommandsUsage+"\n")
+		fmt.Fprintln(flag.CommandLine.Output(), "Flags:")
+		flag.PrintDefaults()
+	}
+
 	config, err := config.GetConfig()
 	if err != nil {
 		logger.Fatalf("can not create app config: %v", err)
 	}
 
+	if len(config.Command) > 0 {
+		if err = app.RunCommand(mainCtx, config, os.Stdout); err != nil {
+			logger.Fatalf("Command '%v' failed: %v", config.Command[0], err)
+		}
+		return
+	}
+
 	app, err := app.NewApp(config)
 	if err != nil {
 		logger.Fatalf("Application initialization error: %v", err)
 	}
 
+	// по SIGHUP перечитываем TLS сертификаты, если HTTPS включен
+	if config.Server.TLSCertFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				logger.Info("Received SIGHUP, reloading TLS certificates")
+				if err := app.ReloadCertificates(); err != nil {
+					logger.Errorf("Can not reload TLS certificates: %v", err)
+				}
+			}
+		}()
+	}
+
 	go func() {
 		signal := <-signals
 		logger.Infof("Received %v signal", signal)
@@ -5,13 +5,20 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
 	"github.com/aksenk/go-yandex-metrics/internal/agent/metrics"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/spool"
 	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/retry"
 	"github.com/aksenk/go-yandex-metrics/internal/signature"
 	"go.uber.org/zap"
+	"io"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,131 +27,463 @@ type App struct {
 	Client                 *http.Client
 	Config                 *config.Config
 	RuntimeRequiredMetrics []string
-	PSUtilRequiredMetrics  []string
-	ReadyMetrics           chan []models.Metric
-	PSUtilMetrics          chan []models.Metric
-	PollCounter            *metrics.PollCounter
-	ReportTicker           *time.Ticker
+	// Counters приращения counter метрик, которые списываются только после ответа сервера
+	Counters  *metrics.Counters
+	SendStats *metrics.SendStats
+	// Collectors включенные в конфиге источники метрик
+	Collectors []metrics.Collector
+	// Aggregator значения метрик, собранные с прошлого отчета
+	Aggregator   *metrics.Aggregator
+	ReportTicker *time.Ticker
+	// до этого момента воркеры не отправляют запросы, т.к. сервер ответил 429
+	pauseUntil time.Time
+	pauseMu    sync.Mutex
+	// пачки, которые не удалось отправить, уходят повторно со следующим отчетом
+	requeued   []models.Metric
+	requeuedMu sync.Mutex
+	// Spool очередь неотправленных пачек на диске, nil если не настроена
+	Spool *spool.Spool
+	// последняя отправка была успешной, можно разбирать очередь на диске
+	reachable atomic.Bool
 }
 
+// Response результат отправки пачки метрик
 type Response struct {
-	Name       string
+	Batch      []models.Metric
 	StatusCode int
 	Err        error
+	drain      *spoolDrain
+}
+
+// job пачка метрик для отправки. drain задан, если метрики забраны из очереди на диске
+type job struct {
+	batch []models.Metric
+	drain *spoolDrain
+}
+
+// spoolDrain метрики, забранные из очереди на диске одним Take. Файлы очереди удаляются,
+// когда на все пачки из этих метрик получен ответ
+type spoolDrain struct {
+	lease   *spool.Lease
+	pending atomic.Int32
 }
 
 var errMetricSend = fmt.Errorf("error sending metric")
 var errStatusCode = fmt.Errorf("unexpected response status code")
 var errReadBody = fmt.Errorf("error reading response body")
 
+// если сервер не прислал корректный Retry-After
+const defaultRetryAfter = time.Second
+
+// сколько неотправленных метрик храним для повторной отправки, более старые отбрасываются
+const maxRequeued = 10000
+
+// retryAfterError сервер ответил 429 и попросил повторить запрос позже
+type retryAfterError struct {
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("server rate limit exceeded, retry after %v", e.wait)
+}
+
+func parseRetryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
 func NewApp(client *http.Client, logger *zap.SugaredLogger, config *config.Config) (*App, error) {
 	runtimeRequiredMetrics := []string{"Alloc", "BuckHashSys", "Frees", "GCCPUFraction", "GCSys", "HeapAlloc",
 		"HeapIdle", "HeapInuse", "HeapObjects", "HeapReleased", "HeapSys", "LastGC", "Lookups",
 		"MCacheInuse", "MCacheSys", "MSpanInuse", "MSpanSys", "Mallocs", "NextGC", "NumForcedGC",
 		"NumGC", "OtherSys", "PauseTotalNs", "StackInuse", "StackSys", "Sys", "TotalAlloc"}
-	psutilRequiredMetrics := []string{"TotalMemory", "FreeMemory", "CPUutilization1"}
+	counters := metrics.NewCounters()
+	sendStats := &metrics.SendStats{}
 
-	return &App{
+	registry := metrics.DefaultRegistry(config, runtimeRequiredMetrics, counters, sendStats)
+	collectors, err := registry.Build(config.Collectors, config.Filters, config.PollInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	var sp *spool.Spool
+	if config.SpoolDir != "" {
+		sp, err = spool.NewSpool(config.SpoolDir, int64(config.SpoolMaxSize)<<20, config.SpoolMaxAge, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a := &App{
 		Logger:                 logger,
 		Client:                 client,
 		Config:                 config,
 		RuntimeRequiredMetrics: runtimeRequiredMetrics,
-		PSUtilRequiredMetrics:  psutilRequiredMetrics,
-		ReadyMetrics:           make(chan []models.Metric, 1),
-		PollCounter:            &metrics.PollCounter{},
+		Counters:               counters,
+		SendStats:              sendStats,
+		Collectors:             collectors,
+		Aggregator:             metrics.NewAggregator(config.Aggregations),
 		ReportTicker:           time.NewTicker(config.ReportInterval),
-	}, nil
+		Spool:                  sp,
+	}
+	a.reachable.Store(true)
+	a.updateSpoolStats()
+	return a, nil
 }
 
 func (a *App) resultHandler(results <-chan Response) {
 	for result := range results {
-		if result.Err == nil {
-			a.Logger.Infof("Metric %v is successfully sent", result.Name)
+		a.handleResult(result)
+	}
+}
+
+// handleResult списывает отправленную пачку или откладывает неотправленную
+func (a *App) handleResult(result Response) {
+	if result.drain != nil {
+		defer a.finishDrain(result.drain)
+	}
+	if result.Err == nil {
+		a.Logger.Infof("Batch of %v metrics is successfully sent", len(result.Batch))
+		a.ack(result)
+		a.reachable.Store(true)
+		return
+	}
+	a.Logger.Errorf("Error sending batch of %v metrics: %v", len(result.Batch), result.Err)
+	// сервер отверг сами метрики, повтор ничего не изменит
+	if result.StatusCode >= 400 && result.StatusCode < 500 && result.StatusCode != http.StatusTooManyRequests {
+		a.ack(result)
+		return
+	}
+	a.reachable.Store(false)
+	if result.drain != nil {
+		a.respool(result.Batch, result.drain.lease.Created)
+		return
+	}
+	a.postpone(result.Batch)
+}
+
+// ack списывает приращения counter пачки. Приращения из очереди на диске уже списаны, когда пачка попала в нее
+func (a *App) ack(result Response) {
+	if result.drain == nil {
+		a.Counters.Ack(result.Batch)
+	}
+}
+
+// finishDrain удаляет файлы очереди на диске, когда получен ответ на последнюю пачку из них
+func (a *App) finishDrain(d *spoolDrain) {
+	if d.pending.Add(-1) == 0 {
+		a.Spool.Release(d.lease)
+		a.updateSpoolStats()
+	}
+}
+
+// postpone откладывает неотправленную пачку. Если настроена очередь на диске, пачка сохраняется в нее целиком,
+// вместе с приращениями counter. Иначе приращения возвращаются в Counters, а остальные метрики откладываются в память
+func (a *App) postpone(batch []models.Metric) {
+	if a.Spool != nil {
+		err := a.Spool.Append(batch)
+		if err == nil {
+			// приращения теперь хранятся в очереди на диске
+			a.Counters.Ack(batch)
+			a.updateSpoolStats()
+			return
 		}
-		if result.Err != nil {
-			a.Logger.Errorf("Error sending %v metric: %v", result.Name, result.Err)
+		a.Logger.Errorf("Can not spool batch of %v metrics: %v", len(batch), err)
+	}
+	if batch = a.Counters.Return(batch); len(batch) > 0 {
+		a.requeue(batch)
+	}
+}
+
+// respool возвращает неотправленные метрики из очереди на диске обратно в нее с исходным временем записи
+func (a *App) respool(batch []models.Metric, created time.Time) {
+	if err := a.Spool.AppendAt(batch, created); err != nil {
+		a.Logger.Errorf("Can not spool batch of %v metrics: %v", len(batch), err)
+		a.requeue(batch)
+	}
+}
+
+// spoolPending сохраняет при остановке агента отложенные в памяти метрики и неотправленные приращения counter
+// в очередь на диске, чтобы отправить их после перезапуска
+func (a *App) spoolPending() {
+	if a.Spool == nil {
+		return
+	}
+	requeued := a.takeRequeued()
+	counters := a.Counters.Take()
+	batch := append(requeued, counters...)
+	if len(batch) == 0 {
+		return
+	}
+	if err := a.Spool.Append(batch); err != nil {
+		a.Logger.Errorf("Can not spool %v unsent metrics, they are lost: %v", len(batch), err)
+		return
+	}
+	a.Counters.Ack(counters)
+	a.updateSpoolStats()
+	a.Logger.Infof("%v unsent metrics are spooled", len(batch))
+}
+
+func (a *App) updateSpoolStats() {
+	if a.Spool == nil {
+		return
+	}
+	batches, bytes := a.Spool.Depth()
+	a.SendStats.SpoolBatches.Store(int64(batches))
+	a.SendStats.SpoolBytes.Store(bytes)
+}
+
+// requeue откладывает пачку до следующего отчета
+func (a *App) requeue(batch []models.Metric) {
+	a.requeuedMu.Lock()
+	defer a.requeuedMu.Unlock()
+	a.requeued = append(a.requeued, batch...)
+	if drop := len(a.requeued) - maxRequeued; drop > 0 {
+		a.Logger.Warnf("Too many unsent metrics, dropping %v oldest", drop)
+		a.requeued = append([]models.Metric(nil), a.requeued[drop:]...)
+	}
+}
+
+// takeRequeued забирает отложенные в памяти метрики
+func (a *App) takeRequeued() []models.Metric {
+	a.requeuedMu.Lock()
+	defer a.requeuedMu.Unlock()
+	requeued := a.requeued
+	a.requeued = nil
+	return requeued
+}
+
+// takeSpooled забирает метрики из очереди на диске, если сервер снова доступен
+func (a *App) takeSpooled() *spool.Lease {
+	if a.Spool == nil || !a.reachable.Load() {
+		return nil
+	}
+	lease, err := a.Spool.Take()
+	if err != nil {
+		a.Logger.Errorf("Can not read spool: %v", err)
+		return nil
+	}
+	if lease != nil {
+		a.Logger.Infof("Server is reachable, draining %v spooled metrics", len(lease.Metrics))
+	}
+	return lease
+}
+
+// dropStaleGauges отбрасывает отложенные gauge, для которых уже собрано новое значение
+func dropStaleGauges(pending, fresh []models.Metric) []models.Metric {
+	freshGauges := make(map[string]struct{})
+	for _, m := range fresh {
+		if m.MType == models.Gauge.String() {
+			freshGauges[m.ID] = struct{}{}
 		}
-		if result.StatusCode != 200 {
-			a.Logger.Errorf("Unexpected status code while sending %v metric: %v", result.Name, result.StatusCode)
+	}
+	result := make([]models.Metric, 0, len(pending))
+	for _, m := range pending {
+		if _, ok := freshGauges[m.ID]; ok && m.MType == models.Gauge.String() {
+			continue
 		}
+		result = append(result, m)
+	}
+	return result
+}
+
+// splitBatches делит метрики на пачки не больше size метрик
+func splitBatches(metrics []models.Metric, size int) [][]models.Metric {
+	if size < 1 {
+		size = len(metrics)
 	}
+	var batches [][]models.Metric
+	for len(metrics) > 0 {
+		n := min(size, len(metrics))
+		batches = append(batches, metrics[:n:n])
+		metrics = metrics[n:]
+	}
+	return batches
 }
 
 func (a *App) Run(ctx context.Context) error {
 	a.Logger.Infof("Starting agent")
-	a.Logger.Infof("Collecting metric every %s and sending every %v", a.Config.PollInterval, a.Config.ReportInterval)
-
-	reportInterval := a.Config.ReportInterval
-	reportTicker := time.NewTicker(reportInterval)
-	defer reportTicker.Stop()
+	a.Logger.Infof("Sending metrics every %v", a.Config.ReportInterval)
 
-	pollInterval := a.Config.PollInterval
-	pollTicker := time.NewTicker(pollInterval)
-	defer pollTicker.Stop()
+	if a.Config.ListenAddress != "" {
+		l, err := a.listen()
+		if err != nil {
+			return fmt.Errorf("can not listen on %v: %v", a.Config.ListenAddress, err)
+		}
+		go a.serveIngest(ctx, l)
+	}
 
-	// канал куда складываем метрики для отправки на сервер
-	jobs := make(chan models.Metric, a.Config.RateLimit)
+	// канал куда складываем пачки метрик для отправки на сервер
+	jobs := make(chan job, a.Config.RateLimit)
 	// канал куда получаем результаты отправки метрик
 	results := make(chan Response, a.Config.RateLimit)
 
+	var workers sync.WaitGroup
 	for i := 0; i < a.Config.RateLimit; i++ {
-		go a.worker(jobs, results)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			a.worker(ctx, jobs, results)
+		}()
 	}
 
-	go a.resultHandler(results)
+	handled := make(chan struct{})
+	go func() {
+		a.resultHandler(results)
+		close(handled)
+	}()
 
-	runtimeMetrics := metrics.GetRuntimeMetrics(ctx, a.RuntimeRequiredMetrics, pollTicker)
-	customMetrics := metrics.GetCustomMetrics(ctx, a.PollCounter.Get(), pollTicker)
-	psutilMetrics := metrics.GetPSUtilMetrics(ctx, pollTicker)
+	for _, c := range a.Collectors {
+		a.Logger.Infof("Collecting %v metrics every %v", c.Name(), c.Interval())
+		go metrics.Run(ctx, c, a.Aggregator, a.Logger)
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			a.Logger.Infof("Stopping agent")
+			// прерванные отправки откладываются в resultHandler, после этого отложенное сохраняется на диск
+			close(jobs)
+			workers.Wait()
+			close(results)
+			<-handled
+			a.spoolPending()
 			return nil
 		case <-a.ReportTicker.C:
-			var allMetrics []models.Metric
 			a.Logger.Debug("Report ticker")
-			if len(runtimeMetrics) > 0 {
-				m := <-runtimeMetrics
-				allMetrics = append(allMetrics, m...)
-			}
-			if len(customMetrics) > 0 {
-				m := <-customMetrics
-				allMetrics = append(allMetrics, m...)
-			}
-			if len(psutilMetrics) > 0 {
-				m := <-psutilMetrics
-				allMetrics = append(allMetrics, m...)
-			}
-			if len(allMetrics) > 0 {
-				a.Logger.Infof("Sending %v metrics", len(allMetrics))
-				for _, m := range allMetrics {
-					jobs <- m
-				}
-			} else {
-				a.Logger.Infof("No metrics to send")
+			a.report(ctx, a.Aggregator.Flush(), jobs)
+		}
+	}
+}
+
+// report делит собранные и отложенные метрики на пачки по BatchSize и отдает их воркерам.
+// Отложенные метрики старше собранных, поэтому идут первыми
+func (a *App) report(ctx context.Context, collected []models.Metric, jobs chan<- job) {
+	var batches []job
+	count := 0
+	if lease := a.takeSpooled(); lease != nil {
+		// метрики из очереди на диске уходят отдельными пачками, чтобы удалить ее файлы после ответа на все эти пачки
+		drain := &spoolDrain{lease: lease}
+		spooled := dropStaleGauges(lease.Metrics, collected)
+		for _, batch := range splitBatches(spooled, a.Config.BatchSize) {
+			batches = append(batches, job{batch: batch, drain: drain})
+		}
+		drain.pending.Store(int32(len(batches)))
+		if len(batches) == 0 {
+			a.Spool.Release(lease)
+			a.updateSpoolStats()
+		}
+		count += len(spooled)
+	}
+	allMetrics := append(dropStaleGauges(a.takeRequeued(), collected), collected...)
+	allMetrics = append(allMetrics, a.Counters.Take()...)
+	for _, batch := range splitBatches(allMetrics, a.Config.BatchSize) {
+		batches = append(batches, job{batch: batch})
+	}
+	count += len(allMetrics)
+	if len(batches) == 0 {
+		a.Logger.Infof("No metrics to send")
+		return
+	}
+	a.Logger.Infof("Sending %v metrics in %v batches", count, len(batches))
+	for i, j := range batches {
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			// неотправленные пачки вернутся в очередь
+			for _, rest := range batches[i:] {
+				a.handleResult(Response{Batch: rest.batch, Err: ctx.Err(), drain: rest.drain})
 			}
+			return
 		}
 	}
 }
 
-func (a *App) worker(jobs <-chan models.Metric, results chan<- Response) {
+// pause приостанавливает отправку во всех воркерах
+func (a *App) pause(wait time.Duration) {
+	a.pauseMu.Lock()
+	defer a.pauseMu.Unlock()
+	if until := time.Now().Add(wait); until.After(a.pauseUntil) {
+		a.pauseUntil = until
+	}
+}
+
+// waitPause ждет окончания паузы, если она была выставлена
+func (a *App) waitPause(ctx context.Context) error {
+	a.pauseMu.Lock()
+	wait := time.Until(a.pauseUntil)
+	a.pauseMu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (a *App) worker(ctx context.Context, jobs <-chan job, results chan<- Response) {
 	for j := range jobs {
-		a.Logger.Infof("Sending metric %v", j.ID)
-		statusCode, err := a.sendMetric(j)
+		batch := j.batch
+		var statusCode int
+		attempt := 0
+		retryer := retry.NewRetryer(a.Logger, a.Config.RetryAttempts, 0, func(ctx context.Context) (bool, error) {
+			if err := a.waitPause(ctx); err != nil {
+				return true, err
+			}
+			if attempt++; attempt > 1 {
+				a.SendStats.Retries.Add(1)
+			}
+			a.Logger.Debugf("Sending batch of %v metrics", len(batch))
+			var err error
+			statusCode, err = a.sendMetrics(ctx, batch)
+			var retryAfter *retryAfterError
+			if errors.As(err, &retryAfter) {
+				// сервер попросил подождать: ставим на паузу весь пул, повтор будет не раньше окончания паузы
+				a.Logger.Warnf("Server rate limit exceeded while sending batch of %v metrics, pausing for %v", len(batch), retryAfter.wait)
+				a.pause(retryAfter.wait)
+			}
+			return !retryable(statusCode, err), err
+		})
+		retryer.Backoff = retry.FullJitter(time.Duration(a.Config.RetryInitialWaitTime)*time.Second, time.Duration(a.Config.RetryWaitTime)*time.Second)
+		err := retryer.Do(ctx)
+		if err != nil {
+			a.SendStats.Failures.Add(1)
+		}
 		resp := Response{
 			StatusCode: statusCode,
 			Err:        err,
-			Name:       j.ID,
+			Batch:      batch,
+			drain:      j.drain,
 		}
 		results <- resp
 	}
 }
 
-func (a *App) sendMetric(metric models.Metric) (statusCode int, err error) {
-	metrics := []models.Metric{metric}
+// retryable повторять ли отправку: только при сетевых ошибках, 5xx и 429
+func retryable(statusCode int, err error) bool {
+	if err == nil {
+		return false
+	}
+	if statusCode == http.StatusTooManyRequests || statusCode >= 500 {
+		return true
+	}
+	return errors.Is(err, errMetricSend) || errors.Is(err, errReadBody)
+}
 
+func (a *App) sendMetrics(ctx context.Context, metrics []models.Metric) (statusCode int, err error) {
 	jsonData, err := json.Marshal(metrics)
 	if err != nil {
 		return 0, fmt.Errorf("can not marshal data: %v", err)
@@ -161,13 +500,17 @@ func (a *App) sendMetric(metric models.Metric) (statusCode int, err error) {
 		return 0, fmt.Errorf("can not close gzip writer: %v", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, a.Config.ServerURL, &gzippedBody)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.Config.ServerURL, &gzippedBody)
 	if err != nil {
 		return 0, fmt.Errorf("can not create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "gzip")
 
+	if a.Config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Config.Token)
+	}
+
 	cryptKey := a.Config.CryptKey
 	if cryptKey != "" {
 		sign := signature.GetSignature(jsonData, cryptKey)
@@ -176,16 +519,19 @@ func (a *App) sendMetric(metric models.Metric) (statusCode int, err error) {
 
 	res, err := a.Client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("%w: %s", errMetricSend, err)
+		return 0, fmt.Errorf("%w: %w", errMetricSend, err)
 	}
 
-	var resBody []byte
-	_, err = res.Body.Read(resBody)
+	resBody, err := io.ReadAll(res.Body)
 	res.Body.Close()
 	if err != nil {
 		return 0, fmt.Errorf("%w: %s", errReadBody, err)
 	}
 
+	if res.StatusCode == http.StatusTooManyRequests {
+		return res.StatusCode, &retryAfterError{wait: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+
 	if res.StatusCode != http.StatusOK {
 		return res.StatusCode, fmt.Errorf("%w: %v, response: %v", errStatusCode, res.StatusCode, string(resBody))
 	}
@@ -1 +1,563 @@
 package app
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/metrics"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "seconds", header: "3", want: 3 * time.Second},
+		{name: "empty", header: "", want: defaultRetryAfter},
+		{name: "garbage", header: "soon", want: defaultRetryAfter},
+		{name: "date in the past", header: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseRetryAfter(tt.header))
+		})
+	}
+}
+
+func TestApp_workerRetryAfter(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a, err := NewApp(server.Client(), log, &config.Config{
+		ServerURL:      server.URL + "/updates/",
+		ReportInterval: time.Second,
+		RetryAttempts:  1,
+	})
+	require.NoError(t, err)
+
+	jobs := make(chan job, 1)
+	results := make(chan Response, 1)
+	go a.worker(context.TODO(), jobs, results)
+
+	m, err := models.NewMetric("test", "gauge", 1)
+	require.NoError(t, err)
+	jobs <- job{batch: []models.Metric{m}}
+	close(jobs)
+
+	res := <-results
+	assert.NoError(t, res.Err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.EqualValues(t, 2, requests.Load())
+}
+
+func TestSplitBatches(t *testing.T) {
+	var metrics []models.Metric
+	for i := 0; i < 5; i++ {
+		m, err := models.NewMetric(fmt.Sprintf("m%v", i), "gauge", i)
+		require.NoError(t, err)
+		metrics = append(metrics, m)
+	}
+	tests := []struct {
+		name    string
+		size    int
+		metrics []models.Metric
+		want    []int
+	}{
+		{name: "no metrics", size: 2},
+		{name: "last batch is smaller", size: 2, metrics: metrics, want: []int{2, 2, 1}},
+		{name: "one batch", size: 10, metrics: metrics, want: []int{5}},
+		{name: "batch size is not set", size: 0, metrics: metrics, want: []int{5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sizes []int
+			var got []models.Metric
+			for _, batch := range splitBatches(tt.metrics, tt.size) {
+				sizes = append(sizes, len(batch))
+				got = append(got, batch...)
+			}
+			assert.Equal(t, tt.want, sizes)
+			assert.Equal(t, tt.metrics, got)
+		})
+	}
+}
+
+func TestApp_reportBatches(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var received [][]models.Metric
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gzr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []models.Metric
+		require.NoError(t, json.NewDecoder(gzr).Decode(&batch))
+		// первая пачка первого отчета не доходит до сервера
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		mu.Lock()
+		received = append(received, batch)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a, err := NewApp(server.Client(), log, &config.Config{
+		ServerURL:      server.URL + "/updates/",
+		ReportInterval: time.Second,
+		PollInterval:   time.Second,
+		BatchSize:      2,
+	})
+	require.NoError(t, err)
+
+	gauge := func(name string, value float64) models.Metric {
+		m, err := models.NewMetric(name, "gauge", value)
+		require.NoError(t, err)
+		return m
+	}
+
+	// один воркер, чтобы пачки уходили по порядку
+	jobs := make(chan job)
+	results := make(chan Response)
+	go a.worker(context.TODO(), jobs, results)
+	handle := func(count int) {
+		for i := 0; i < count; i++ {
+			res := <-results
+			if res.Err != nil {
+				a.requeue(res.Batch)
+			}
+		}
+	}
+
+	go a.report(context.TODO(), []models.Metric{gauge("a", 1), gauge("b", 1), gauge("c", 1)}, jobs)
+	handle(2)
+	// отложенная пачка уходит со следующим отчетом, устаревший gauge заменяется новым значением
+	go a.report(context.TODO(), []models.Metric{gauge("a", 2)}, jobs)
+	handle(1)
+	close(jobs)
+
+	assert.Equal(t, [][]models.Metric{
+		{gauge("c", 1)},
+		{gauge("b", 1), gauge("a", 2)},
+	}, received)
+}
+
+func TestApp_resultHandler(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	a := &App{Logger: log, Counters: metrics.NewCounters()}
+
+	m, err := models.NewMetric("test", "gauge", 1)
+	require.NoError(t, err)
+	results := make(chan Response, 3)
+	results <- Response{Batch: []models.Metric{m}, StatusCode: http.StatusOK}
+	results <- Response{Batch: []models.Metric{m}, StatusCode: http.StatusBadRequest, Err: errStatusCode}
+	results <- Response{Batch: []models.Metric{m, m}, Err: errMetricSend}
+	close(results)
+	a.resultHandler(results)
+
+	assert.Len(t, a.takeRequeued(), 2)
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		err        error
+		want       bool
+	}{
+		{name: "success", statusCode: http.StatusOK},
+		{name: "network error", err: fmt.Errorf("%w: connection refused", errMetricSend), want: true},
+		{name: "broken response", statusCode: http.StatusOK, err: fmt.Errorf("%w: unexpected EOF", errReadBody), want: true},
+		{name: "server error", statusCode: http.StatusServiceUnavailable, err: errStatusCode, want: true},
+		{name: "rate limit", statusCode: http.StatusTooManyRequests, err: &retryAfterError{}, want: true},
+		{name: "bad request", statusCode: http.StatusBadRequest, err: errStatusCode},
+		{name: "marshal error", err: fmt.Errorf("can not marshal data")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, retryable(tt.statusCode, tt.err))
+		})
+	}
+}
+
+func TestApp_workerRetry(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	m, err := models.NewMetric("test", "gauge", 1)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantCode     int
+		wantRequests int32
+		wantRetries  int64
+		wantFailures int64
+	}{
+		{name: "server recovers", statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, wantCode: http.StatusOK, wantRequests: 3, wantRetries: 2},
+		{name: "server is down", statuses: []int{http.StatusInternalServerError}, wantCode: http.StatusInternalServerError, wantRequests: 4, wantRetries: 3, wantFailures: 1},
+		{name: "client error is not retried", statuses: []int{http.StatusBadRequest}, wantCode: http.StatusBadRequest, wantRequests: 1, wantFailures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(requests.Add(1))
+				w.WriteHeader(tt.statuses[min(n, len(tt.statuses))-1])
+			}))
+			defer server.Close()
+
+			a, err := NewApp(server.Client(), log, &config.Config{
+				ServerURL:      server.URL + "/updates/",
+				ReportInterval: time.Second,
+				RetryAttempts:  3,
+			})
+			require.NoError(t, err)
+
+			jobs := make(chan job, 1)
+			results := make(chan Response, 1)
+			jobs <- job{batch: []models.Metric{m}}
+			close(jobs)
+			a.worker(context.TODO(), jobs, results)
+
+			res := <-results
+			assert.Equal(t, tt.wantCode, res.StatusCode)
+			assert.Equal(t, tt.wantRequests, requests.Load())
+			assert.Equal(t, tt.wantRetries, a.SendStats.Retries.Load())
+			assert.Equal(t, tt.wantFailures, a.SendStats.Failures.Load())
+		})
+	}
+
+	t.Run("shutdown interrupts backoff", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		a, err := NewApp(server.Client(), log, &config.Config{
+			ServerURL:            server.URL + "/updates/",
+			ReportInterval:       time.Second,
+			RetryAttempts:        3,
+			RetryInitialWaitTime: 60,
+			RetryWaitTime:        60,
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+		defer cancel()
+		jobs := make(chan job, 1)
+		results := make(chan Response, 1)
+		jobs <- job{batch: []models.Metric{m}}
+		close(jobs)
+		start := time.Now()
+		a.worker(ctx, jobs, results)
+
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.ErrorIs(t, (<-results).Err, context.DeadlineExceeded)
+	})
+
+	t.Run("shutdown interrupts request", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}))
+		defer server.Close()
+		defer close(release)
+
+		a, err := NewApp(server.Client(), log, &config.Config{
+			ServerURL:      server.URL + "/updates/",
+			ReportInterval: time.Second,
+		})
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+		defer cancel()
+		jobs := make(chan job, 1)
+		results := make(chan Response, 1)
+		jobs <- job{batch: []models.Metric{m}}
+		close(jobs)
+		start := time.Now()
+		a.worker(ctx, jobs, results)
+
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.ErrorIs(t, (<-results).Err, context.DeadlineExceeded)
+	})
+}
+
+func TestApp_spool(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	var online atomic.Bool
+	var mu sync.Mutex
+	var received []models.Metric
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !online.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gzr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []models.Metric
+		require.NoError(t, json.NewDecoder(gzr).Decode(&batch))
+		mu.Lock()
+		received = append(received, batch...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		ServerURL:      server.URL + "/updates/",
+		ReportInterval: time.Second,
+		PollInterval:   time.Second,
+		BatchSize:      10,
+		SpoolDir:       t.TempDir(),
+		SpoolMaxSize:   1,
+		SpoolMaxAge:    time.Hour,
+	}
+	a, err := NewApp(server.Client(), log, cfg)
+	require.NoError(t, err)
+
+	metric := func(name, mtype string, value any) models.Metric {
+		m, err := models.NewMetric(name, mtype, value)
+		require.NoError(t, err)
+		return m
+	}
+	// один отчет: пачки отправляются одним воркером, результаты обрабатываются resultHandler
+	report := func(collected ...models.Metric) {
+		jobs := make(chan job)
+		results := make(chan Response)
+		done := make(chan struct{})
+		go func() {
+			a.resultHandler(results)
+			close(done)
+		}()
+		go func() {
+			a.worker(context.TODO(), jobs, results)
+			close(results)
+		}()
+		a.report(context.TODO(), collected, jobs)
+		close(jobs)
+		<-done
+	}
+
+	report(metric("PollCount", "counter", 1), metric("Alloc", "gauge", 1))
+	report(metric("PollCount", "counter", 2), metric("Alloc", "gauge", 2))
+	assert.EqualValues(t, 2, a.SendStats.SpoolBatches.Load())
+	assert.Empty(t, received)
+
+	// агент перезапускается и находит очередь на диске
+	a, err = NewApp(server.Client(), log, cfg)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, a.SendStats.SpoolBatches.Load())
+
+	online.Store(true)
+	report(metric("PollCount", "counter", 4), metric("Alloc", "gauge", 4))
+	assert.Equal(t, []models.Metric{
+		metric("PollCount", "counter", 3),
+		metric("PollCount", "counter", 4),
+		metric("Alloc", "gauge", 4),
+	}, received)
+	assert.EqualValues(t, 0, a.SendStats.SpoolBatches.Load())
+	assert.EqualValues(t, 0, a.SendStats.SpoolBytes.Load())
+}
+
+func TestApp_counterDeltas(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	var fail atomic.Bool
+	var mu sync.Mutex
+	var received []models.Metric
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gzr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []models.Metric
+		require.NoError(t, json.NewDecoder(gzr).Decode(&batch))
+		mu.Lock()
+		received = append(received, batch...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a, err := NewApp(server.Client(), log, &config.Config{
+		ServerURL:      server.URL + "/updates/",
+		ReportInterval: time.Second,
+		PollInterval:   time.Second,
+		BatchSize:      10,
+		Collectors:     []config.CollectorConfig{{Name: "custom"}},
+	})
+	require.NoError(t, err)
+
+	poll := func(count int) {
+		for i := 0; i < count; i++ {
+			_, err := a.Collectors[0].Collect(context.TODO())
+			require.NoError(t, err)
+		}
+	}
+	report := func() {
+		jobs := make(chan job)
+		results := make(chan Response)
+		done := make(chan struct{})
+		go func() {
+			a.resultHandler(results)
+			close(done)
+		}()
+		go func() {
+			a.worker(context.TODO(), jobs, results)
+			close(results)
+		}()
+		a.report(context.TODO(), nil, jobs)
+		close(jobs)
+		<-done
+	}
+	pollCounts := func() []int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		var deltas []int64
+		for _, m := range received {
+			if m.ID == "PollCount" {
+				deltas = append(deltas, *m.Delta)
+			}
+		}
+		return deltas
+	}
+
+	poll(3)
+	report()
+	assert.Equal(t, []int64{3}, pollCounts())
+
+	// неудачная отправка не теряет и не дублирует приращения
+	poll(2)
+	fail.Store(true)
+	report()
+	assert.EqualValues(t, 2, a.Counters.Get("PollCount"))
+	fail.Store(false)
+	poll(1)
+	report()
+	assert.Equal(t, []int64{3, 3}, pollCounts())
+	assert.EqualValues(t, 0, a.Counters.Get("PollCount"))
+}
+
+func TestApp_spoolCounters(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	var fail atomic.Bool
+	var mu sync.Mutex
+	var received []models.Metric
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gzr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []models.Metric
+		require.NoError(t, json.NewDecoder(gzr).Decode(&batch))
+		mu.Lock()
+		received = append(received, batch...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{
+		ServerURL:      server.URL + "/updates/",
+		ReportInterval: time.Hour,
+		PollInterval:   time.Second,
+		RateLimit:      1,
+		BatchSize:      10,
+		SpoolDir:       t.TempDir(),
+		SpoolMaxSize:   1,
+		SpoolMaxAge:    time.Hour,
+		Collectors:     []config.CollectorConfig{{Name: "custom"}},
+	}
+	a, err := NewApp(server.Client(), log, cfg)
+	require.NoError(t, err)
+	report := func(a *App) {
+		jobs := make(chan job)
+		results := make(chan Response)
+		done := make(chan struct{})
+		go func() {
+			a.resultHandler(results)
+			close(done)
+		}()
+		go func() {
+			a.worker(context.TODO(), jobs, results)
+			close(results)
+		}()
+		a.report(context.TODO(), nil, jobs)
+		close(jobs)
+		<-done
+	}
+
+	// приращения из неудачной отправки уходят в очередь на диске, а не остаются в памяти
+	a.Counters.Add("PollCount", 3)
+	fail.Store(true)
+	report(a)
+	assert.EqualValues(t, 0, a.Counters.Get("PollCount"))
+	assert.EqualValues(t, 1, a.SendStats.SpoolBatches.Load())
+
+	// при остановке отложенное в памяти и накопленные приращения тоже сохраняются на диск
+	a.Counters.Add("PollCount", 2)
+	gauge, err := models.NewMetric("Alloc", "gauge", 1)
+	require.NoError(t, err)
+	a.requeue([]models.Metric{gauge})
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	require.NoError(t, a.Run(ctx))
+	assert.EqualValues(t, 2, a.SendStats.SpoolBatches.Load())
+
+	// после перезапуска первая попытка разобрать очередь не удается, но очередь не теряется
+	a, err = NewApp(server.Client(), log, cfg)
+	require.NoError(t, err)
+	report(a)
+	assert.EqualValues(t, 1, a.SendStats.SpoolBatches.Load())
+
+	fail.Store(false)
+	a.reachable.Store(true)
+	report(a)
+	pollCount, err := models.NewMetric("PollCount", "counter", 5)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metric{pollCount, gauge}, received)
+	assert.EqualValues(t, 0, a.SendStats.SpoolBatches.Load())
+}
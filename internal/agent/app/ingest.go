@@ -0,0 +1,147 @@
+package app
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// максимальный размер тела запроса от локального приложения
+const maxIngestBody = 1 << 20
+
+// checkIngestMetric проверяет метрику от локального приложения так же, как сервер
+func checkIngestMetric(m models.Metric) error {
+	if m.ID == "" {
+		return fmt.Errorf("field 'id' is required")
+	}
+	switch m.MType {
+	case models.Gauge.String():
+		if m.Value == nil || m.Delta != nil {
+			return fmt.Errorf("field 'value' is required and 'delta' is not allowed for gauge metrics")
+		}
+	case models.Counter.String():
+		if m.Delta == nil || m.Value != nil {
+			return fmt.Errorf("field 'delta' is required and 'value' is not allowed for counter metrics")
+		}
+	default:
+		return fmt.Errorf("unknown value of field 'type'. Should be 'gauge' or 'counter'")
+	}
+	return nil
+}
+
+// ingest добавляет метрики приложений к собранным: counter суммируются в Counters и списываются
+// только после ответа сервера, gauge попадают в Aggregator, в отчет уходит последнее значение
+func (a *App) ingest(received []models.Metric) {
+	var gauges []models.Metric
+	for _, m := range received {
+		if m.MType == models.Counter.String() {
+			a.Counters.Add(m.ID, *m.Delta)
+			continue
+		}
+		gauges = append(gauges, m)
+	}
+	a.Aggregator.Add(gauges)
+}
+
+// ingestHandler принимает метрики в формате /update/ и /updates/ сервера
+func (a *App) ingestHandler() http.Handler {
+	handle := func(batch bool) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodPost {
+				http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if contentType := req.Header.Get("Content-Type"); contentType != "application/json" {
+				http.Error(res, "Header 'Content-Type: application/json' is required", http.StatusBadRequest)
+				return
+			}
+
+			var body io.Reader = http.MaxBytesReader(res, req.Body, maxIngestBody)
+			if req.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(body)
+				if err != nil {
+					http.Error(res, fmt.Sprintf("Error reading gzip body: %v", err), http.StatusBadRequest)
+					return
+				}
+				defer gz.Close()
+				body = io.LimitReader(gz, maxIngestBody)
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				http.Error(res, fmt.Sprintf("Error reading body: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			var received []models.Metric
+			if batch {
+				err = json.Unmarshal(data, &received)
+			} else {
+				received = make([]models.Metric, 1)
+				err = json.Unmarshal(data, &received[0])
+			}
+			if err != nil {
+				http.Error(res, fmt.Sprintf("Error parsing JSON: %v", err), http.StatusBadRequest)
+				return
+			}
+			for _, m := range received {
+				if err = checkIngestMetric(m); err != nil {
+					http.Error(res, fmt.Sprintf("Metric '%v' is incorrect: %v", m.ID, err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			a.ingest(received)
+			a.Logger.Debugf("Received %v metrics from local application", len(received))
+			res.WriteHeader(http.StatusOK)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/update/", handle(false))
+	mux.Handle("/updates/", handle(true))
+	return mux
+}
+
+// listen открывает ListenAddress: 'unix:/path/to/socket' или 'host:port' на loopback интерфейсе.
+// Оставшийся от прошлого запуска сокет удаляется
+func (a *App) listen() (net.Listener, error) {
+	if err := config.CheckListenAddress(a.Config.ListenAddress); err != nil {
+		return nil, err
+	}
+	path, ok := strings.CutPrefix(a.Config.ListenAddress, "unix:")
+	if !ok {
+		return net.Listen("tcp", a.Config.ListenAddress)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("can not remove stale socket: %v", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// serveIngest принимает метрики приложений до отмены ctx
+func (a *App) serveIngest(ctx context.Context, l net.Listener) {
+	server := &http.Server{
+		Handler:           a.ingestHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	a.Logger.Infof("Accepting metrics from local applications on %v", a.Config.ListenAddress)
+	if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		a.Logger.Errorf("Local metrics listener stopped: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/metrics"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func metric(t *testing.T, name, mtype string, value any) models.Metric {
+	m, err := models.NewMetric(name, mtype, value)
+	require.NoError(t, err)
+	return m
+}
+
+func TestApp_ingestHandler(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	gzipped := func(body string) string {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(body))
+		w.Close()
+		return buf.String()
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		contentType  string
+		gzip         bool
+		body         string
+		wantStatus   int
+		wantGauges   []models.Metric
+		wantCounters []models.Metric
+	}{
+		{
+			name:       "single gauge",
+			path:       "/update/",
+			body:       `{"id":"Orders","type":"gauge","value":10.5}`,
+			wantStatus: http.StatusOK,
+			wantGauges: []models.Metric{metric(t, "Orders", "gauge", 10.5)},
+		},
+		{
+			name:         "batch: counters are summed, last gauge wins",
+			path:         "/updates/",
+			body:         `[{"id":"Requests","type":"counter","delta":2},{"id":"Queue","type":"gauge","value":1},{"id":"Requests","type":"counter","delta":3},{"id":"Queue","type":"gauge","value":7}]`,
+			wantStatus:   http.StatusOK,
+			wantGauges:   []models.Metric{metric(t, "Queue", "gauge", 7)},
+			wantCounters: []models.Metric{metric(t, "Requests", "counter", 5)},
+		},
+		{
+			name:         "gzipped batch",
+			path:         "/updates/",
+			gzip:         true,
+			body:         `[{"id":"Requests","type":"counter","delta":1}]`,
+			wantStatus:   http.StatusOK,
+			wantCounters: []models.Metric{metric(t, "Requests", "counter", 1)},
+		},
+		{
+			name:       "incorrect metric rejects whole batch",
+			path:       "/updates/",
+			body:       `[{"id":"Queue","type":"gauge","value":1},{"id":"Requests","type":"counter","value":1}]`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown type",
+			path:       "/update/",
+			body:       `{"id":"Orders","type":"histogram","value":1}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "broken json",
+			path:       "/update/",
+			body:       `{"id":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "incorrect content type",
+			path:        "/update/",
+			contentType: "text/plain",
+			body:        `{"id":"Orders","type":"gauge","value":1}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:       "incorrect method",
+			method:     http.MethodGet,
+			path:       "/updates/",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &App{Logger: log, Counters: metrics.NewCounters(), Aggregator: metrics.NewAggregator(nil)}
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			body := tt.body
+			if tt.gzip {
+				body = gzipped(body)
+			}
+			req := httptest.NewRequest(method, tt.path, bytes.NewBufferString(body))
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			req.Header.Set("Content-Type", contentType)
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			res := httptest.NewRecorder()
+
+			a.ingestHandler().ServeHTTP(res, req)
+
+			assert.Equal(t, tt.wantStatus, res.Code)
+			assert.Equal(t, tt.wantGauges, a.Aggregator.Flush())
+			assert.Equal(t, tt.wantCounters, a.Counters.Take())
+		})
+	}
+}
+
+func TestApp_serveIngestUnix(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+
+	// сокет от прошлого запуска
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	a := &App{
+		Logger:     log,
+		Config:     &config.Config{ListenAddress: "unix:" + socket},
+		Counters:   metrics.NewCounters(),
+		Aggregator: metrics.NewAggregator(nil),
+	}
+	l, err := a.listen()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.serveIngest(ctx, l)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	res, err := client.Post("http://agent/update/", "application/json", bytes.NewBufferString(`{"id":"Orders","type":"counter","delta":4}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []models.Metric{metric(t, "Orders", "counter", 4)}, a.Counters.Take())
+}
+
+func TestApp_listenRejectsExternalAddress(t *testing.T) {
+	a := &App{Config: &config.Config{ListenAddress: "0.0.0.0:0"}}
+	_, err := a.listen()
+	assert.ErrorContains(t, err, "is not a loopback address")
+
+	a.Config.ListenAddress = "127.0.0.1:0"
+	l, err := a.listen()
+	require.NoError(t, err)
+	l.Close()
+}
@@ -3,24 +3,250 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	ServerUseHTTPS       bool
-	ServerURL            string
-	PollInterval         time.Duration
-	ReportInterval       time.Duration
-	LogLevel             string
-	BatchSize            int
-	RetryAttempts        int
-	RetryWaitTime        int
+	ServerUseHTTPS bool
+	// ServerAddr адрес сервера (host:port), по нему проверяется TLS сертификат сервера
+	ServerAddr     string
+	ServerURL      string
+	PollInterval   time.Duration
+	ReportInterval time.Duration
+	LogLevel       string
+	BatchSize      int
+	// RetryAttempts количество повторов отправки пачки
+	RetryAttempts int
+	// RetryWaitTime максимальная пауза между повторами (в секундах)
+	RetryWaitTime int
+	// RetryInitialWaitTime пауза перед первым повтором (в секундах), с каждым повтором удваивается
 	RetryInitialWaitTime int
 	ClientTimeout        int
 	CryptKey             string
 	RateLimit            int
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSCAFile            string
+	Token                string
+	// SpoolDir каталог очереди неотправленных пачек на диске. Пустой - очередь отключена
+	SpoolDir string
+	// SpoolMaxSize максимальный размер очереди на диске (в мегабайтах)
+	SpoolMaxSize int
+	// SpoolMaxAge максимальный возраст пачки в очереди
+	SpoolMaxAge time.Duration
+	// Collectors включенные коллекторы метрик. Пустой список - все доступные
+	Collectors []CollectorConfig
+	// Filters фильтры коллекторов по именам: устройств, точек монтирования и интерфейсов
+	// для коллекторов хоста и метрик для остальных
+	Filters map[string]Filter
+	// Processes процессы, метрики которых собирает коллектор process
+	Processes []ProcessMatcher
+	// CgroupPath каталог cgroup v2 агента. Пустой - определяется по /proc/self/cgroup
+	CgroupPath string
+	// ListenAddress адрес приема метрик от локальных приложений: 'host:port' на loopback интерфейсе
+	// или 'unix:/path/to/socket'. Пустой - прием выключен
+	ListenAddress string
+	// Aggregations правила агрегации значений gauge между отчетами
+	Aggregations []AggregationRule
+}
+
+// Filter шаблоны имен в формате path.Match. Имя проходит фильтр, если подходит под один из Include
+// (или Include пуст) и не подходит ни под один из Exclude
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+// Allows проходит ли имя фильтр
+func (f Filter) Allows(name string) bool {
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFilters разбирает фильтры коллекторов вида 'diskio=!loop*+!ram*,net=eth*+en*'.
+// Шаблоны с '!' исключают имена, остальные - оставляют только подходящие
+func parseFilters(list string) (map[string]Filter, error) {
+	filters := make(map[string]Filter)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, patterns, found := strings.Cut(item, "=")
+		if !found || name == "" || patterns == "" {
+			return nil, fmt.Errorf("incorrect collector filter '%v'. Should be 'collector=pattern+!pattern'", item)
+		}
+		if _, ok := filters[name]; ok {
+			return nil, fmt.Errorf("filter of collector '%v' is specified more than once", name)
+		}
+		var filter Filter
+		for _, pattern := range strings.Split(patterns, "+") {
+			exclude := strings.HasPrefix(pattern, "!")
+			pattern = strings.TrimPrefix(pattern, "!")
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return nil, fmt.Errorf("incorrect pattern '%v' in filter of collector '%v'", pattern, name)
+			}
+			if exclude {
+				filter.Exclude = append(filter.Exclude, pattern)
+			} else {
+				filter.Include = append(filter.Include, pattern)
+			}
+		}
+		filters[name] = filter
+	}
+	return filters, nil
+}
+
+// ProcessMatcher группа процессов с именем Label: процессы, имя или командная строка которых подходит под Pattern,
+// или процесс из PIDFile
+type ProcessMatcher struct {
+	Label   string
+	Pattern *regexp.Regexp
+	PIDFile string
+}
+
+// parseProcesses разбирает группы процессов вида 'web=^nginx;db=@/run/postgresql.pid'.
+// Группы разделяются ';', т.к. в регулярном выражении может быть запятая
+func parseProcesses(list string) ([]ProcessMatcher, error) {
+	var processes []ProcessMatcher
+	for _, item := range strings.Split(list, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		label, matcher, found := strings.Cut(item, "=")
+		if !found || label == "" || matcher == "" {
+			return nil, fmt.Errorf("incorrect process group '%v'. Should be 'label=regexp' or 'label=@pidfile'", item)
+		}
+		for _, existing := range processes {
+			if existing.Label == label {
+				return nil, fmt.Errorf("process group '%v' is specified more than once", label)
+			}
+		}
+		p := ProcessMatcher{Label: label}
+		if pidFile, ok := strings.CutPrefix(matcher, "@"); ok {
+			p.PIDFile = pidFile
+		} else {
+			pattern, err := regexp.Compile(matcher)
+			if err != nil {
+				return nil, fmt.Errorf("incorrect regexp of process group '%v': %v", label, err)
+			}
+			p.Pattern = pattern
+		}
+		processes = append(processes, p)
+	}
+	return processes, nil
+}
+
+// AggregationRule агрегаты, которые считаются по всем значениям метрик Pattern за интервал отчета.
+// Pattern - шаблон имени в формате path.Match
+type AggregationRule struct {
+	Pattern string
+	Funcs   []string
+}
+
+// AggregationFuncs доступные функции агрегации
+var AggregationFuncs = []string{"last", "min", "max", "avg", "p95"}
+
+// parseAggregations разбирает правила агрегации вида 'CPUutilization*=max+p95,FreeMemory=min'
+func parseAggregations(list string) ([]AggregationRule, error) {
+	var rules []AggregationRule
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, funcs, found := strings.Cut(item, "=")
+		if !found || pattern == "" || funcs == "" {
+			return nil, fmt.Errorf("incorrect aggregation rule '%v'. Should be 'pattern=func+func'", item)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("incorrect pattern '%v': %v", pattern, err)
+		}
+		rule := AggregationRule{Pattern: pattern}
+		for _, f := range strings.Split(funcs, "+") {
+			if !slices.Contains(AggregationFuncs, f) {
+				return nil, fmt.Errorf("unknown aggregation function '%v'. Available functions: %v", f, AggregationFuncs)
+			}
+			if !slices.Contains(rule.Funcs, f) {
+				rule.Funcs = append(rule.Funcs, f)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// CheckListenAddress проверяет адрес приема метрик от локальных приложений. Прием идет без аутентификации,
+// поэтому TCP адрес допускается только на loopback интерфейсе
+func CheckListenAddress(address string) error {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("socket path is required in listen address 'unix:'")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("incorrect listen address '%v': %v", address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("listen address '%v' is not a loopback address: ingest has no authentication, "+
+			"use 'localhost:port' or 'unix:/path/to/socket'", address)
+	}
+	return nil
+}
+
+// CollectorConfig коллектор и его интервал сбора. Нулевой интервал - PollInterval
+type CollectorConfig struct {
+	Name     string
+	Interval time.Duration
+}
+
+// parseCollectors разбирает список коллекторов вида 'runtime,psutil:10', интервал указывается в секундах
+func parseCollectors(list string) ([]CollectorConfig, error) {
+	var collectors []CollectorConfig
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, interval, found := strings.Cut(item, ":")
+		c := CollectorConfig{Name: name}
+		if found {
+			seconds, err := strconv.Atoi(interval)
+			if err != nil || seconds < 1 {
+				return nil, fmt.Errorf("incorrect interval '%v' of collector '%v'", interval, name)
+			}
+			c.Interval = time.Second * time.Duration(seconds)
+		}
+		for _, existing := range collectors {
+			if existing.Name == name {
+				return nil, fmt.Errorf("collector '%v' is specified more than once", name)
+			}
+		}
+		collectors = append(collectors, c)
+	}
+	return collectors, nil
 }
 
 func NewConfig() (*Config, error) {
@@ -31,12 +257,27 @@ func NewConfig() (*Config, error) {
 	pollInterval := flag.String("p", "2", "Interval for scraping metrics (in seconds)")
 	reportInterval := flag.String("r", "10", "Interval for sending metrics (in seconds)")
 	logLevel := flag.String("log", "debug", "Log level")
-	batchSize := flag.String("b", "50", "Batch size")
+	batchSize := flag.String("b", "50", "Maximum count of metrics in one request")
 	cryptKey := flag.String("k", "", "Crypt key for signing requests")
 	rateLimit := flag.String("l", "10", "Count of the concurrent requests")
+	token := flag.String("t", "", "Bearer token for the server authentication")
+	tlsCertFile := flag.String("tls-cert", "", "Path to the client TLS certificate (mutual TLS)")
+	tlsKeyFile := flag.String("tls-key", "", "Path to the client TLS private key (mutual TLS)")
+	tlsCAFile := flag.String("tls-ca", "", "Path to the CA bundle for verifying the server certificate")
+	spoolDir := flag.String("spool-dir", "", "Directory for batches which can not be sent to the server (disabled by default)")
+	spoolMaxSize := flag.String("spool-max-size", "100", "Maximum size of the spool directory (in megabytes)")
+	spoolMaxAge := flag.String("spool-max-age", "86400", "Maximum age of the spooled batch (in seconds)")
+	filters := flag.String("collector-filter", "diskio=!loop*+!ram*,net=!lo", "Comma separated filters of collectors, e.g. 'diskio=!loop*,net=eth*+!veth*'. Patterns with '!' exclude devices, mounts, interfaces or metrics")
+	processes := flag.String("processes", "", "Semicolon separated process groups for the process collector, e.g. 'web=^nginx;db=@/run/postgresql.pid' (regexp of name or command line, or @pidfile)")
+	cgroupPath := flag.String("cgroup-path", "", "Path to the cgroup v2 directory of the agent (detected from /proc/self/cgroup by default)")
+	listenAddress := flag.String("listen", "", "Address to accept metrics from local applications in the server JSON format, loopback 'host:port' or 'unix:/path/to/socket' (disabled by default)")
+	aggregations := flag.String("aggregate", "", "Comma separated aggregation rules for gauges between reports, e.g. 'CPUutilization*=max+avg+p95,FreeMemory=min'. Functions: last, min, max, avg, p95")
+	collectors := flag.String("collectors", "", "Comma separated list of enabled collectors with optional interval in seconds, e.g. 'runtime,psutil:10' (all except cgroup by default)")
+
+	retryAttempts := flag.String("retry-attempts", "3", "Count of retries for the failed request")
+	retryInitialWaitTime := flag.String("retry-initial-wait", "1", "Maximum wait before the first retry (in seconds), doubles with each retry")
+	retryWaitTime := flag.String("retry-max-wait", "30", "Maximum wait between retries (in seconds)")
 
-	retryAttempts := 3
-	retryWaitTime := 2
 	clientTimeout := 10
 
 	flag.Parse()
@@ -65,6 +306,63 @@ func NewConfig() (*Config, error) {
 	if e := os.Getenv("RATE_LIMIT"); e != "" {
 		rateLimit = &e
 	}
+	if e := os.Getenv("TOKEN"); e != "" {
+		token = &e
+	}
+	if e := os.Getenv("TLS_CERT_FILE"); e != "" {
+		tlsCertFile = &e
+	}
+	if e := os.Getenv("TLS_KEY_FILE"); e != "" {
+		tlsKeyFile = &e
+	}
+	if e := os.Getenv("TLS_CA_FILE"); e != "" {
+		tlsCAFile = &e
+	}
+	if e := os.Getenv("RETRY_ATTEMPTS"); e != "" {
+		retryAttempts = &e
+	}
+	if e := os.Getenv("RETRY_INITIAL_WAIT"); e != "" {
+		retryInitialWaitTime = &e
+	}
+	if e := os.Getenv("RETRY_MAX_WAIT"); e != "" {
+		retryWaitTime = &e
+	}
+	if e := os.Getenv("SPOOL_DIR"); e != "" {
+		spoolDir = &e
+	}
+	if e := os.Getenv("SPOOL_MAX_SIZE"); e != "" {
+		spoolMaxSize = &e
+	}
+	if e := os.Getenv("SPOOL_MAX_AGE"); e != "" {
+		spoolMaxAge = &e
+	}
+	// пустое значение отключает фильтры по умолчанию
+	if e, ok := os.LookupEnv("COLLECTOR_FILTER"); ok {
+		filters = &e
+	}
+	if e := os.Getenv("PROCESSES"); e != "" {
+		processes = &e
+	}
+	if e := os.Getenv("CGROUP_PATH"); e != "" {
+		cgroupPath = &e
+	}
+	if e := os.Getenv("LISTEN_ADDRESS"); e != "" {
+		listenAddress = &e
+	}
+	if e := os.Getenv("AGGREGATE"); e != "" {
+		aggregations = &e
+	}
+	if e := os.Getenv("COLLECTORS"); e != "" {
+		collectors = &e
+	}
+	if *listenAddress != "" {
+		if err := CheckListenAddress(*listenAddress); err != nil {
+			return nil, err
+		}
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return nil, fmt.Errorf("TLS certificate and key must be specified together")
+	}
 	reportIntervalInt, err := strconv.Atoi(*reportInterval)
 	if err != nil {
 		return nil, err
@@ -80,6 +378,9 @@ func NewConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if batchSizeInt < 1 {
+		return nil, fmt.Errorf("batch size must be positive")
+	}
 
 	serverUseHTTPSBool, err := strconv.ParseBool(*serverUseHTTPS)
 	if err != nil {
@@ -91,6 +392,51 @@ func NewConfig() (*Config, error) {
 		return nil, err
 	}
 
+	retryAttemptsInt, err := strconv.Atoi(*retryAttempts)
+	if err != nil {
+		return nil, err
+	}
+	retryInitialWaitTimeInt, err := strconv.Atoi(*retryInitialWaitTime)
+	if err != nil {
+		return nil, err
+	}
+	retryWaitTimeInt, err := strconv.Atoi(*retryWaitTime)
+	if err != nil {
+		return nil, err
+	}
+	if retryAttemptsInt < 0 || retryInitialWaitTimeInt < 0 || retryWaitTimeInt < retryInitialWaitTimeInt {
+		return nil, fmt.Errorf("retry settings must not be negative and max wait must not be less than initial wait")
+	}
+
+	spoolMaxSizeInt, err := strconv.Atoi(*spoolMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	spoolMaxAgeInt, err := strconv.Atoi(*spoolMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	if spoolMaxSizeInt < 1 || spoolMaxAgeInt < 1 {
+		return nil, fmt.Errorf("spool size and age limits must be positive")
+	}
+
+	collectorsList, err := parseCollectors(*collectors)
+	if err != nil {
+		return nil, err
+	}
+	filtersMap, err := parseFilters(*filters)
+	if err != nil {
+		return nil, err
+	}
+	processMatchers, err := parseProcesses(*processes)
+	if err != nil {
+		return nil, err
+	}
+	aggregationRules, err := parseAggregations(*aggregations)
+	if err != nil {
+		return nil, err
+	}
+
 	if serverUseHTTPSBool {
 		serverURL = fmt.Sprintf("https://%v/updates/", *serverAddr)
 	} else {
@@ -98,16 +444,31 @@ func NewConfig() (*Config, error) {
 	}
 
 	return &Config{
-		ServerUseHTTPS: serverUseHTTPSBool,
-		ServerURL:      serverURL,
-		LogLevel:       *logLevel,
-		PollInterval:   time.Second * time.Duration(pollIntervalInt),
-		ReportInterval: time.Second * time.Duration(reportIntervalInt),
-		BatchSize:      batchSizeInt,
-		RetryAttempts:  retryAttempts,
-		RetryWaitTime:  retryWaitTime,
-		ClientTimeout:  clientTimeout,
-		CryptKey:       *cryptKey,
-		RateLimit:      rateLimitInt,
+		ServerUseHTTPS:       serverUseHTTPSBool,
+		ServerAddr:           *serverAddr,
+		ServerURL:            serverURL,
+		LogLevel:             *logLevel,
+		PollInterval:         time.Second * time.Duration(pollIntervalInt),
+		ReportInterval:       time.Second * time.Duration(reportIntervalInt),
+		BatchSize:            batchSizeInt,
+		RetryAttempts:        retryAttemptsInt,
+		RetryWaitTime:        retryWaitTimeInt,
+		RetryInitialWaitTime: retryInitialWaitTimeInt,
+		ClientTimeout:        clientTimeout,
+		CryptKey:             *cryptKey,
+		RateLimit:            rateLimitInt,
+		TLSCertFile:          *tlsCertFile,
+		TLSKeyFile:           *tlsKeyFile,
+		TLSCAFile:            *tlsCAFile,
+		Token:                *token,
+		SpoolDir:             *spoolDir,
+		SpoolMaxSize:         spoolMaxSizeInt,
+		SpoolMaxAge:          time.Second * time.Duration(spoolMaxAgeInt),
+		Collectors:           collectorsList,
+		Filters:              filtersMap,
+		Processes:            processMatchers,
+		CgroupPath:           *cgroupPath,
+		ListenAddress:        *listenAddress,
+		Aggregations:         aggregationRules,
 	}, nil
 }
@@ -45,3 +45,161 @@ func TestNewConfig(t *testing.T) {
 		assert.Equal(t, time.Second*time.Duration(ReportIntervalInt), gotConfig.(*Config).ReportInterval)
 	})
 }
+
+func TestParseCollectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []CollectorConfig
+		wantErr string
+	}{
+		{name: "empty list", list: ""},
+		{
+			name: "collectors with intervals",
+			list: "runtime, psutil:10",
+			want: []CollectorConfig{{Name: "runtime"}, {Name: "psutil", Interval: 10 * time.Second}},
+		},
+		{name: "incorrect interval", list: "psutil:0", wantErr: "incorrect interval '0' of collector 'psutil'"},
+		{name: "duplicate collector", list: "runtime,runtime:5", wantErr: "collector 'runtime' is specified more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCollectors(tt.list)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseAggregations(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    []AggregationRule
+		wantErr string
+	}{
+		{name: "empty list", list: ""},
+		{
+			name: "several rules",
+			list: "CPUutilization*=max+p95+max, FreeMemory=min",
+			want: []AggregationRule{
+				{Pattern: "CPUutilization*", Funcs: []string{"max", "p95"}},
+				{Pattern: "FreeMemory", Funcs: []string{"min"}},
+			},
+		},
+		{name: "unknown function", list: "Alloc=median", wantErr: "unknown aggregation function 'median'. Available functions: [last min max avg p95]"},
+		{name: "rule without functions", list: "Alloc", wantErr: "incorrect aggregation rule 'Alloc'. Should be 'pattern=func+func'"},
+		{name: "incorrect pattern", list: "[=max", wantErr: "incorrect pattern '[': syntax error in pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAggregations(tt.list)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    map[string]Filter
+		wantErr string
+	}{
+		{name: "empty list", list: "", want: map[string]Filter{}},
+		{
+			name: "include and exclude",
+			list: "diskio=!loop*+!ram*, net=eth*+!eth1",
+			want: map[string]Filter{
+				"diskio": {Exclude: []string{"loop*", "ram*"}},
+				"net":    {Include: []string{"eth*"}, Exclude: []string{"eth1"}},
+			},
+		},
+		{name: "filter without patterns", list: "net=", wantErr: "incorrect collector filter 'net='. Should be 'collector=pattern+!pattern'"},
+		{name: "empty pattern", list: "net=!", wantErr: "incorrect pattern '' in filter of collector 'net'"},
+		{name: "duplicate filter", list: "net=lo,net=eth0", wantErr: "filter of collector 'net' is specified more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFilters(tt.list)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFilter_Allows(t *testing.T) {
+	f := Filter{Include: []string{"eth*", "en*"}, Exclude: []string{"eth1"}}
+	assert.True(t, f.Allows("eth0"))
+	assert.True(t, f.Allows("enp3s0"))
+	assert.False(t, f.Allows("eth1"))
+	assert.False(t, f.Allows("lo"))
+	assert.True(t, Filter{}.Allows("lo"))
+}
+
+func TestParseProcesses(t *testing.T) {
+	got, err := parseProcesses("web=^nginx(,|:);db=@/run/postgresql.pid")
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, "web", got[0].Label)
+	assert.True(t, got[0].Pattern.MatchString("nginx: worker"))
+	assert.Equal(t, ProcessMatcher{Label: "db", PIDFile: "/run/postgresql.pid"}, got[1])
+
+	tests := []struct {
+		name    string
+		list    string
+		wantErr string
+	}{
+		{name: "group without matcher", list: "web", wantErr: "incorrect process group 'web'. Should be 'label=regexp' or 'label=@pidfile'"},
+		{name: "incorrect regexp", list: "web=(nginx", wantErr: "incorrect regexp of process group 'web': error parsing regexp: missing closing ): `(nginx`"},
+		{name: "duplicate group", list: "web=nginx;web=apache", wantErr: "process group 'web' is specified more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseProcesses(tt.list)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheckListenAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{name: "unix socket", address: "unix:/run/agent.sock"},
+		{name: "unix socket without path", address: "unix:", wantErr: true},
+		{name: "loopback ipv4", address: "127.0.0.1:8125"},
+		{name: "loopback ipv6", address: "[::1]:8125"},
+		{name: "localhost", address: "localhost:8125"},
+		{name: "all interfaces", address: ":8125", wantErr: true},
+		{name: "unspecified address", address: "0.0.0.0:8125", wantErr: true},
+		{name: "external address", address: "10.0.0.1:8125", wantErr: true},
+		{name: "host name", address: "example.com:8125", wantErr: true},
+		{name: "without port", address: "127.0.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckListenAddress(tt.address)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"math"
+	"path"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// series значения метрики за интервал отчета
+type series struct {
+	metric models.Metric
+	// все значения gauge, только если для метрики есть правило агрегации
+	samples []float64
+	funcs   []string
+}
+
+// Aggregator собирает значения метрик между отчетами. Для gauge в отчет уходит последнее значение
+// и агрегаты по правилам (метрики с суффиксами _min, _max, _avg, _p95), counter суммируются
+type Aggregator struct {
+	rules  []config.AggregationRule
+	mu     sync.Mutex
+	series map[string]*series
+	// порядок первого появления метрик
+	order []string
+}
+
+func NewAggregator(rules []config.AggregationRule) *Aggregator {
+	return &Aggregator{
+		rules:  rules,
+		series: make(map[string]*series),
+	}
+}
+
+// funcsFor функции агрегации первого подходящего правила
+func (a *Aggregator) funcsFor(name string) []string {
+	for _, rule := range a.rules {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Funcs
+		}
+	}
+	return nil
+}
+
+// Add добавляет значения метрик очередного опроса
+func (a *Aggregator) Add(metrics []models.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, m := range metrics {
+		key := m.MType + "/" + m.ID
+		s, ok := a.series[key]
+		if !ok {
+			s = &series{}
+			if m.MType == models.Gauge.String() {
+				s.funcs = a.funcsFor(m.ID)
+			}
+			a.series[key] = s
+			a.order = append(a.order, key)
+		}
+		switch {
+		case m.MType == models.Counter.String() && m.Delta != nil && s.metric.Delta != nil:
+			sum := *s.metric.Delta + *m.Delta
+			s.metric = m.Clone()
+			s.metric.Delta = &sum
+		default:
+			s.metric = m.Clone()
+		}
+		if len(s.funcs) > 0 && m.Value != nil {
+			s.samples = append(s.samples, *m.Value)
+		}
+	}
+}
+
+// Flush возвращает метрики и агрегаты за интервал и начинает новый интервал
+func (a *Aggregator) Flush() []models.Metric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var result []models.Metric
+	for _, key := range a.order {
+		s := a.series[key]
+		result = append(result, s.metric)
+		if len(s.samples) == 0 {
+			continue
+		}
+		for _, f := range s.funcs {
+			if f == "last" {
+				continue
+			}
+			value := aggregate(f, s.samples)
+			result = append(result, models.Metric{ID: s.metric.ID + "_" + f, MType: models.Gauge.String(), Value: &value})
+		}
+	}
+	clear(a.series)
+	a.order = nil
+	return result
+}
+
+func aggregate(f string, samples []float64) float64 {
+	switch f {
+	case "min":
+		return slices.Min(samples)
+	case "max":
+		return slices.Max(samples)
+	case "avg":
+		var sum float64
+		for _, v := range samples {
+			sum += v
+		}
+		return sum / float64(len(samples))
+	case "p95":
+		// nearest-rank перцентиль
+		sorted := append([]float64(nil), samples...)
+		sort.Float64s(sorted)
+		rank := int(math.Ceil(0.95 * float64(len(sorted))))
+		return sorted[max(rank, 1)-1]
+	}
+	return samples[len(samples)-1]
+}
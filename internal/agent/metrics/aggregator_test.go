@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	gauge := func(name string, value float64) models.Metric {
+		m, err := models.NewMetric(name, "gauge", value)
+		require.NoError(t, err)
+		return m
+	}
+
+	rules := []config.AggregationRule{
+		{Pattern: "CPUutilization*", Funcs: []string{"last", "min", "max", "avg", "p95"}},
+		{Pattern: "*Memory", Funcs: []string{"min"}},
+	}
+
+	tests := []struct {
+		name  string
+		polls [][]models.Metric
+		want  []models.Metric
+	}{
+		{
+			name: "metrics without rules report last value",
+			polls: [][]models.Metric{
+				{gauge("Alloc", 1), counter(t, "Requests", 2)},
+				{gauge("Alloc", 3), counter(t, "Requests", 5)},
+			},
+			want: []models.Metric{gauge("Alloc", 3), counter(t, "Requests", 7)},
+		},
+		{
+			name: "cpu spike is not lost",
+			polls: [][]models.Metric{
+				{gauge("CPUutilization1", 10)},
+				{gauge("CPUutilization1", 95)},
+				{gauge("CPUutilization1", 20)},
+				{gauge("CPUutilization1", 15)},
+			},
+			want: []models.Metric{
+				gauge("CPUutilization1", 15),
+				gauge("CPUutilization1_min", 10),
+				gauge("CPUutilization1_max", 95),
+				gauge("CPUutilization1_avg", 35),
+				gauge("CPUutilization1_p95", 95),
+			},
+		},
+		{
+			name: "first matching rule is used",
+			polls: [][]models.Metric{
+				{gauge("FreeMemory", 5), gauge("TotalMemory", 10)},
+				{gauge("FreeMemory", 2), gauge("TotalMemory", 10)},
+			},
+			want: []models.Metric{
+				gauge("FreeMemory", 2),
+				gauge("FreeMemory_min", 2),
+				gauge("TotalMemory", 10),
+				gauge("TotalMemory_min", 10),
+			},
+		},
+		{name: "nothing collected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAggregator(rules)
+			for _, poll := range tt.polls {
+				a.Add(poll)
+			}
+			assert.Equal(t, tt.want, a.Flush())
+			assert.Empty(t, a.Flush())
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	samples := make([]float64, 0, 100)
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, float64(i))
+	}
+	tests := []struct {
+		f       string
+		samples []float64
+		want    float64
+	}{
+		{f: "last", samples: samples, want: 1},
+		{f: "min", samples: samples, want: 1},
+		{f: "max", samples: samples, want: 100},
+		{f: "avg", samples: samples, want: 50.5},
+		{f: "p95", samples: samples, want: 95},
+		{f: "p95", samples: []float64{7}, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.f, func(t *testing.T) {
+			assert.Equal(t, tt.want, aggregate(tt.f, tt.samples))
+		})
+	}
+}
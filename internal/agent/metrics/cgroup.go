@@ -0,0 +1,245 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgroupDir каталог cgroup v2 текущего процесса: строка '0::<путь>' из procCgroup относительно root
+func cgroupDir(procCgroup, root string) (string, error) {
+	data, err := os.ReadFile(procCgroup)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(root, p), nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 is not available")
+}
+
+// CgroupCollector лимиты и потребление ресурсов cgroup v2, в которой работает агент (контейнер).
+// Файлы читаются напрямую из каталога cgroup, отсутствующие файлы (выключенные контроллеры) пропускаются.
+// Накопительные счетчики cpu.stat и io.stat отправляются приращениями через Counters.
+// Фильтр применяется к именам метрик, в том числе счетчиков, до отправки в Counters
+type CgroupCollector struct {
+	dir      string
+	filter   config.Filter
+	interval time.Duration
+	deltas   *deltas
+	// ошибка определения каталога, возвращается при каждом сборе
+	err error
+}
+
+// NewCgroupCollector создает коллектор для каталога dir. Если dir пуст, каталог определяется по /proc/self/cgroup
+func NewCgroupCollector(dir string, counters *Counters, filter config.Filter, interval time.Duration) *CgroupCollector {
+	c := &CgroupCollector{dir: dir, filter: filter, interval: interval, deltas: newDeltas(counters)}
+	if c.dir == "" {
+		c.dir, c.err = cgroupDir("/proc/self/cgroup", "/sys/fs/cgroup")
+	}
+	if c.err == nil {
+		// cgroup.controllers есть только в иерархии cgroup v2
+		if _, err := os.Stat(filepath.Join(c.dir, "cgroup.controllers")); err != nil {
+			c.err = fmt.Errorf("cgroup v2 is not available in %v: %v", c.dir, err)
+		}
+	}
+	return c
+}
+
+func (c *CgroupCollector) Name() string {
+	return "cgroup"
+}
+
+func (c *CgroupCollector) Interval() time.Duration {
+	return c.interval
+}
+
+// readValue значение однострочного файла. Для отсутствующего файла или значения 'max' (без лимита) ok = false
+func (c *CgroupCollector) readValue(name string) (value string, ok bool, err error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	value = strings.TrimSpace(string(data))
+	return value, value != "max", nil
+}
+
+func (c *CgroupCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var metrics []models.Metric
+
+	gauges := []struct {
+		file   string
+		metric string
+	}{
+		{file: "memory.current", metric: "CgroupMemoryCurrent"},
+		{file: "memory.max", metric: "CgroupMemoryMax"},
+		{file: "memory.swap.current", metric: "CgroupSwapCurrent"},
+		{file: "pids.current", metric: "CgroupPidsCurrent"},
+		{file: "pids.max", metric: "CgroupPidsMax"},
+	}
+	for _, g := range gauges {
+		if !c.filter.Allows(g.metric) {
+			continue
+		}
+		value, ok, err := c.readValue(g.file)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		m, err := models.NewMetric(g.metric, "gauge", value)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect value of %v: %v", g.file, err)
+		}
+		metrics = append(metrics, m)
+	}
+
+	// cpu.max: '<квота> <период>', лимит в ядрах. Квота 'max' - без лимита
+	value, ok, err := c.readValue("cpu.max")
+	if err != nil {
+		return nil, err
+	}
+	if quota, period, found := strings.Cut(value, " "); ok && found && quota != "max" && c.filter.Allows("CgroupCPULimit") {
+		q, errQ := strconv.ParseFloat(quota, 64)
+		p, errP := strconv.ParseFloat(period, 64)
+		if errQ != nil || errP != nil || p == 0 {
+			return nil, fmt.Errorf("incorrect value of cpu.max: '%v'", value)
+		}
+		m, _ := models.NewMetric("CgroupCPULimit", "gauge", q/p)
+		metrics = append(metrics, m)
+	}
+
+	cpuStat, err := c.readKeyed("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	cpuCounters := []struct {
+		key    string
+		metric string
+	}{
+		{key: "usage_usec", metric: "CgroupCPUUsageUsec"},
+		{key: "user_usec", metric: "CgroupCPUUserUsec"},
+		{key: "system_usec", metric: "CgroupCPUSystemUsec"},
+		{key: "nr_throttled", metric: "CgroupCPUThrottledPeriods"},
+		{key: "throttled_usec", metric: "CgroupCPUThrottledUsec"},
+	}
+	for _, cc := range cpuCounters {
+		if v, ok := cpuStat[cc.key]; ok && c.filter.Allows(cc.metric) {
+			c.deltas.add(cc.metric, v)
+		}
+	}
+
+	ioStat, err := c.readIOStat()
+	if err != nil {
+		return nil, err
+	}
+	ioCounters := []struct {
+		key    string
+		metric string
+	}{
+		{key: "rbytes", metric: "CgroupIOReadBytes"},
+		{key: "wbytes", metric: "CgroupIOWriteBytes"},
+		{key: "rios", metric: "CgroupIOReads"},
+		{key: "wios", metric: "CgroupIOWrites"},
+	}
+	// приращения считаются по каждому устройству и потом складываются: если сложить сами счетчики,
+	// пропавшее устройство выглядело бы как сброс суммы, а новое - как скачок
+	for _, ic := range ioCounters {
+		if !c.filter.Allows(ic.metric) {
+			continue
+		}
+		var sum int64
+		found := false
+		for device, stat := range ioStat {
+			v, ok := stat[ic.key]
+			if !ok {
+				continue
+			}
+			if delta, ok := c.deltas.delta(ic.metric+"/"+device, v); ok {
+				sum += delta
+				found = true
+			}
+		}
+		if found {
+			c.deltas.counters.Add(ic.metric, sum)
+		}
+	}
+
+	return metrics, nil
+}
+
+// readKeyed разбирает файл со строками '<ключ> <значение>'
+func (c *CgroupCollector) readKeyed(name string) (map[string]uint64, error) {
+	file, err := os.Open(filepath.Join(c.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect value of %v in %v: %v", key, name, err)
+		}
+		result[key] = v
+	}
+	return result, scanner.Err()
+}
+
+// readIOStat разбирает строки io.stat вида '<major:minor> rbytes=1 wbytes=2 ...' в значения по устройствам
+func (c *CgroupCollector) readIOStat() (map[string]map[string]uint64, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, "io.stat"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		stat := make(map[string]uint64)
+		result[fields[0]] = stat
+		for _, field := range fields[1:] {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("incorrect value of %v in io.stat: %v", key, err)
+			}
+			stat[key] = v
+		}
+	}
+	return result, nil
+}
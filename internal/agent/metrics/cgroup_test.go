@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCgroupDir(t *testing.T) {
+	tests := []struct {
+		name       string
+		procCgroup string
+		want       string
+		wantErr    string
+	}{
+		{name: "cgroup v2", procCgroup: "testdata/cgroup/proc-self-cgroup", want: "/sys/fs/cgroup/system.slice/agent.service"},
+		{name: "cgroup v1", procCgroup: "testdata/cgroup/v1/proc-self-cgroup", wantErr: "cgroup v2 is not available"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cgroupDir(tt.procCgroup, "/sys/fs/cgroup")
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCgroupCollector(t *testing.T) {
+	gauge := func(name string, value float64) models.Metric {
+		m, err := models.NewMetric(name, "gauge", value)
+		require.NoError(t, err)
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		want    []models.Metric
+		wantErr bool
+	}{
+		{
+			name: "container with limits",
+			dir:  "testdata/cgroup/limited",
+			want: []models.Metric{
+				gauge("CgroupMemoryCurrent", 104857600),
+				gauge("CgroupMemoryMax", 536870912),
+				gauge("CgroupSwapCurrent", 0),
+				gauge("CgroupPidsCurrent", 12),
+				gauge("CgroupPidsMax", 1024),
+				gauge("CgroupCPULimit", 1.5),
+			},
+		},
+		{
+			name: "container without limits",
+			dir:  "testdata/cgroup/unlimited",
+			want: []models.Metric{gauge("CgroupMemoryCurrent", 2048)},
+		},
+		{
+			name:    "not a cgroup v2 directory",
+			dir:     "testdata/cgroup/v1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewCgroupCollector(tt.dir, NewCounters(), config.Filter{}, time.Second).Collect(context.TODO())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// copyLimited копирует файлы testdata/cgroup/limited во временный каталог, чтобы их можно было менять
+	copyLimited := func(t *testing.T) string {
+		dir := t.TempDir()
+		entries, err := os.ReadDir("testdata/cgroup/limited")
+		require.NoError(t, err)
+		for _, e := range entries {
+			data, err := os.ReadFile(filepath.Join("testdata/cgroup/limited", e.Name()))
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, e.Name()), data, 0644))
+		}
+		return dir
+	}
+
+	t.Run("usage counters are sent as deltas", func(t *testing.T) {
+		dir := copyLimited(t)
+		counters := NewCounters()
+		c := NewCgroupCollector(dir, counters, config.Filter{}, time.Second)
+		_, err := c.Collect(context.TODO())
+		require.NoError(t, err)
+		assert.Empty(t, counters.Take())
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cpu.stat"),
+			[]byte("usage_usec 2500000\nuser_usec 1800000\nsystem_usec 700000\nnr_periods 110\nnr_throttled 3\nthrottled_usec 40000\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "io.stat"),
+			[]byte("8:0 rbytes=8192 wbytes=8192 rios=2 wios=2 dbytes=0 dios=0\n259:0 rbytes=1024 wbytes=4096 rios=1 wios=1 dbytes=0 dios=0\n"), 0644))
+		_, err = c.Collect(context.TODO())
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{
+			counter(t, "CgroupCPUSystemUsec", 200000),
+			counter(t, "CgroupCPUUsageUsec", 500000),
+			counter(t, "CgroupCPUUserUsec", 300000),
+			counter(t, "CgroupIOReadBytes", 4096),
+			counter(t, "CgroupIOReads", 1),
+			counter(t, "CgroupIOWriteBytes", 4096),
+			counter(t, "CgroupIOWrites", 1),
+		}, counters.Take())
+
+		// устройство 259:0 пропало, а появилось новое: приращения считаются по каждому устройству отдельно
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "io.stat"),
+			[]byte("8:0 rbytes=9216 wbytes=8192 rios=3 wios=2 dbytes=0 dios=0\n8:16 rbytes=512 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n"), 0644))
+		_, err = c.Collect(context.TODO())
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{
+			counter(t, "CgroupIOReadBytes", 1024),
+			counter(t, "CgroupIOReads", 1),
+		}, counters.Take())
+	})
+	t.Run("filter is applied to counters", func(t *testing.T) {
+		dir := copyLimited(t)
+		counters := NewCounters()
+		c := NewCgroupCollector(dir, counters, config.Filter{Exclude: []string{"CgroupIO*", "CgroupMemory*"}}, time.Second)
+		got, err := c.Collect(context.TODO())
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{
+			gauge("CgroupSwapCurrent", 0),
+			gauge("CgroupPidsCurrent", 12),
+			gauge("CgroupPidsMax", 1024),
+			gauge("CgroupCPULimit", 1.5),
+		}, got)
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cpu.stat"),
+			[]byte("usage_usec 2500000\nuser_usec 1800000\nsystem_usec 700000\nnr_periods 110\nnr_throttled 3\nthrottled_usec 40000\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "io.stat"),
+			[]byte("8:0 rbytes=8192 wbytes=8192 rios=2 wios=2 dbytes=0 dios=0\n259:0 rbytes=1024 wbytes=4096 rios=1 wios=1 dbytes=0 dios=0\n"), 0644))
+		_, err = c.Collect(context.TODO())
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{
+			counter(t, "CgroupCPUSystemUsec", 200000),
+			counter(t, "CgroupCPUUsageUsec", 500000),
+			counter(t, "CgroupCPUUserUsec", 300000),
+		}, counters.Take())
+	})
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Collector источник метрик агента. Collect вызывается раз в Interval
+type Collector interface {
+	Name() string
+	Interval() time.Duration
+	Collect(ctx context.Context) ([]models.Metric, error)
+}
+
+// Factory создает коллектор с заданным интервалом сбора и фильтром
+type Factory func(interval time.Duration, filter config.Filter) Collector
+
+// Registry известные агенту коллекторы по именам
+type Registry struct {
+	factories map[string]Factory
+	// порядок регистрации, в нем же создаются коллекторы по умолчанию
+	names []string
+	// коллекторы, которые создаются только если явно указаны в конфиге
+	optional map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]Factory), optional: make(map[string]bool)}
+}
+
+// Register добавляет коллектор в реестр. Повторная регистрация имени заменяет фабрику
+func (r *Registry) Register(name string, factory Factory) {
+	if _, ok := r.factories[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.factories[name] = factory
+}
+
+// RegisterOptional добавляет коллектор, который не включается по умолчанию
+func (r *Registry) RegisterOptional(name string, factory Factory) {
+	r.Register(name, factory)
+	r.optional[name] = true
+}
+
+// Names имена зарегистрированных коллекторов
+func (r *Registry) Names() []string {
+	return append([]string(nil), r.names...)
+}
+
+// Build создает включенные в конфиге коллекторы. Если список пуст, создаются все зарегистрированные, кроме необязательных.
+// Коллекторы без своего интервала собирают метрики раз в defaultInterval
+func (r *Registry) Build(collectors []config.CollectorConfig, filters map[string]config.Filter, defaultInterval time.Duration) ([]Collector, error) {
+	for name := range filters {
+		if _, ok := r.factories[name]; !ok {
+			return nil, fmt.Errorf("filter of unknown collector '%v'. Available collectors: %v", name, r.names)
+		}
+	}
+	if len(collectors) == 0 {
+		for _, name := range r.names {
+			if !r.optional[name] {
+				collectors = append(collectors, config.CollectorConfig{Name: name})
+			}
+		}
+	}
+	var result []Collector
+	for _, c := range collectors {
+		factory, ok := r.factories[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector '%v'. Available collectors: %v", c.Name, r.names)
+		}
+		interval := c.Interval
+		if interval == 0 {
+			interval = defaultInterval
+		}
+		result = append(result, factory(interval, filters[c.Name]))
+	}
+	return result, nil
+}
+
+// DefaultRegistry реестр со встроенными коллекторами агента
+func DefaultRegistry(cfg *config.Config, runtimeMetrics []string, counters *Counters, sendStats *SendStats) *Registry {
+	r := NewRegistry()
+	r.Register("runtime", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewRuntimeCollector(runtimeMetrics, interval), filter)
+	})
+	r.Register("custom", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewCustomCollector(counters, interval), filter)
+	})
+	r.Register("psutil", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewPSUtilCollector(interval), filter)
+	})
+	r.Register("load", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewLoadCollector(interval), filter)
+	})
+	r.Register("swap", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewSwapCollector(interval), filter)
+	})
+	r.Register("uptime", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewUptimeCollector(interval), filter)
+	})
+	r.Register("diskio", func(interval time.Duration, filter config.Filter) Collector {
+		return NewDiskIOCollector(counters, filter, interval)
+	})
+	r.Register("filesystem", func(interval time.Duration, filter config.Filter) Collector {
+		return NewFilesystemCollector(filter, interval)
+	})
+	r.Register("net", func(interval time.Duration, filter config.Filter) Collector {
+		return NewNetCollector(counters, filter, interval)
+	})
+	r.Register("process", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewProcessCollector(cfg.Processes, interval), filter)
+	})
+	// на хосте без cgroup v2 коллектор только пишет ошибки, поэтому включается явно
+	r.RegisterOptional("cgroup", func(interval time.Duration, filter config.Filter) Collector {
+		return NewCgroupCollector(cfg.CgroupPath, counters, filter, interval)
+	})
+	r.Register("self", func(interval time.Duration, filter config.Filter) Collector {
+		return WithFilter(NewSelfCollector(sendStats, interval), filter)
+	})
+	return r
+}
+
+// filtered коллектор, метрики которого проходят через фильтр по имени
+type filtered struct {
+	Collector
+	filter config.Filter
+}
+
+// WithFilter оставляет только метрики коллектора, имена которых проходят фильтр
+func WithFilter(c Collector, filter config.Filter) Collector {
+	if len(filter.Include) == 0 && len(filter.Exclude) == 0 {
+		return c
+	}
+	return &filtered{Collector: c, filter: filter}
+}
+
+func (f *filtered) Collect(ctx context.Context) ([]models.Metric, error) {
+	metrics, err := f.Collector.Collect(ctx)
+	result := metrics[:0]
+	for _, m := range metrics {
+		if f.filter.Allows(m.ID) {
+			result = append(result, m)
+		}
+	}
+	return result, err
+}
+
+// Run запускает сбор метрик коллектором раз в его интервал, все значения передаются в aggregator до следующего отчета.
+// Сбор останавливается после отмены контекста
+func Run(ctx context.Context, c Collector, aggregator *Aggregator, log *zap.SugaredLogger) {
+	ticker := time.NewTicker(c.Interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metrics, err := c.Collect(ctx)
+			if err != nil {
+				log.Errorf("Collector %v error: %v", c.Name(), err)
+			}
+			aggregator.Add(metrics)
+		}
+	}
+}
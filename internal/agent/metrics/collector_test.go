@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type collectorDummy struct {
+	name     string
+	interval time.Duration
+	calls    int
+	err      error
+}
+
+func (c *collectorDummy) Name() string {
+	return c.name
+}
+
+func (c *collectorDummy) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *collectorDummy) Collect(ctx context.Context) ([]models.Metric, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	m, err := models.NewMetric(c.name, "gauge", c.calls)
+	return []models.Metric{m}, err
+}
+
+func TestRegistry_Build(t *testing.T) {
+	r := NewRegistry()
+	for _, name := range []string{"first", "second"} {
+		name := name
+		r.Register(name, func(interval time.Duration, filter config.Filter) Collector {
+			return WithFilter(&collectorDummy{name: name, interval: interval}, filter)
+		})
+	}
+
+	tests := []struct {
+		name       string
+		collectors []config.CollectorConfig
+		filters    map[string]config.Filter
+		want       map[string]time.Duration
+		wantErr    string
+	}{
+		{
+			name: "all collectors by default",
+			want: map[string]time.Duration{"first": time.Second, "second": time.Second},
+		},
+		{
+			name:       "only enabled collectors",
+			collectors: []config.CollectorConfig{{Name: "second", Interval: 5 * time.Second}},
+			want:       map[string]time.Duration{"second": 5 * time.Second},
+		},
+		{
+			name:       "unknown collector",
+			collectors: []config.CollectorConfig{{Name: "third"}},
+			wantErr:    "unknown collector 'third'. Available collectors: [first second]",
+		},
+		{
+			name:    "filter of unknown collector",
+			filters: map[string]config.Filter{"third": {Exclude: []string{"*"}}},
+			wantErr: "filter of unknown collector 'third'. Available collectors: [first second]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Build(tt.collectors, tt.filters, time.Second)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			intervals := make(map[string]time.Duration)
+			for _, c := range got {
+				intervals[c.Name()] = c.Interval()
+			}
+			assert.Equal(t, tt.want, intervals)
+		})
+	}
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	counters := NewCounters()
+	r := DefaultRegistry(&config.Config{}, []string{"Alloc"}, counters, &SendStats{})
+	assert.Equal(t, []string{"runtime", "custom", "psutil", "load", "swap", "uptime", "diskio", "filesystem", "net", "process", "cgroup", "self"}, r.Names())
+
+	defaults, err := r.Build(nil, nil, time.Second)
+	require.NoError(t, err)
+	for _, c := range defaults {
+		assert.NotEqual(t, "cgroup", c.Name())
+	}
+
+	collectors, err := r.Build([]config.CollectorConfig{{Name: "runtime"}, {Name: "custom"}}, nil, time.Second)
+	require.NoError(t, err)
+
+	runtimeMetrics, err := collectors[0].Collect(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, runtimeMetrics, 1)
+	assert.Equal(t, "Alloc", runtimeMetrics[0].ID)
+
+	for i := 0; i < 2; i++ {
+		customMetrics, err := collectors[1].Collect(context.TODO())
+		require.NoError(t, err)
+		require.Len(t, customMetrics, 1)
+		assert.Equal(t, "RandomValue", customMetrics[0].ID)
+	}
+	assert.EqualValues(t, 2, counters.Get("PollCount"))
+}
+
+func TestRun(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	t.Run("all samples are aggregated", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Millisecond)
+		defer cancel()
+		c := &collectorDummy{name: "dummy", interval: time.Millisecond}
+		aggregator := NewAggregator([]config.AggregationRule{{Pattern: "dummy", Funcs: []string{"min", "max"}}})
+		Run(ctx, c, aggregator, log)
+
+		require.Greater(t, c.calls, 1)
+		got := aggregator.Flush()
+		require.Len(t, got, 3)
+		assert.EqualValues(t, c.calls, *got[0].Value)
+		assert.EqualValues(t, 1, *got[1].Value)
+		assert.EqualValues(t, c.calls, *got[2].Value)
+	})
+
+	t.Run("errors are skipped", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Millisecond)
+		defer cancel()
+		c := &collectorDummy{name: "dummy", interval: time.Millisecond, err: errors.New("broken")}
+		aggregator := NewAggregator(nil)
+		Run(ctx, c, aggregator, log)
+		assert.Empty(t, aggregator.Flush())
+	})
+}
+
+func TestWithFilter(t *testing.T) {
+	c := &collectorDummy{name: "dummy", interval: time.Second}
+	assert.Same(t, c, WithFilter(c, config.Filter{}))
+
+	got, err := WithFilter(c, config.Filter{Exclude: []string{"dum*"}}).Collect(context.TODO())
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	got, err = WithFilter(c, config.Filter{Include: []string{"dummy"}}).Collect(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, got, 1)
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"sort"
+	"sync"
+)
+
+// Counters приращения counter метрик агента. Сервер прибавляет присланное значение к своему,
+// поэтому отправляются только приращения с прошлой подтвержденной отправки.
+// Приращение списывается только после того, как сервер принял пачку (Ack), при ошибке оно возвращается (Return)
+// и уходит со следующим отчетом
+type Counters struct {
+	mu sync.Mutex
+	// накоплено и еще не отправлено
+	pending map[string]int64
+	// отправлено и ждет ответа сервера
+	inflight map[string]int64
+}
+
+func NewCounters() *Counters {
+	return &Counters{
+		pending:  make(map[string]int64),
+		inflight: make(map[string]int64),
+	}
+}
+
+// Add добавляет приращение counter метрики
+func (c *Counters) Add(name string, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[name] += delta
+}
+
+// Take забирает накопленные приращения для отправки, отсортированные по имени
+func (c *Counters) Take() []models.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var metrics []models.Metric
+	for name, delta := range c.pending {
+		if delta == 0 {
+			continue
+		}
+		m, _ := models.NewMetric(name, models.Counter.String(), delta)
+		metrics = append(metrics, m)
+		c.inflight[name] += delta
+	}
+	clear(c.pending)
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+	return metrics
+}
+
+// Ack списывает приращения из принятой сервером пачки
+func (c *Counters) Ack(batch []models.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range batch {
+		if delta, ok := c.own(m); ok {
+			c.release(m.ID, delta)
+		}
+	}
+}
+
+// Return возвращает приращения из неотправленной пачки к накопленным.
+// Результат - остальные метрики пачки, которые нужно отложить отдельно
+func (c *Counters) Return(batch []models.Metric) []models.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rest := make([]models.Metric, 0, len(batch))
+	for _, m := range batch {
+		delta, ok := c.own(m)
+		if !ok {
+			rest = append(rest, m)
+			continue
+		}
+		c.release(m.ID, delta)
+		c.pending[m.ID] += delta
+	}
+	return rest
+}
+
+// Get накопленное и отправленное, но не подтвержденное приращение метрики
+func (c *Counters) Get(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending[name] + c.inflight[name]
+}
+
+// own приращение метрики из пачки, если оно было выдано Take. Вызывается под mu
+func (c *Counters) own(m models.Metric) (int64, bool) {
+	if m.MType != models.Counter.String() || m.Delta == nil {
+		return 0, false
+	}
+	inflight, ok := c.inflight[m.ID]
+	if !ok {
+		return 0, false
+	}
+	return min(*m.Delta, inflight), true
+}
+
+func (c *Counters) release(name string, delta int64) {
+	if c.inflight[name] -= delta; c.inflight[name] <= 0 {
+		delete(c.inflight, name)
+	}
+}
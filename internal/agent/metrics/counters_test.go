@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func counter(t *testing.T, name string, delta int64) models.Metric {
+	m, err := models.NewMetric(name, "counter", delta)
+	require.NoError(t, err)
+	return m
+}
+
+func TestCounters(t *testing.T) {
+	t.Run("acknowledged deltas are reset", func(t *testing.T) {
+		c := NewCounters()
+		c.Add("PollCount", 1)
+		c.Add("PollCount", 1)
+		batch := c.Take()
+		assert.Equal(t, []models.Metric{counter(t, "PollCount", 2)}, batch)
+		assert.Empty(t, c.Take())
+
+		// опрос во время отправки попадет в следующий отчет
+		c.Add("PollCount", 1)
+		c.Ack(batch)
+		assert.EqualValues(t, 1, c.Get("PollCount"))
+		assert.Equal(t, []models.Metric{counter(t, "PollCount", 1)}, c.Take())
+	})
+
+	t.Run("failed deltas are carried over", func(t *testing.T) {
+		c := NewCounters()
+		c.Add("PollCount", 2)
+		gauge, err := models.NewMetric("Alloc", "gauge", 1)
+		require.NoError(t, err)
+		batch := append(c.Take(), gauge)
+
+		c.Add("PollCount", 1)
+		rest := c.Return(batch)
+		assert.Equal(t, []models.Metric{gauge}, rest)
+		assert.Equal(t, []models.Metric{counter(t, "PollCount", 3)}, c.Take())
+	})
+
+	t.Run("foreign counters are not touched", func(t *testing.T) {
+		c := NewCounters()
+		c.Add("PollCount", 2)
+		c.Take()
+		foreign := []models.Metric{counter(t, "Requests", 5)}
+		c.Ack(foreign)
+		assert.Equal(t, foreign, c.Return(foreign))
+		assert.EqualValues(t, 2, c.Get("PollCount"))
+	})
+}
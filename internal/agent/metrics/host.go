@@ -0,0 +1,297 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sanitize приводит имя устройства, точки монтирования или интерфейса к виду, допустимому в имени метрики
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// mountName имя точки монтирования для метрики: '/' - root, '/var/lib' - var_lib
+func mountName(mountpoint string) string {
+	if name := strings.Trim(mountpoint, "/"); name != "" {
+		return sanitize(name)
+	}
+	return "root"
+}
+
+// deltas превращает монотонные счетчики ОС в приращения для Counters
+type deltas struct {
+	counters *Counters
+	prev     map[string]uint64
+}
+
+func newDeltas(counters *Counters) *deltas {
+	return &deltas{counters: counters, prev: make(map[string]uint64)}
+}
+
+// add учитывает новое значение счетчика и отправляет приращение в Counters
+func (d *deltas) add(name string, value uint64) {
+	if delta, ok := d.delta(name, value); ok {
+		d.counters.Add(name, delta)
+	}
+}
+
+// delta запоминает новое значение счетчика key и возвращает приращение. Первое значение только запоминается (false),
+// уменьшение значения считается сбросом счетчика и все новое значение идет приращением
+func (d *deltas) delta(key string, value uint64) (int64, bool) {
+	prev, ok := d.prev[key]
+	d.prev[key] = value
+	if !ok {
+		return 0, false
+	}
+	if value < prev {
+		return int64(value), true
+	}
+	return int64(value - prev), true
+}
+
+// LoadCollector средняя загрузка системы за 1, 5 и 15 минут
+type LoadCollector struct {
+	interval time.Duration
+}
+
+func NewLoadCollector(interval time.Duration) *LoadCollector {
+	return &LoadCollector{interval: interval}
+}
+
+func (c *LoadCollector) Name() string {
+	return "load"
+}
+
+func (c *LoadCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *LoadCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get load average: %v", err)
+	}
+	load1, _ := models.NewMetric("Load1", "gauge", avg.Load1)
+	load5, _ := models.NewMetric("Load5", "gauge", avg.Load5)
+	load15, _ := models.NewMetric("Load15", "gauge", avg.Load15)
+	return []models.Metric{load1, load5, load15}, nil
+}
+
+// SwapCollector использование swap
+type SwapCollector struct {
+	interval time.Duration
+}
+
+func NewSwapCollector(interval time.Duration) *SwapCollector {
+	return &SwapCollector{interval: interval}
+}
+
+func (c *SwapCollector) Name() string {
+	return "swap"
+}
+
+func (c *SwapCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *SwapCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	swap, err := mem.SwapMemoryWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get swap stats: %v", err)
+	}
+	total, _ := models.NewMetric("SwapTotal", "gauge", swap.Total)
+	used, _ := models.NewMetric("SwapUsed", "gauge", swap.Used)
+	free, _ := models.NewMetric("SwapFree", "gauge", swap.Free)
+	return []models.Metric{total, used, free}, nil
+}
+
+// UptimeCollector время работы хоста в секундах
+type UptimeCollector struct {
+	interval time.Duration
+}
+
+func NewUptimeCollector(interval time.Duration) *UptimeCollector {
+	return &UptimeCollector{interval: interval}
+}
+
+func (c *UptimeCollector) Name() string {
+	return "uptime"
+}
+
+func (c *UptimeCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *UptimeCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	uptime, err := host.UptimeWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get uptime: %v", err)
+	}
+	m, _ := models.NewMetric("Uptime", "gauge", uptime)
+	return []models.Metric{m}, nil
+}
+
+// DiskIOCollector счетчики чтения и записи по блочным устройствам, фильтр применяется к имени устройства.
+// Счетчики отправляются приращениями через Counters
+type DiskIOCollector struct {
+	filter     config.Filter
+	interval   time.Duration
+	deltas     *deltas
+	ioCounters func(ctx context.Context) (map[string]disk.IOCountersStat, error)
+}
+
+func NewDiskIOCollector(counters *Counters, filter config.Filter, interval time.Duration) *DiskIOCollector {
+	return &DiskIOCollector{
+		filter:   filter,
+		interval: interval,
+		deltas:   newDeltas(counters),
+		ioCounters: func(ctx context.Context) (map[string]disk.IOCountersStat, error) {
+			return disk.IOCountersWithContext(ctx)
+		},
+	}
+}
+
+func (c *DiskIOCollector) Name() string {
+	return "diskio"
+}
+
+func (c *DiskIOCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *DiskIOCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	stats, err := c.ioCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get disk io stats: %v", err)
+	}
+	for device, s := range stats {
+		if !c.filter.Allows(device) {
+			continue
+		}
+		name := sanitize(device)
+		c.deltas.add("DiskReadBytes_"+name, s.ReadBytes)
+		c.deltas.add("DiskWriteBytes_"+name, s.WriteBytes)
+		c.deltas.add("DiskReadCount_"+name, s.ReadCount)
+		c.deltas.add("DiskWriteCount_"+name, s.WriteCount)
+	}
+	return nil, nil
+}
+
+// FilesystemCollector использование файловых систем, фильтр применяется к точке монтирования
+type FilesystemCollector struct {
+	filter     config.Filter
+	interval   time.Duration
+	partitions func(ctx context.Context) ([]disk.PartitionStat, error)
+	usage      func(ctx context.Context, path string) (*disk.UsageStat, error)
+}
+
+func NewFilesystemCollector(filter config.Filter, interval time.Duration) *FilesystemCollector {
+	return &FilesystemCollector{
+		filter:   filter,
+		interval: interval,
+		partitions: func(ctx context.Context) ([]disk.PartitionStat, error) {
+			return disk.PartitionsWithContext(ctx, false)
+		},
+		usage: disk.UsageWithContext,
+	}
+}
+
+func (c *FilesystemCollector) Name() string {
+	return "filesystem"
+}
+
+func (c *FilesystemCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *FilesystemCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	partitions, err := c.partitions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get partitions: %v", err)
+	}
+	var metrics []models.Metric
+	var errs []string
+	for _, p := range partitions {
+		if !c.filter.Allows(p.Mountpoint) {
+			continue
+		}
+		usage, err := c.usage(ctx, p.Mountpoint)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", p.Mountpoint, err))
+			continue
+		}
+		name := mountName(p.Mountpoint)
+		total, _ := models.NewMetric("FilesystemTotal_"+name, "gauge", usage.Total)
+		used, _ := models.NewMetric("FilesystemUsed_"+name, "gauge", usage.Used)
+		usedPercent, _ := models.NewMetric("FilesystemUsedPercent_"+name, "gauge", usage.UsedPercent)
+		metrics = append(metrics, total, used, usedPercent)
+	}
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("can not get filesystem usage: %v", strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+// NetCollector счетчики сетевых интерфейсов, фильтр применяется к имени интерфейса.
+// Счетчики отправляются приращениями через Counters
+type NetCollector struct {
+	filter     config.Filter
+	interval   time.Duration
+	deltas     *deltas
+	ioCounters func(ctx context.Context) ([]net.IOCountersStat, error)
+}
+
+func NewNetCollector(counters *Counters, filter config.Filter, interval time.Duration) *NetCollector {
+	return &NetCollector{
+		filter:   filter,
+		interval: interval,
+		deltas:   newDeltas(counters),
+		ioCounters: func(ctx context.Context) ([]net.IOCountersStat, error) {
+			return net.IOCountersWithContext(ctx, true)
+		},
+	}
+}
+
+func (c *NetCollector) Name() string {
+	return "net"
+}
+
+func (c *NetCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *NetCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	stats, err := c.ioCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get network stats: %v", err)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	for _, s := range stats {
+		if !c.filter.Allows(s.Name) {
+			continue
+		}
+		name := sanitize(s.Name)
+		c.deltas.add("NetBytesSent_"+name, s.BytesSent)
+		c.deltas.add("NetBytesRecv_"+name, s.BytesRecv)
+		c.deltas.add("NetPacketsSent_"+name, s.PacketsSent)
+		c.deltas.add("NetPacketsRecv_"+name, s.PacketsRecv)
+		c.deltas.add("NetErrorsIn_"+name, s.Errin)
+		c.deltas.add("NetErrorsOut_"+name, s.Errout)
+	}
+	return nil, nil
+}
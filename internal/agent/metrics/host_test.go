@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMountName(t *testing.T) {
+	tests := map[string]string{
+		"/":             "root",
+		"/home":         "home",
+		"/var/lib/data": "var_lib_data",
+		"/mnt/my-disk/": "mnt_my_disk",
+	}
+	for mountpoint, want := range tests {
+		assert.Equal(t, want, mountName(mountpoint), mountpoint)
+	}
+}
+
+func TestDiskIOCollector(t *testing.T) {
+	counters := NewCounters()
+	c := NewDiskIOCollector(counters, config.Filter{Exclude: []string{"loop*"}}, time.Second)
+	stats := map[string]disk.IOCountersStat{
+		"sda":   {ReadBytes: 100, WriteBytes: 200, ReadCount: 1, WriteCount: 2},
+		"loop0": {ReadBytes: 100},
+	}
+	c.ioCounters = func(ctx context.Context) (map[string]disk.IOCountersStat, error) {
+		return stats, nil
+	}
+
+	// первое значение только точка отсчета
+	_, err := c.Collect(context.TODO())
+	require.NoError(t, err)
+	assert.Empty(t, counters.Take())
+
+	stats["sda"] = disk.IOCountersStat{ReadBytes: 150, WriteBytes: 200, ReadCount: 3, WriteCount: 2}
+	stats["loop0"] = disk.IOCountersStat{ReadBytes: 500}
+	_, err = c.Collect(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metric{counter(t, "DiskReadBytes_sda", 50), counter(t, "DiskReadCount_sda", 2)}, counters.Take())
+
+	// счетчик устройства сброшен
+	stats["sda"] = disk.IOCountersStat{ReadBytes: 10, WriteBytes: 200, ReadCount: 3, WriteCount: 2}
+	_, err = c.Collect(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metric{counter(t, "DiskReadBytes_sda", 10)}, counters.Take())
+}
+
+func TestNetCollector(t *testing.T) {
+	counters := NewCounters()
+	c := NewNetCollector(counters, config.Filter{Include: []string{"eth*"}, Exclude: []string{"eth1"}}, time.Second)
+	bytes := uint64(1000)
+	c.ioCounters = func(ctx context.Context) ([]net.IOCountersStat, error) {
+		bytes += 100
+		return []net.IOCountersStat{
+			{Name: "eth0", BytesRecv: bytes},
+			{Name: "eth1", BytesRecv: bytes},
+			{Name: "veth123", BytesRecv: bytes},
+		}, nil
+	}
+	for i := 0; i < 3; i++ {
+		_, err := c.Collect(context.TODO())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []models.Metric{counter(t, "NetBytesRecv_eth0", 200)}, counters.Take())
+
+	c.ioCounters = func(ctx context.Context) ([]net.IOCountersStat, error) {
+		return nil, errors.New("not supported")
+	}
+	_, err := c.Collect(context.TODO())
+	assert.EqualError(t, err, "can not get network stats: not supported")
+}
+
+func TestFilesystemCollector(t *testing.T) {
+	c := NewFilesystemCollector(config.Filter{Exclude: []string{"/snap/*"}}, time.Second)
+	c.partitions = func(ctx context.Context) ([]disk.PartitionStat, error) {
+		return []disk.PartitionStat{{Mountpoint: "/"}, {Mountpoint: "/snap/core"}, {Mountpoint: "/broken"}}, nil
+	}
+	c.usage = func(ctx context.Context, path string) (*disk.UsageStat, error) {
+		if path == "/broken" {
+			return nil, errors.New("permission denied")
+		}
+		return &disk.UsageStat{Total: 100, Used: 25, UsedPercent: 25}, nil
+	}
+
+	got, err := c.Collect(context.TODO())
+	assert.EqualError(t, err, "can not get filesystem usage: /broken: permission denied")
+	gauge := func(name string, value float64) models.Metric {
+		m, err := models.NewMetric(name, "gauge", value)
+		require.NoError(t, err)
+		return m
+	}
+	assert.Equal(t, []models.Metric{
+		gauge("FilesystemTotal_root", 100),
+		gauge("FilesystemUsed_root", 25),
+		gauge("FilesystemUsedPercent_root", 25),
+	}, got)
+}
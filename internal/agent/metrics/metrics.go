@@ -11,153 +11,215 @@ import (
 	"math/rand"
 	"runtime"
 	"slices"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-type PollCounter struct {
-	value int64
-	mu    sync.RWMutex
+// CustomCollector счетчик опросов PollCount и случайное значение RandomValue.
+// PollCount накапливается в Counters и отправляется вместе с остальными counter
+type CustomCollector struct {
+	counters *Counters
+	interval time.Duration
 }
 
-func (pc *PollCounter) Inc() {
-	pc.mu.Lock()
-	defer pc.mu.Unlock()
-	pc.value++
+func NewCustomCollector(counters *Counters, interval time.Duration) *CustomCollector {
+	return &CustomCollector{counters: counters, interval: interval}
 }
 
-func (pc *PollCounter) Get() int64 {
-	pc.mu.RLock()
-	defer pc.mu.RUnlock()
-	return pc.value
+func (c *CustomCollector) Name() string {
+	return "custom"
 }
 
-func (pc *PollCounter) Reset() {
-	pc.mu.Lock()
-	defer pc.mu.Unlock()
-	pc.value = 0
+func (c *CustomCollector) Interval() time.Duration {
+	return c.interval
 }
 
-func GetCustomMetrics(ctx context.Context, counter int64, pollTicker *time.Ticker) chan []models.Metric {
-	resultChan := make(chan []models.Metric, 1)
+func (c *CustomCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	c.counters.Add("PollCount", 1)
+	rnd := rand.Float64()
+
+	return []models.Metric{
+		{
+			ID:    "RandomValue",
+			MType: "gauge",
+			Value: &rnd,
+		},
+	}, nil
+}
 
-	go func() {
-		defer close(resultChan)
+// PSUtilCollector память и загрузка процессоров хоста. Загрузка считается по разнице cpu.Times
+// между соседними сборами, поэтому сбор не блокируется, а метрики CPU появляются со второго сбора
+type PSUtilCollector struct {
+	interval time.Duration
+	// предыдущие значения по имени процессора (cpu0, cpu1, ...)
+	prev  map[string]cpu.TimesStat
+	times func(ctx context.Context) ([]cpu.TimesStat, error)
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-pollTicker.C:
-				var metrics []models.Metric
+func NewPSUtilCollector(interval time.Duration) *PSUtilCollector {
+	return &PSUtilCollector{
+		interval: interval,
+		prev:     make(map[string]cpu.TimesStat),
+		times: func(ctx context.Context) ([]cpu.TimesStat, error) {
+			return cpu.TimesWithContext(ctx, true)
+		},
+	}
+}
 
-				rnd := rand.Float64()
+func (c *PSUtilCollector) Name() string {
+	return "psutil"
+}
 
-				pollCountMetric := models.Metric{
-					ID:    "PollCount",
-					MType: "counter",
-					Delta: &counter,
-				}
-				metrics = append(metrics, pollCountMetric)
+func (c *PSUtilCollector) Interval() time.Duration {
+	return c.interval
+}
 
-				randomValueMetric := models.Metric{
-					ID:    "RandomValue",
-					MType: "gauge",
-					Value: &rnd,
-				}
-				metrics = append(metrics, randomValueMetric)
+// cpuTotal все время процессора. Guest уже учтено в User и Nice
+func cpuTotal(t cpu.TimesStat) float64 {
+	return t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
 
-				select {
-				case resultChan <- metrics:
-				default:
-					<-resultChan
-					resultChan <- metrics
-				}
-			}
+// cpuNumber номер процессора для имени метрики: cpu0 - 1
+func cpuNumber(name string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "cpu"))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n + 1, true
+}
+
+func (c *PSUtilCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	var metrics []models.Metric
+
+	v, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get memory stats: %v", err)
+	}
+	times, err := c.times(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not get cpu stats: %v", err)
+	}
+
+	TotalMemoryMetric, _ := models.NewMetric("TotalMemory", "gauge", v.Total)
+	metrics = append(metrics, TotalMemoryMetric)
+
+	FreeMemoryMetric, _ := models.NewMetric("FreeMemory", "gauge", v.Free)
+	metrics = append(metrics, FreeMemoryMetric)
+
+	// процессоры могут добавляться и отключаться: новые только запоминаются, пропавшие забываются
+	current := make(map[string]cpu.TimesStat, len(times))
+	for _, t := range times {
+		current[t.CPU] = t
+		prev, ok := c.prev[t.CPU]
+		if !ok {
+			continue
+		}
+		n, ok := cpuNumber(t.CPU)
+		if !ok {
+			continue
+		}
+		total := cpuTotal(t) - cpuTotal(prev)
+		// время не прошло или счетчики сбросились
+		if total <= 0 {
+			continue
 		}
-	}()
+		percent := func(cur, old float64) float64 {
+			return min(max((cur-old)/total*100, 0), 100)
+		}
+		idle := percent(t.Idle+t.Iowait, prev.Idle+prev.Iowait)
+		for _, mode := range []struct {
+			name  string
+			value float64
+		}{
+			{name: "CPUutilization", value: 100 - idle},
+			{name: "CPUUser", value: percent(t.User, prev.User)},
+			{name: "CPUSystem", value: percent(t.System, prev.System)},
+			{name: "CPUIowait", value: percent(t.Iowait, prev.Iowait)},
+			{name: "CPUSteal", value: percent(t.Steal, prev.Steal)},
+		} {
+			m, _ := models.NewMetric(fmt.Sprintf("%v%v", mode.name, n), "gauge", mode.value)
+			metrics = append(metrics, m)
+		}
+	}
+	c.prev = current
 
-	return resultChan
+	return metrics, nil
 }
 
-func GetPSUtilMetrics(ctx context.Context, pollTicker *time.Ticker) chan []models.Metric {
-	resultChan := make(chan []models.Metric, 1)
-
-	go func() {
-		defer close(resultChan)
+// RuntimeCollector метрики runtime.MemStats из списка Metrics
+type RuntimeCollector struct {
+	Metrics  []string
+	interval time.Duration
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-pollTicker.C:
-				var metrics []models.Metric
+func NewRuntimeCollector(metrics []string, interval time.Duration) *RuntimeCollector {
+	return &RuntimeCollector{Metrics: metrics, interval: interval}
+}
 
-				cpuCount := runtime.NumCPU()
-				v, _ := mem.VirtualMemoryWithContext(ctx)
-				c, _ := cpu.PercentWithContext(ctx, 10, true)
+func (c *RuntimeCollector) Name() string {
+	return "runtime"
+}
 
-				TotalMemoryMetric, _ := models.NewMetric("TotalMemory", "gauge", v.Total)
-				metrics = append(metrics, TotalMemoryMetric)
+func (c *RuntimeCollector) Interval() time.Duration {
+	return c.interval
+}
 
-				FreeMemoryMetric, _ := models.NewMetric("FreeMemory", "gauge", v.Free)
-				metrics = append(metrics, FreeMemoryMetric)
+func (c *RuntimeCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	m := &runtime.MemStats{}
+	runtime.ReadMemStats(m)
 
-				for i := 0; i < cpuCount; i++ {
-					CPUUtilizationMetric, _ := models.NewMetric(fmt.Sprintf("CPUutilization%v", i+1), "gauge", c[i])
-					metrics = append(metrics, CPUUtilizationMetric)
-				}
+	var metrics []models.Metric
 
-				select {
-				case resultChan <- metrics:
-				default:
-					<-resultChan
-					resultChan <- metrics
-				}
+	for k, v := range structs.Map(m) {
+		if contains := slices.Contains(c.Metrics, k); contains {
+			float64Value, err := converter.AnyToFloat64(v)
+			if err != nil {
+				continue
 			}
+			t, _ := models.NewMetric(k, "gauge", float64Value)
+
+			metrics = append(metrics, t)
 		}
-	}()
+	}
 
-	return resultChan
+	return metrics, nil
 }
 
-func GetRuntimeMetrics(ctx context.Context, r []string, pollTicker *time.Ticker) chan []models.Metric {
-	resultChan := make(chan []models.Metric, 1)
-
-	go func() {
-		defer close(resultChan)
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-pollTicker.C:
-				m := &runtime.MemStats{}
-				runtime.ReadMemStats(m)
+// SendStats счетчики отправки метрик агентом
+type SendStats struct {
+	// Retries повторные попытки отправки
+	Retries atomic.Int64
+	// Failures пачки, которые не удалось отправить после всех повторов
+	Failures atomic.Int64
+	// SpoolBatches и SpoolBytes глубина очереди неотправленных пачек на диске
+	SpoolBatches atomic.Int64
+	SpoolBytes   atomic.Int64
+}
 
-				var metrics []models.Metric
+// SelfCollector метрики работы самого агента
+type SelfCollector struct {
+	stats    *SendStats
+	interval time.Duration
+}
 
-				for k, v := range structs.Map(m) {
-					if contains := slices.Contains(r, k); contains {
-						float64Value, err := converter.AnyToFloat64(v)
-						if err != nil {
-							continue
-						}
-						t, _ := models.NewMetric(k, "gauge", float64Value)
+func NewSelfCollector(stats *SendStats, interval time.Duration) *SelfCollector {
+	return &SelfCollector{stats: stats, interval: interval}
+}
 
-						metrics = append(metrics, t)
-					}
-				}
+func (c *SelfCollector) Name() string {
+	return "self"
+}
 
-				select {
-				case resultChan <- metrics:
-				default:
-					<-resultChan
-					resultChan <- metrics
-				}
-			}
-		}
-	}()
+func (c *SelfCollector) Interval() time.Duration {
+	return c.interval
+}
 
-	return resultChan
+func (c *SelfCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	retries, _ := models.NewMetric("AgentSendRetries", "gauge", c.stats.Retries.Load())
+	failures, _ := models.NewMetric("AgentSendFailures", "gauge", c.stats.Failures.Load())
+	spoolBatches, _ := models.NewMetric("AgentSpoolBatches", "gauge", c.stats.SpoolBatches.Load())
+	spoolBytes, _ := models.NewMetric("AgentSpoolBytes", "gauge", c.stats.SpoolBytes.Load())
+	return []models.Metric{retries, failures, spoolBatches, spoolBytes}, nil
 }
@@ -1 +1,62 @@
 package metrics
+
+import (
+	"context"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPSUtilCollector(t *testing.T) {
+	c := NewPSUtilCollector(time.Second)
+	var times []cpu.TimesStat
+	c.times = func(ctx context.Context) ([]cpu.TimesStat, error) {
+		return times, nil
+	}
+	collectCPU := func() map[string]float64 {
+		metrics, err := c.Collect(context.TODO())
+		require.NoError(t, err)
+		got := make(map[string]float64)
+		for _, m := range metrics {
+			if strings.HasPrefix(m.ID, "CPU") {
+				got[m.ID] = *m.Value
+			}
+		}
+		return got
+	}
+
+	// первый сбор только точка отсчета
+	times = []cpu.TimesStat{{CPU: "cpu0", User: 10, System: 10, Idle: 80}}
+	assert.Empty(t, collectCPU())
+
+	// за 100 тиков: 20 user, 10 system, 10 iowait, 5 steal, 55 idle
+	times = []cpu.TimesStat{
+		{CPU: "cpu0", User: 30, System: 20, Idle: 135, Iowait: 10, Steal: 5},
+		// подключенный процессор
+		{CPU: "cpu1", User: 1, Idle: 1},
+	}
+	assert.InDeltaMapValues(t, map[string]float64{
+		"CPUutilization1": 35,
+		"CPUUser1":        20,
+		"CPUSystem1":      10,
+		"CPUIowait1":      10,
+		"CPUSteal1":       5,
+	}, collectCPU(), 1e-9)
+
+	// cpu0 отключен, для cpu1 время не прошло
+	times = []cpu.TimesStat{{CPU: "cpu1", User: 1, Idle: 1}}
+	assert.Empty(t, collectCPU())
+
+	// cpu0 снова подключен и начинает с новой точки отсчета
+	times = []cpu.TimesStat{{CPU: "cpu0", User: 1}, {CPU: "cpu1", User: 2, Idle: 4}}
+	assert.InDeltaMapValues(t, map[string]float64{
+		"CPUutilization2": 25,
+		"CPUUser2":        25,
+		"CPUSystem2":      0,
+		"CPUIowait2":      0,
+		"CPUSteal2":       0,
+	}, collectCPU(), 1e-9)
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/shirou/gopsutil/v3/process"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type procRef struct {
+	pid     int32
+	name    string
+	cmdline string
+}
+
+type procStats struct {
+	// процессорное время user+system в секундах
+	cpuSeconds float64
+	rss        uint64
+	fds        int32
+	threads    int32
+}
+
+// procSource список процессов и их статистика. Подменяется в тестах
+type procSource interface {
+	List(ctx context.Context) ([]procRef, error)
+	Stats(ctx context.Context, pid int32) (procStats, error)
+}
+
+type gopsutilProcs struct{}
+
+func (gopsutilProcs) List(ctx context.Context) ([]procRef, error) {
+	processes, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]procRef, 0, len(processes))
+	for _, p := range processes {
+		// процесс мог уже завершиться, тогда имя останется пустым и он не подойдет под шаблон
+		name, _ := p.NameWithContext(ctx)
+		cmdline, _ := p.CmdlineWithContext(ctx)
+		refs = append(refs, procRef{pid: p.Pid, name: name, cmdline: cmdline})
+	}
+	return refs, nil
+}
+
+func (gopsutilProcs) Stats(ctx context.Context, pid int32) (procStats, error) {
+	p, err := process.NewProcessWithContext(ctx, pid)
+	if err != nil {
+		return procStats{}, err
+	}
+	var stats procStats
+	times, err := p.TimesWithContext(ctx)
+	if err != nil {
+		return procStats{}, err
+	}
+	stats.cpuSeconds = times.User + times.System
+	memory, err := p.MemoryInfoWithContext(ctx)
+	if err != nil {
+		return procStats{}, err
+	}
+	stats.rss = memory.RSS
+	// без прав на /proc/<pid>/fd количество дескрипторов недоступно, остальные метрики все равно отдаем
+	stats.fds, _ = p.NumFDsWithContext(ctx)
+	if stats.threads, err = p.NumThreadsWithContext(ctx); err != nil {
+		return procStats{}, err
+	}
+	return stats, nil
+}
+
+type cpuSample struct {
+	seconds float64
+	at      time.Time
+}
+
+// ProcessCollector метрики групп процессов из config.ProcessMatcher, суммарно по всем процессам группы:
+// количество, загрузка CPU в процентах с прошлого сбора, RSS, открытые дескрипторы и потоки
+type ProcessCollector struct {
+	matchers []config.ProcessMatcher
+	interval time.Duration
+	source   procSource
+	prev     map[int32]cpuSample
+	now      func() time.Time
+}
+
+func NewProcessCollector(matchers []config.ProcessMatcher, interval time.Duration) *ProcessCollector {
+	return &ProcessCollector{
+		matchers: matchers,
+		interval: interval,
+		source:   gopsutilProcs{},
+		prev:     make(map[int32]cpuSample),
+		now:      time.Now,
+	}
+}
+
+func (c *ProcessCollector) Name() string {
+	return "process"
+}
+
+func (c *ProcessCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func readPIDFile(name string) (int32, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("incorrect pid in %v: %v", name, err)
+	}
+	return int32(pid), nil
+}
+
+func (c *ProcessCollector) Collect(ctx context.Context) ([]models.Metric, error) {
+	if len(c.matchers) == 0 {
+		return nil, nil
+	}
+	now := c.now()
+	seen := make(map[int32]cpuSample)
+	var refs []procRef
+	listed := false
+	var metrics []models.Metric
+	var errs []error
+
+	for _, matcher := range c.matchers {
+		var pids []int32
+		if matcher.PIDFile != "" {
+			pid, err := readPIDFile(matcher.PIDFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("process group %v: %v", matcher.Label, err))
+			} else {
+				pids = append(pids, pid)
+			}
+		} else {
+			if !listed {
+				var err error
+				if refs, err = c.source.List(ctx); err != nil {
+					return nil, fmt.Errorf("can not list processes: %v", err)
+				}
+				listed = true
+			}
+			for _, ref := range refs {
+				if matcher.Pattern.MatchString(ref.name) || matcher.Pattern.MatchString(ref.cmdline) {
+					pids = append(pids, ref.pid)
+				}
+			}
+		}
+
+		var count, fds, threads int
+		var rss uint64
+		var cpuPercent float64
+		hasCPU := false
+		for _, pid := range pids {
+			stats, err := c.source.Stats(ctx, pid)
+			if err != nil {
+				// процесс завершился между поиском и сбором
+				continue
+			}
+			count++
+			rss += stats.rss
+			fds += int(stats.fds)
+			threads += int(stats.threads)
+			if prev, ok := c.prev[pid]; ok && now.After(prev.at) && stats.cpuSeconds >= prev.seconds {
+				cpuPercent += (stats.cpuSeconds - prev.seconds) / now.Sub(prev.at).Seconds() * 100
+				hasCPU = true
+			}
+			seen[pid] = cpuSample{seconds: stats.cpuSeconds, at: now}
+		}
+
+		name := sanitize(matcher.Label)
+		countMetric, _ := models.NewMetric("ProcessCount_"+name, "gauge", count)
+		rssMetric, _ := models.NewMetric("ProcessRSS_"+name, "gauge", rss)
+		fdsMetric, _ := models.NewMetric("ProcessFDs_"+name, "gauge", fds)
+		threadsMetric, _ := models.NewMetric("ProcessThreads_"+name, "gauge", threads)
+		metrics = append(metrics, countMetric, rssMetric, fdsMetric, threadsMetric)
+		// загрузку можно посчитать только со второго сбора
+		if hasCPU {
+			cpuMetric, _ := models.NewMetric("ProcessCPUPercent_"+name, "gauge", cpuPercent)
+			metrics = append(metrics, cpuMetric)
+		}
+	}
+	c.prev = seen
+	return metrics, errors.Join(errs...)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/aksenk/go-yandex-metrics/internal/agent/config"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type procSourceDummy struct {
+	refs  []procRef
+	stats map[int32]procStats
+}
+
+func (p *procSourceDummy) List(ctx context.Context) ([]procRef, error) {
+	return p.refs, nil
+}
+
+func (p *procSourceDummy) Stats(ctx context.Context, pid int32) (procStats, error) {
+	stats, ok := p.stats[pid]
+	if !ok {
+		return procStats{}, errors.New("process not found")
+	}
+	return stats, nil
+}
+
+func TestProcessCollector(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "db.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte("30\n"), 0644))
+
+	source := &procSourceDummy{
+		refs: []procRef{
+			{pid: 10, name: "nginx", cmdline: "nginx: master process"},
+			{pid: 11, name: "nginx", cmdline: "nginx: worker process"},
+			// завершится до сбора статистики
+			{pid: 12, name: "nginx", cmdline: "nginx: worker process"},
+			{pid: 20, name: "bash", cmdline: "bash"},
+		},
+		stats: map[int32]procStats{
+			10: {cpuSeconds: 1, rss: 100, fds: 10, threads: 1},
+			11: {cpuSeconds: 2, rss: 200, fds: 20, threads: 4},
+			30: {cpuSeconds: 5, rss: 1000, fds: 50, threads: 8},
+		},
+	}
+	c := NewProcessCollector([]config.ProcessMatcher{
+		{Label: "web", Pattern: regexp.MustCompile("^nginx")},
+		{Label: "db", PIDFile: pidFile},
+	}, time.Second)
+	c.source = source
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	gauge := func(name string, value float64) models.Metric {
+		m, err := models.NewMetric(name, "gauge", value)
+		require.NoError(t, err)
+		return m
+	}
+
+	got, err := c.Collect(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metric{
+		gauge("ProcessCount_web", 2),
+		gauge("ProcessRSS_web", 300),
+		gauge("ProcessFDs_web", 30),
+		gauge("ProcessThreads_web", 5),
+		gauge("ProcessCount_db", 1),
+		gauge("ProcessRSS_db", 1000),
+		gauge("ProcessFDs_db", 50),
+		gauge("ProcessThreads_db", 8),
+	}, got)
+
+	// за 2 секунды процессы web потратили 1 секунду процессорного времени
+	now = now.Add(2 * time.Second)
+	source.stats[10] = procStats{cpuSeconds: 1.5, rss: 100, fds: 10, threads: 1}
+	source.stats[11] = procStats{cpuSeconds: 2.5, rss: 200, fds: 20, threads: 4}
+	require.NoError(t, os.Remove(pidFile))
+	got, err = c.Collect(context.TODO())
+	assert.ErrorContains(t, err, "process group db:")
+	assert.Contains(t, got, gauge("ProcessCPUPercent_web", 50))
+	assert.Contains(t, got, gauge("ProcessCount_db", 0))
+	assert.NotContains(t, got, gauge("ProcessCPUPercent_db", 0))
+}
+
+func TestProcessCollector_noProcesses(t *testing.T) {
+	got, err := NewProcessCollector(nil, time.Second).Collect(context.TODO())
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestProcessCollector_self(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "self.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644))
+	c := NewProcessCollector([]config.ProcessMatcher{{Label: "self", PIDFile: pidFile}}, time.Second)
+	got, err := c.Collect(context.TODO())
+	require.NoError(t, err)
+	require.NotEmpty(t, got)
+	assert.Equal(t, "ProcessCount_self", got[0].ID)
+	assert.EqualValues(t, 1, *got[0].Value)
+}
@@ -0,0 +1,273 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileSuffix = ".json"
+
+type spoolFile struct {
+	name    string
+	size    int64
+	created time.Time
+}
+
+// Spool очередь пачек метрик на диске для агента без связи с сервером.
+// Каждая пачка хранится отдельным файлом, имя начинается со времени записи, поэтому файлы упорядочены от старых к новым.
+// При превышении MaxBytes или MaxAge первыми удаляются самые старые пачки
+type Spool struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+	Logger   *zap.SugaredLogger
+	mu       sync.Mutex
+	files    []spoolFile
+	bytes    int64
+	// забранные Take, но еще не подтвержденные через Release пачки. В ограничение MaxBytes они не входят:
+	// неотправленная часть возвращается в очередь новым файлом, а сами пачки скоро будут удалены
+	leased      int
+	leasedBytes int64
+	seq         uint64
+	now         func() time.Time
+}
+
+// Lease пачки, забранные Take. Файлы пачек остаются на диске до Release, поэтому при падении агента
+// до подтверждения отправки пачки не теряются, а отправляются повторно после перезапуска
+type Lease struct {
+	Metrics []models.Metric
+	// время записи самой старой пачки, с ним неотправленные метрики возвращаются в очередь (AppendAt)
+	Created time.Time
+	files   []spoolFile
+}
+
+// NewSpool открывает каталог очереди, создавая его при необходимости, и подхватывает пачки, оставшиеся с прошлого запуска
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration, log *zap.SugaredLogger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("can not create spool directory: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can not read spool directory: %v", err)
+	}
+
+	s := &Spool{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		MaxAge:   maxAge,
+		Logger:   log,
+		now:      time.Now,
+	}
+	for _, e := range entries {
+		created, ok := parseName(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, spoolFile{name: e.Name(), size: info.Size(), created: created})
+		s.bytes += info.Size()
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+
+	s.mu.Lock()
+	s.trim()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// parseName возвращает время записи пачки из имени файла вида <unix nano>-<номер>.json
+func parseName(name string) (time.Time, bool) {
+	base, found := strings.CutSuffix(name, fileSuffix)
+	if !found {
+		return time.Time{}, false
+	}
+	nanos, _, found := strings.Cut(base, "-")
+	if !found {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// trim удаляет самые старые пачки сверх ограничений. Вызывается под mu
+func (s *Spool) trim() {
+	now := s.now()
+	dropped := 0
+	for len(s.files) > 0 {
+		oldest := s.files[0]
+		expired := s.MaxAge > 0 && now.Sub(oldest.created) > s.MaxAge
+		overflow := s.MaxBytes > 0 && s.bytes-s.leasedBytes > s.MaxBytes
+		if !expired && !overflow {
+			break
+		}
+		s.remove(oldest)
+		s.files = s.files[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		s.Logger.Warnf("Spool limits exceeded, %v oldest batches dropped", dropped)
+	}
+}
+
+func (s *Spool) remove(f spoolFile) {
+	if err := os.Remove(filepath.Join(s.Dir, f.name)); err != nil && !os.IsNotExist(err) {
+		s.Logger.Errorf("Can not remove spool file %v: %v", f.name, err)
+	}
+	s.bytes -= f.size
+}
+
+// Append сохраняет пачку в конец очереди
+func (s *Spool) Append(batch []models.Metric) error {
+	return s.AppendAt(batch, time.Time{})
+}
+
+// AppendAt сохраняет пачку так, будто она записана в created: по этому времени пачка упорядочивается
+// и устаревает по MaxAge. Нулевое created - текущее время
+func (s *Spool) AppendAt(batch []models.Metric, created time.Time) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("can not marshal batch: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if created.IsZero() {
+		created = s.now()
+	}
+	// с исходным временем возвращаются пачки, файлы которых еще на диске, поэтому имя не должно совпасть с ними
+	var name string
+	for {
+		s.seq++
+		name = fmt.Sprintf("%020d-%06d%v", created.UnixNano(), s.seq%1000000, fileSuffix)
+		if _, err = os.Lstat(filepath.Join(s.Dir, name)); err != nil {
+			break
+		}
+	}
+	// пишем во временный файл и переименовываем, чтобы при падении агента не осталось половины пачки
+	tmp, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("can not create spool file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("can not write spool file: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(s.Dir, name)); err != nil {
+		return fmt.Errorf("can not write spool file: %v", err)
+	}
+
+	f := spoolFile{name: name, size: int64(len(data)), created: created}
+	// пачка со старым временем встает перед более новыми
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].name > name })
+	s.files = slices.Insert(s.files, i, f)
+	s.bytes += f.size
+	s.trim()
+	return nil
+}
+
+// Take забирает все пачки из очереди от старых к новым и объединяет их метрики (Coalesce).
+// Пока пачки не подтверждены через Release, они не возвращаются повторно, но остаются на диске.
+// Если очередь пуста, результат nil
+func (s *Spool) Take() (*Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trim()
+	if len(s.files) == 0 {
+		return nil, nil
+	}
+	var metrics []models.Metric
+	for _, f := range s.files {
+		data, err := os.ReadFile(filepath.Join(s.Dir, f.name))
+		if err != nil {
+			return nil, fmt.Errorf("can not read spool file %v: %v", f.name, err)
+		}
+		var batch []models.Metric
+		if err = json.Unmarshal(data, &batch); err != nil {
+			s.Logger.Errorf("Spool file %v is corrupted and will be dropped: %v", f.name, err)
+		}
+		metrics = append(metrics, batch...)
+	}
+	lease := &Lease{Metrics: Coalesce(metrics), Created: s.files[0].created, files: s.files}
+	for _, f := range s.files {
+		s.leasedBytes += f.size
+	}
+	s.leased += len(s.files)
+	s.files = nil
+	return lease, nil
+}
+
+// Release удаляет файлы пачек после того, как все метрики lease отправлены или снова добавлены в очередь
+func (s *Spool) Release(lease *Lease) {
+	if lease == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range lease.files {
+		s.remove(f)
+		s.leasedBytes -= f.size
+	}
+	s.leased -= len(lease.files)
+	lease.files = nil
+}
+
+// Depth количество пачек на диске, включая забранные Take, и их размер в байтах
+func (s *Spool) Depth() (batches int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files) + s.leased, s.bytes
+}
+
+// Coalesce объединяет метрики с одинаковыми именами: counter суммируются, у gauge остается последнее значение.
+// Порядок метрик - по первому появлению имени
+func Coalesce(metrics []models.Metric) []models.Metric {
+	index := make(map[string]int)
+	var result []models.Metric
+	for _, m := range metrics {
+		key := m.MType + "/" + m.ID
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(result)
+			result = append(result, m.Clone())
+			continue
+		}
+		switch {
+		case m.MType == models.Counter.String() && m.Delta != nil:
+			sum := *m.Delta
+			if result[i].Delta != nil {
+				sum += *result[i].Delta
+			}
+			result[i].Delta = &sum
+		default:
+			result[i] = m.Clone()
+		}
+	}
+	return result
+}
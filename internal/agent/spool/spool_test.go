@@ -0,0 +1,203 @@
+package spool
+
+import (
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func metric(t *testing.T, name, mtype string, value any) models.Metric {
+	m, err := models.NewMetric(name, mtype, value)
+	require.NoError(t, err)
+	return m
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []models.Metric
+		want    []models.Metric
+	}{
+		{name: "no metrics"},
+		{
+			name: "counters are summed, last gauge wins",
+			metrics: []models.Metric{
+				metric(t, "PollCount", "counter", 2),
+				metric(t, "Alloc", "gauge", 1),
+				metric(t, "PollCount", "counter", 3),
+				metric(t, "Alloc", "gauge", 5),
+			},
+			want: []models.Metric{
+				metric(t, "PollCount", "counter", 5),
+				metric(t, "Alloc", "gauge", 5),
+			},
+		},
+		{
+			name: "same name with different types",
+			metrics: []models.Metric{
+				metric(t, "test", "counter", 1),
+				metric(t, "test", "gauge", 1),
+			},
+			want: []models.Metric{
+				metric(t, "test", "counter", 1),
+				metric(t, "test", "gauge", 1),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Coalesce(tt.metrics))
+		})
+	}
+
+	t.Run("source metrics are not changed", func(t *testing.T) {
+		metrics := []models.Metric{metric(t, "PollCount", "counter", 2), metric(t, "PollCount", "counter", 3)}
+		Coalesce(metrics)
+		assert.EqualValues(t, 2, *metrics[0].Delta)
+	})
+}
+
+func TestSpool(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	t.Run("take in order and survive restart", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewSpool(dir, 1<<20, time.Hour, log)
+		require.NoError(t, err)
+		require.NoError(t, s.Append([]models.Metric{metric(t, "PollCount", "counter", 1), metric(t, "Alloc", "gauge", 1)}))
+		require.NoError(t, s.Append([]models.Metric{metric(t, "PollCount", "counter", 2), metric(t, "Alloc", "gauge", 2)}))
+		// мусор в каталоге не считается пачкой
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("test"), 0644))
+
+		restarted, err := NewSpool(dir, 1<<20, time.Hour, log)
+		require.NoError(t, err)
+		batches, bytes := restarted.Depth()
+		assert.Equal(t, 2, batches)
+		assert.Greater(t, bytes, int64(0))
+
+		lease, err := restarted.Take()
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{metric(t, "PollCount", "counter", 3), metric(t, "Alloc", "gauge", 2)}, lease.Metrics)
+
+		// до подтверждения пачки остаются на диске, но повторно не забираются
+		batches, _ = restarted.Depth()
+		assert.Equal(t, 2, batches)
+		again, err := restarted.Take()
+		require.NoError(t, err)
+		assert.Nil(t, again)
+
+		restarted.Release(lease)
+		batches, bytes = restarted.Depth()
+		assert.Equal(t, 0, batches)
+		assert.Equal(t, int64(0), bytes)
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("unreleased batches survive restart", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewSpool(dir, 1<<20, time.Hour, log)
+		require.NoError(t, err)
+		require.NoError(t, s.Append([]models.Metric{metric(t, "PollCount", "counter", 1)}))
+		_, err = s.Take()
+		require.NoError(t, err)
+
+		// агент упал до подтверждения отправки
+		restarted, err := NewSpool(dir, 1<<20, time.Hour, log)
+		require.NoError(t, err)
+		lease, err := restarted.Take()
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{metric(t, "PollCount", "counter", 1)}, lease.Metrics)
+
+		// возвращенная пачка не перезаписывает файл, который удалит Release
+		require.NoError(t, restarted.AppendAt(lease.Metrics, lease.Created))
+		restarted.Release(lease)
+		lease, err = restarted.Take()
+		require.NoError(t, err)
+		require.NotNil(t, lease)
+		assert.Equal(t, []models.Metric{metric(t, "PollCount", "counter", 1)}, lease.Metrics)
+	})
+
+	t.Run("failed batch keeps its place and age", func(t *testing.T) {
+		s, err := NewSpool(t.TempDir(), 1<<20, time.Minute, log)
+		require.NoError(t, err)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		require.NoError(t, s.Append([]models.Metric{metric(t, "Alloc", "gauge", 1)}))
+		lease, err := s.Take()
+		require.NoError(t, err)
+		assert.Equal(t, now.UnixNano(), lease.Created.UnixNano())
+
+		now = now.Add(30 * time.Second)
+		require.NoError(t, s.Append([]models.Metric{metric(t, "Alloc", "gauge", 2)}))
+		// отправка не удалась: пачка возвращается раньше более новой
+		require.NoError(t, s.AppendAt(lease.Metrics, lease.Created))
+		s.Release(lease)
+		next, err := s.Take()
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{metric(t, "Alloc", "gauge", 2)}, next.Metrics)
+		s.Release(next)
+
+		// и устаревает по исходному времени
+		require.NoError(t, s.AppendAt(next.Metrics, next.Created))
+		now = now.Add(time.Minute)
+		next, err = s.Take()
+		require.NoError(t, err)
+		assert.Nil(t, next)
+	})
+
+	t.Run("size limit drops oldest batches", func(t *testing.T) {
+		s, err := NewSpool(t.TempDir(), 150, time.Hour, log)
+		require.NoError(t, err)
+		for i := 1; i <= 5; i++ {
+			require.NoError(t, s.Append([]models.Metric{metric(t, "PollCount", "counter", i)}))
+		}
+		batches, bytes := s.Depth()
+		assert.LessOrEqual(t, bytes, int64(150))
+		assert.Less(t, batches, 5)
+
+		lease, err := s.Take()
+		require.NoError(t, err)
+		// остались только последние пачки
+		var want int64
+		for i := 5; i > 5-batches; i-- {
+			want += int64(i)
+		}
+		assert.Equal(t, want, *lease.Metrics[0].Delta)
+	})
+
+	t.Run("age limit drops old batches", func(t *testing.T) {
+		s, err := NewSpool(t.TempDir(), 1<<20, time.Minute, log)
+		require.NoError(t, err)
+		now := time.Now()
+		s.now = func() time.Time { return now }
+		require.NoError(t, s.Append([]models.Metric{metric(t, "old", "gauge", 1)}))
+		now = now.Add(2 * time.Minute)
+		require.NoError(t, s.Append([]models.Metric{metric(t, "new", "gauge", 1)}))
+
+		lease, err := s.Take()
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{metric(t, "new", "gauge", 1)}, lease.Metrics)
+	})
+
+	t.Run("corrupted batch is dropped", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := NewSpool(dir, 1<<20, time.Hour, log)
+		require.NoError(t, err)
+		require.NoError(t, s.Append([]models.Metric{metric(t, "test", "gauge", 1)}))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "1-000001.json"), []byte("{broken"), 0644))
+
+		restarted, err := NewSpool(dir, 1<<20, 0, log)
+		require.NoError(t, err)
+		lease, err := restarted.Take()
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{metric(t, "test", "gauge", 1)}, lease.Metrics)
+	})
+}
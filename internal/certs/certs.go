@@ -0,0 +1,155 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"sync"
+)
+
+// Reloader держит в памяти сертификат, ключ и CA bundle и умеет перечитывать их с диска без рестарта приложения
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	logger   *zap.SugaredLogger
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+}
+
+func NewReloader(certFile, keyFile, caFile string, logger *zap.SugaredLogger) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("certificate and key must be specified together")
+	}
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		logger:   logger,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload перечитывает файлы. При ошибке продолжают использоваться ранее загруженные сертификаты
+func (r *Reloader) Reload() error {
+	var cert *tls.Certificate
+	var caPool *x509.CertPool
+
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("can not load certificate '%v' and key '%v': %v", r.certFile, r.keyFile, err)
+		}
+		cert = &c
+	}
+
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("can not read CA bundle '%v': %v", r.caFile, err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA bundle '%v' does not contain any valid certificate", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = cert
+	r.caPool = caPool
+	r.mu.Unlock()
+
+	r.logger.Infof("TLS certificates are loaded (cert: '%v', CA: '%v')", r.certFile, r.caFile)
+	return nil
+}
+
+func (r *Reloader) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *Reloader) pool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.caPool
+}
+
+// ServerConfig возвращает конфиг для http.Server. Если задан CA bundle, то клиенты обязаны предъявить
+// сертификат, подписанный этим CA (mutual TLS)
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert := r.certificate()
+			if cert == nil {
+				return nil, fmt.Errorf("server certificate is not loaded")
+			}
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool := r.pool(); pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig возвращает конфиг для http.Transport, подключающегося к serverAddr (host:port). Если задан CA bundle,
+// то сертификат сервера проверяется по нему, иначе по системному хранилищу. Клиентский сертификат предъявляется
+// только если он задан
+func (r *Reloader) ClientConfig(serverAddr string) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := r.certificate(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+	if r.caFile == "" {
+		return cfg
+	}
+	// RootCAs нельзя подменить у уже созданного транспорта, поэтому стандартную проверку отключаем
+	// и проверяем цепочку сами по актуальному пулу
+	cfg.InsecureSkipVerify = true
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		host = serverAddr
+	}
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("server did not present a certificate")
+		}
+		// при подключении по IP ServerName пуст (IP не передается в SNI), сверяем с адресом сервера
+		name := cs.ServerName
+		if name == "" {
+			name = host
+		}
+		if name == "" {
+			return fmt.Errorf("server name for certificate verification is unknown")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         r.pool(),
+			DNSName:       name,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return cfg
+}
@@ -0,0 +1,185 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCA{cert: cert, key: key}
+}
+
+// issue выпускает сертификат и записывает его вместе с ключом в dir
+func (ca testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func (ca testCA) write(t *testing.T, dir string) string {
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	return caFile
+}
+
+func TestNewReloader(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	t.Run("cert without key", func(t *testing.T) {
+		_, err := NewReloader("cert.pem", "", "", log)
+		assert.Error(t, err)
+	})
+
+	t.Run("missing files", func(t *testing.T) {
+		_, err := NewReloader("missing.crt", "missing.key", "", log)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid CA bundle", func(t *testing.T) {
+		caFile := filepath.Join(t.TempDir(), "ca.crt")
+		require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+		_, err := NewReloader("", "", caFile, log)
+		assert.Error(t, err)
+	})
+}
+
+func TestReloader_MutualTLS(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	serverDir := t.TempDir()
+	clientDir := t.TempDir()
+	ca := newTestCA(t)
+
+	serverCert, serverKey := ca.issue(t, serverDir, "server", x509.ExtKeyUsageServerAuth)
+	serverCA := ca.write(t, serverDir)
+	clientCert, clientKey := ca.issue(t, clientDir, "client", x509.ExtKeyUsageClientAuth)
+	clientCA := ca.write(t, clientDir)
+
+	serverCerts, err := NewReloader(serverCert, serverKey, serverCA, log)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = serverCerts.ServerConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	newClient := func(r *Reloader) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: r.ClientConfig(server.Listener.Addr().String())}}
+	}
+
+	t.Run("client with certificate", func(t *testing.T) {
+		clientCerts, err := NewReloader(clientCert, clientKey, clientCA, log)
+		require.NoError(t, err)
+		res, err := newClient(clientCerts).Get(server.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("client without certificate", func(t *testing.T) {
+		clientCerts, err := NewReloader("", "", clientCA, log)
+		require.NoError(t, err)
+		_, err = newClient(clientCerts).Get(server.URL)
+		assert.Error(t, err)
+	})
+
+	t.Run("server certificate is issued for another address", func(t *testing.T) {
+		clientCerts, err := NewReloader(clientCert, clientKey, clientCA, log)
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCerts.ClientConfig("127.0.0.2:8080")}}
+		_, err = client.Get(server.URL)
+		assert.ErrorContains(t, err, "127.0.0.2")
+	})
+
+	t.Run("client does not trust server CA", func(t *testing.T) {
+		otherDir := t.TempDir()
+		otherCA := newTestCA(t).write(t, otherDir)
+		clientCerts, err := NewReloader(clientCert, clientKey, otherCA, log)
+		require.NoError(t, err)
+		_, err = newClient(clientCerts).Get(server.URL)
+		assert.Error(t, err)
+	})
+
+	t.Run("server reloads certificates", func(t *testing.T) {
+		clientCerts, err := NewReloader(clientCert, clientKey, clientCA, log)
+		require.NoError(t, err)
+		client := newClient(clientCerts)
+
+		// переходим на новый CA: сервер должен перестать принимать старый клиентский сертификат
+		newCA := newTestCA(t)
+		newCA.issue(t, serverDir, "server", x509.ExtKeyUsageServerAuth)
+		newCA.write(t, serverDir)
+		require.NoError(t, serverCerts.Reload())
+
+		_, err = client.Get(server.URL)
+		assert.Error(t, err)
+
+		// после перевыпуска клиентских сертификатов и их перечитывания соединение снова устанавливается
+		newCA.issue(t, clientDir, "client", x509.ExtKeyUsageClientAuth)
+		newCA.write(t, clientDir)
+		require.NoError(t, clientCerts.Reload())
+		client.CloseIdleConnections()
+
+		res, err := client.Get(server.URL)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+}
@@ -23,6 +23,19 @@ func (m Metric) String() string {
 	return ""
 }
 
+// Clone копия метрики, не разделяющая с ней значения Delta и Value
+func (m Metric) Clone() Metric {
+	if m.Delta != nil {
+		delta := *m.Delta
+		m.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		m.Value = &value
+	}
+	return m
+}
+
 type MType string
 
 const (
@@ -140,3 +140,23 @@ func TestNewMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestMetric_Clone(t *testing.T) {
+	counter, err := NewMetric("counter", "counter", 5)
+	require.NoError(t, err)
+	gauge, err := NewMetric("gauge", "gauge", 1.5)
+	require.NoError(t, err)
+
+	for _, m := range []Metric{counter, gauge, {ID: "empty", MType: "gauge"}} {
+		clone := m.Clone()
+		assert.Equal(t, m, clone)
+		if m.Delta != nil {
+			*clone.Delta++
+			assert.NotEqual(t, *m.Delta, *clone.Delta)
+		}
+		if m.Value != nil {
+			*clone.Value++
+			assert.NotEqual(t, *m.Value, *clone.Value)
+		}
+	}
+}
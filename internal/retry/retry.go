@@ -4,16 +4,38 @@ import (
 	"context"
 	"fmt"
 	"go.uber.org/zap"
+	"math/rand"
 	"time"
 )
 
 type Worker func(ctx context.Context) (stopRetry bool, err error)
 
+// Backoff возвращает паузу перед повтором с номером attempt (с 1)
+type Backoff func(attempt int) time.Duration
+
 type Retry struct {
 	Logger        *zap.SugaredLogger
 	RetryAttempts int
 	SleepStep     time.Duration
 	Worker        Worker
+	// Backoff если задан, заменяет линейную паузу по SleepStep
+	Backoff Backoff
+}
+
+// FullJitter экспоненциальная пауза со случайным разбросом: случайное значение от 0 до initial*2^(attempt-1),
+// но не больше max
+func FullJitter(initial, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		ceiling := initial
+		for i := 1; i < attempt && ceiling < max; i++ {
+			ceiling *= 2
+		}
+		ceiling = min(ceiling, max)
+		if ceiling <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(ceiling) + 1))
+	}
 }
 
 func NewRetryer(logger *zap.SugaredLogger, attempts int, sleepStep time.Duration, worker Worker) *Retry {
@@ -37,21 +59,40 @@ func (w *Retry) Do(ctx context.Context) error {
 		return err
 	}
 	for i := 1; i <= w.RetryAttempts; i++ {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			sleepTime := time.Duration(i)*w.SleepStep - 1
+		var sleepTime time.Duration
+		if w.Backoff != nil {
+			sleepTime = w.Backoff(i)
+			w.Logger.Errorf("Retrying in %v", sleepTime)
+		} else {
+			sleepTime = time.Duration(i)*w.SleepStep - 1
 			w.Logger.Errorf("Retrying in %d seconds", sleepTime)
-			time.Sleep(sleepTime * time.Second)
-			stop, err = w.Worker(ctx)
-			if stop {
-				return err
-			}
-			if err == nil {
-				return nil
-			}
+			sleepTime *= time.Second
+		}
+		if err := sleep(ctx, sleepTime); err != nil {
+			return err
+		}
+		stop, err = w.Worker(ctx)
+		if stop {
+			return err
+		}
+		if err == nil {
+			return nil
 		}
 	}
 	return fmt.Errorf("retry quota exceeded (last origin error: %w)", err)
 }
+
+// sleep ждет d или отмены контекста
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
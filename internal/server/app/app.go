@@ -4,16 +4,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/certs"
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/server/audit"
+	"github.com/aksenk/go-yandex-metrics/internal/server/auth"
 	"github.com/aksenk/go-yandex-metrics/internal/server/config"
 	"github.com/aksenk/go-yandex-metrics/internal/server/handlers"
+	"github.com/aksenk/go-yandex-metrics/internal/server/policy"
+	"github.com/aksenk/go-yandex-metrics/internal/server/ratelimit"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/cache"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/fanout"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage/filestorage"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage/postgres"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/redis"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/sqlite"
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-migrate/migrate/v4/source"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"go.uber.org/zap"
 	"net/http"
+	"os"
+	"regexp"
+	"slices"
 	"time"
 )
 
@@ -23,44 +38,83 @@ type App struct {
 	config  *config.Config
 	server  *http.Server
 	logger  *zap.SugaredLogger
+	certs   *certs.Reloader
+	stats   *stats.Registry
+	auditor *audit.Auditor
+	// postgres и cache заданы, если используются, storage в этом случае может быть оберткой над ними
+	postgres *postgres.PostgresStorage
+	cache    *cache.CachedStorage
 }
 
 func (a *App) Start(ctx context.Context) error {
-	if a.config.Storage == storage.FileStorage {
-		if a.config.Metrics.StartupRestore {
-			err := a.storage.StartupRestore(ctx)
-			if err != nil {
-				return err
-			}
+	useFile := slices.Contains(a.config.StorageTypes(), storage.FileStorage)
+	// кеш всегда загружает метрики из базы, иначе первый сброс затрет данные в ней
+	if (useFile && a.config.Metrics.StartupRestore) || a.cache != nil {
+		if err := a.storage.StartupRestore(ctx); err != nil {
+			return err
+		}
+	}
+	if useFile {
+		// после восстановления WAL сворачивается в снапшот, а без восстановления старые данные затираются
+		if err := a.storage.FlushMetrics(); err != nil {
+			return err
 		}
 		if a.config.Metrics.StoreInterval > 0 {
 			go a.BackgroundFlusher(ctx)
 		}
 	}
+	if a.cache != nil {
+		go a.cache.Run(ctx)
+	}
+	if a.postgres != nil && len(a.config.PostgresStorage.ReplicaDSNs) > 0 {
+		go a.ReplicaChecker(ctx, a.postgres)
+	}
 
 	a.logger.Infof("Starting web server on %v", a.config.Server.ListenAddr)
 	if a.config.CryptConfig.Key != "" {
 		a.logger.Info("Request signing is enabled")
 	}
-	err := a.server.ListenAndServe()
+	var err error
+	if a.certs != nil {
+		a.logger.Info("TLS is enabled")
+		if a.config.Server.TLSClientCAFile != "" {
+			a.logger.Info("Client certificate verification is enabled")
+		}
+		// сертификаты отдаются через TLSConfig, поэтому пути к файлам не передаем
+		err = a.server.ListenAndServeTLS("", "")
+	} else {
+		err = a.server.ListenAndServe()
+	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 	return nil
 }
 
+// ReloadCertificates перечитывает TLS сертификаты с диска (вызывается по SIGHUP)
+func (a *App) ReloadCertificates() error {
+	if a.certs == nil {
+		return fmt.Errorf("TLS is not enabled")
+	}
+	return a.certs.Reload()
+}
+
 func (a *App) Stop(ctx context.Context) error {
 	a.logger.Info("Closing web server")
 	err := a.server.Shutdown(ctx)
 	if err != nil {
 		return err
 	}
-	if a.config.Storage == "file" {
+	// изменения из кеша записываются в базу до ее закрытия
+	if slices.Contains(a.config.StorageTypes(), storage.FileStorage) || a.cache != nil {
 		err = a.storage.FlushMetrics()
 		if err != nil {
 			return err
 		}
 	}
+	if err = a.auditor.Close(); err != nil {
+		return err
+	}
 	a.logger.Info("Closing storage")
 	err = a.storage.Close()
 	if err != nil {
@@ -78,56 +132,91 @@ func NewApp(config *config.Config) (*App, error) {
 	}
 	var router chi.Router
 	var s storage.Storager
+	var tokens auth.TokenStore
+	var auditSink audit.Sink
 
-	logger.Infof("Starting %v storage initialization", config.Storage)
-	synchronousFlush := false
-	if config.Metrics.StoreInterval == 0 {
-		logger.Info("Synchronous flushing is enabled")
-		synchronousFlush = true
+	stack, err := newStorageStack(config, logger, true)
+	if err != nil {
+		return nil, err
 	}
-
-	switch config.Storage {
-
-	case storage.MemoryStorage:
-		s = memstorage.NewMemStorage(logger)
-
-	case storage.FileStorage:
-		s, err = filestorage.NewFileStorage(config.FileStorage.FileName, synchronousFlush, logger)
-		if err != nil {
-			return nil, fmt.Errorf("can not init fileStorage: %v", err)
+	s = stack.storage
+	pgStorage, cachedStorage, fanOut := stack.postgres, stack.cache, stack.fanOut
+	if pgStorage != nil {
+		if config.AuthConfig.UseDatabase {
+			tokens = pgStorage
 		}
+		if config.Audit.UseDatabase {
+			auditSink = postgres.NewAuditSink(pgStorage)
+		}
+	}
 
-	case storage.PostgresStorage:
-		pgs, err := postgres.NewPostgresStorage(config, logger)
+	if config.AuthConfig.TokensFile != "" {
+		tokens, err = auth.NewFileTokenStore(config.AuthConfig.TokensFile)
 		if err != nil {
-			return nil, fmt.Errorf("can not init postgresStorage: %v", err)
+			return nil, fmt.Errorf("can not load tokens: %v", err)
 		}
+	}
+	if config.AuthConfig.Enabled() {
+		logger.Info("Token authentication is enabled")
+	}
 
-		logger.Info("Checking postgres connection")
-		err = pgs.Status(context.TODO())
+	var limiter *ratelimit.Limiter
+	if config.RateLimit.Enabled() {
+		logger.Infof("Rate limiting is enabled: %v requests/sec, %v metrics/sec per %v",
+			config.RateLimit.RequestsPerSecond, config.RateLimit.MetricsPerSecond, config.RateLimit.Key)
+		limiter = ratelimit.NewLimiter(ratelimit.Config{
+			RequestsPerSecond: config.RateLimit.RequestsPerSecond,
+			MetricsPerSecond:  config.RateLimit.MetricsPerSecond,
+			Key:               ratelimit.KeyType(config.RateLimit.Key),
+		})
+	}
+
+	registry := stats.NewRegistry()
+	if pgStorage != nil {
+		pgStorage.RegisterStats(registry)
+	}
+	if cachedStorage != nil {
+		cachedStorage.RegisterStats(registry)
+	}
+	if fanOut != nil {
+		fanOut.RegisterStats(registry)
+	}
+
+	if config.Audit.FileName != "" {
+		auditSink, err = audit.NewFileSink(config.Audit.FileName, int64(config.Audit.MaxSizeMB)*1024*1024, config.Audit.MaxBackups)
 		if err != nil {
-			logger.Errorf("Postgres connection is not OK: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("can not init audit log: %v", err)
 		}
-		logger.Info("Postgres connection is OK")
+	}
+	var auditor *audit.Auditor
+	if auditSink != nil {
+		logger.Info("Audit log is enabled")
+		auditor = audit.NewAuditor(auditSink, logger, registry)
+	}
 
-		logger.Info("Starting database migrations")
-		migrator := postgres.NewMigrator(pgs.Conn, config, logger)
-		migrator.Run()
-		if migrator.Err() != nil {
-			return nil, fmt.Errorf("can not run migrations: %v", err)
-		}
-		if migrator.Dirty() {
-			return nil, fmt.Errorf("database version %v have dirty status", migrator.Version())
-		}
-		s = pgs
-		logger.Infof("Database is up to date. Version: %v", migrator.Version())
+	policyConfig := policy.Config{
+		MaxMetrics:          config.Metrics.MaxMetrics,
+		MaxMetricsPerClient: config.Metrics.MaxMetricsPerClient,
+		MaxNameLength:       config.Metrics.MaxNameLength,
+	}
+	if config.Metrics.NamePattern != "" {
+		// имя должно соответствовать шаблону целиком
+		policyConfig.NamePattern = regexp.MustCompile("^(?:" + config.Metrics.NamePattern + ")$")
+	}
 
-	default:
-		return nil, fmt.Errorf("unknown storage type: %v", config.Storage)
+	metricsPolicy := policy.New(policyConfig, s, registry)
+	if err = metricsPolicy.Load(context.Background()); err != nil {
+		return nil, err
 	}
 
-	router = handlers.NewRouter(s, logger, config.CryptConfig.Key)
+	router = handlers.NewRouter(s, logger, handlers.RouterOptions{
+		CryptKey: config.CryptConfig.Key,
+		Tokens:   tokens,
+		Limiter:  limiter,
+		Policy:   metricsPolicy,
+		Stats:    registry,
+		Auditor:  auditor,
+	})
 	srv := &http.Server{
 		Addr:              config.Server.ListenAddr,
 		Handler:           router,
@@ -136,12 +225,28 @@ func NewApp(config *config.Config) (*App, error) {
 		IdleTimeout:       120 * time.Second,
 		ReadHeaderTimeout: 20 * time.Second,
 	}
+
+	var reloader *certs.Reloader
+	if config.Server.TLSCertFile != "" {
+		reloader, err = certs.NewReloader(config.Server.TLSCertFile, config.Server.TLSKeyFile,
+			config.Server.TLSClientCAFile, logger)
+		if err != nil {
+			return nil, fmt.Errorf("can not load TLS certificates: %v", err)
+		}
+		srv.TLSConfig = reloader.ServerConfig()
+	}
+
 	return &App{
-		storage: s,
-		router:  &router,
-		config:  config,
-		server:  srv,
-		logger:  logger,
+		storage:  s,
+		router:   &router,
+		config:   config,
+		server:   srv,
+		logger:   logger,
+		certs:    reloader,
+		stats:    registry,
+		auditor:  auditor,
+		postgres: pgStorage,
+		cache:    cachedStorage,
 	}, nil
 }
 
@@ -162,3 +267,228 @@ func (a *App) BackgroundFlusher(ctx context.Context) {
 		}
 	}
 }
+
+// ReplicaChecker периодически проверяет реплики postgres, чтобы вернуть восстановившиеся в выборку для чтения
+func (a *App) ReplicaChecker(ctx context.Context, pgs *postgres.PostgresStorage) {
+	period := time.Duration(a.config.PostgresStorage.HealthCheckPeriod) * time.Second
+	if period == 0 {
+		period = time.Minute
+	}
+	a.logger.Infof("Starting postgres replicas health checks every %v", period)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pgs.CheckReplicas(ctx)
+		case <-ctx.Done():
+			a.logger.Info("ReplicaChecker stopped")
+			return
+		}
+	}
+}
+
+// migrationState состояние базы после Run или Status мигратора
+type migrationState interface {
+	Err() error
+	Dirty() bool
+	Version() uint
+}
+
+// checkMigrations проверяет результат миграций. Без migrate база должна быть уже мигрирована до последней версии
+// из migrationsDir: иначе хранилище не открывается, чтобы схема не менялась неявно
+func checkMigrations(m migrationState, migrationsDir string, migrate bool) error {
+	if m.Err() != nil {
+		if migrate {
+			return fmt.Errorf("can not run migrations: %v", m.Err())
+		}
+		return fmt.Errorf("can not check database version: %v", m.Err())
+	}
+	if m.Dirty() {
+		return fmt.Errorf("database version %v have dirty status", m.Version())
+	}
+	if migrate {
+		return nil
+	}
+	latest, err := latestMigration(migrationsDir)
+	if err != nil {
+		return fmt.Errorf("can not read migrations: %v", err)
+	}
+	if m.Version() != latest {
+		return fmt.Errorf("database version %v does not match migrations version %v, run 'migrate up' first", m.Version(), latest)
+	}
+	return nil
+}
+
+// latestMigration возвращает версию последней миграции в migrationsDir
+func latestMigration(migrationsDir string) (uint, error) {
+	src, err := source.Open("file://" + migrationsDir)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	version, err := src.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
+
+// storageStack хранилища приложения: основное, кеш над ним и дополнительные хранилища поверх.
+// storage итоговое хранилище, с которым работает сервер, остальные поля заданы, если используются
+type storageStack struct {
+	storage  storage.Storager
+	postgres *postgres.PostgresStorage
+	cache    *cache.CachedStorage
+	fanOut   *fanout.FanOutStorage
+}
+
+// newStorageStack создает все хранилища из конфига и собирает их в одно.
+// Если migrate, то базы мигрируются до последней версии, иначе их версия только проверяется
+func newStorageStack(config *config.Config, logger *zap.SugaredLogger, migrate bool) (*storageStack, error) {
+	var stack storageStack
+	storages := make(map[storage.SType]storage.Storager)
+	for _, t := range config.StorageTypes() {
+		st, err := newStorage(config, t, logger, migrate)
+		if err != nil {
+			for _, opened := range storages {
+				opened.Close()
+			}
+			return nil, err
+		}
+		storages[t] = st
+	}
+	stack.storage = storages[config.Storage]
+	if pgs, ok := storages[storage.PostgresStorage].(*postgres.PostgresStorage); ok {
+		stack.postgres = pgs
+	}
+
+	if config.Cache.Enabled {
+		logger.Infof("Write-behind cache is enabled: flushing every %v seconds or %v changed metrics",
+			config.Cache.FlushInterval, config.Cache.FlushSize)
+		stack.cache = cache.NewCachedStorage(stack.storage, config.Cache, logger)
+		stack.storage = stack.cache
+	}
+
+	if len(config.Secondaries) > 0 {
+		var secondaries []fanout.Secondary
+		for _, sc := range config.Secondaries {
+			logger.Infof("Writes are copied to %v storage, error policy: %v", sc.Type, sc.OnError)
+			secondaries = append(secondaries, fanout.Secondary{
+				Name:    string(sc.Type),
+				Storage: storages[sc.Type],
+				OnError: fanout.ErrorPolicy(sc.OnError),
+			})
+		}
+		stack.fanOut = fanout.NewFanOutStorage(stack.storage, secondaries, config.RetryConfig, logger)
+		stack.storage = stack.fanOut
+	}
+	return &stack, nil
+}
+
+// newStorage создает хранилище указанного типа: подключается к базе и выполняет миграции (migrate)
+// или проверяет, что они уже выполнены
+func newStorage(config *config.Config, stype storage.SType, logger *zap.SugaredLogger, migrate bool) (storage.Storager, error) {
+	logger.Infof("Starting %v storage initialization", stype)
+	switch stype {
+
+	case storage.MemoryStorage:
+		return memstorage.NewMemStorage(logger), nil
+
+	case storage.FileStorage:
+		fs, err := filestorage.NewFileStorage(config.FileStorage.FileName, false, logger)
+		if err != nil {
+			return nil, fmt.Errorf("can not init fileStorage: %v", err)
+		}
+		fs.Fsync = filestorage.FsyncPolicy(config.FileStorage.Fsync)
+		logger.Infof("WAL fsync policy: %v", fs.Fsync)
+		return fs, nil
+
+	case storage.PostgresStorage:
+		pgs, err := postgres.NewPostgresStorage(config, logger)
+		if err != nil {
+			return nil, fmt.Errorf("can not init postgresStorage: %v", err)
+		}
+
+		// миграции выполняются на отдельном соединении до первого обращения к пулу:
+		// соединения пула подготавливают запросы к таблицам, которые создают миграции
+		migrationDB := pgs.OpenDB()
+		migrator := postgres.NewMigrator(migrationDB, config, logger)
+		if migrate {
+			logger.Info("Starting database migrations")
+			migrator.Run()
+		} else {
+			migrator.Status()
+		}
+		migrationDB.Close()
+		if err = checkMigrations(migrator, config.PostgresStorage.MigrationsDir, migrate); err != nil {
+			pgs.Close()
+			return nil, err
+		}
+
+		logger.Info("Checking postgres connection")
+		err = pgs.Status(context.TODO())
+		if err != nil {
+			logger.Errorf("Postgres connection is not OK: %v", err)
+			pgs.Close()
+			return nil, err
+		}
+		logger.Info("Postgres connection is OK")
+		if len(config.PostgresStorage.ReplicaDSNs) > 0 {
+			logger.Infof("Postgres read replicas: %v configured, %v available",
+				len(config.PostgresStorage.ReplicaDSNs), pgs.HealthyReplicas())
+		}
+		logger.Infof("Database is up to date. Version: %v", migrator.Version())
+		return pgs, nil
+
+	case storage.SQLiteStorage:
+		sqs, err := sqlite.NewSQLiteStorage(config, logger)
+		if err != nil {
+			return nil, fmt.Errorf("can not init sqliteStorage: %v", err)
+		}
+		if err = sqs.Status(context.TODO()); err != nil {
+			logger.Errorf("SQLite database is not OK: %v", err)
+			sqs.Close()
+			return nil, err
+		}
+
+		migrator := sqlite.NewMigrator(sqs.Conn, config, logger)
+		if migrate {
+			logger.Info("Starting database migrations")
+			migrator.Run()
+		} else {
+			migrator.Status()
+		}
+		if err = checkMigrations(migrator, config.SQLiteStorage.MigrationsDir, migrate); err != nil {
+			sqs.Close()
+			return nil, err
+		}
+		logger.Infof("Database is up to date. Version: %v", migrator.Version())
+		return sqs, nil
+
+	case storage.RedisStorage:
+		rs, err := redis.NewRedisStorage(config, logger)
+		if err != nil {
+			return nil, fmt.Errorf("can not init redisStorage: %v", err)
+		}
+		logger.Info("Checking redis connection")
+		if err = rs.Status(context.TODO()); err != nil {
+			logger.Errorf("Redis connection is not OK: %v", err)
+			return nil, err
+		}
+		logger.Info("Redis connection is OK")
+		return rs, nil
+
+	default:
+		return nil, fmt.Errorf("unknown storage type: %v", stype)
+	}
+}
@@ -0,0 +1,264 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/handlers"
+	"github.com/aksenk/go-yandex-metrics/internal/server/snapshot"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/filestorage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/postgres"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CommandsUsage описание административных подкоманд для справки
+const CommandsUsage = `Commands (without command the server is started):
+  migrate up                 apply all new database migrations
+  migrate down [N]           roll back N last migrations (1 by default)
+  migrate version            print database version and dirty state
+  migrate force VERSION      set database version and clear dirty state without running migrations
+  export FILE                write all metrics to FILE in JSON lines ('-' for stdout, gzipped if FILE ends with .gz)
+  import FILE [MODE]         load metrics from FILE ('-' for stdin), MODE is 'replace' (default) or 'merge'
+  compact                    replay file storage WAL into the snapshot and truncate WAL
+  check-config               validate flags and environment variables and print the resulting config
+`
+
+// RunCommand выполняет административную подкоманду из config.Command. Результат выводится в out.
+// Команды работают с хранилищем напрямую, поэтому compact и import для file storage нельзя запускать при работающем сервере
+func RunCommand(ctx context.Context, config *config.Config, out io.Writer) error {
+	if len(config.Command) == 0 {
+		return fmt.Errorf("command is not specified")
+	}
+	log, err := logger.NewLogger(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	name, args := config.Command[0], config.Command[1:]
+	switch name {
+	case "migrate":
+		return migrateCommand(config, args, log, out)
+	case "export":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: export FILE")
+		}
+		return exportCommand(ctx, config, args[0], log, out)
+	case "import":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: import FILE [replace|merge]")
+		}
+		mode := snapshot.ModeReplace
+		if len(args) == 2 {
+			mode = args[1]
+		}
+		return importCommand(ctx, config, args[0], mode, log, out)
+	case "compact":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: compact")
+		}
+		return compactCommand(ctx, config, log, out)
+	case "check-config":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: check-config")
+		}
+		return checkConfigCommand(config, out)
+	}
+	return fmt.Errorf("unknown command '%v'", name)
+}
+
+func migrateCommand(config *config.Config, args []string, log *zap.SugaredLogger, out io.Writer) error {
+	if !slices.Contains(config.StorageTypes(), storage.PostgresStorage) {
+		return fmt.Errorf("migrations require database storage")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [N]|version|force VERSION")
+	}
+	pgs, err := postgres.NewPostgresStorage(config, log)
+	if err != nil {
+		return fmt.Errorf("can not init postgresStorage: %v", err)
+	}
+	defer pgs.Close()
+	db := pgs.OpenDB()
+	defer db.Close()
+	migrator := postgres.NewMigrator(db, config, log)
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		err = migrator.Up()
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			if steps, err = strconv.Atoi(args[1]); err != nil {
+				return fmt.Errorf("incorrect count of migrations '%v': %v", args[1], err)
+			}
+		}
+		err = migrator.Down(steps)
+	case args[0] == "version" && len(args) == 1:
+		err = migrator.Status()
+	case args[0] == "force" && len(args) == 2:
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("incorrect version '%v': %v", args[1], convErr)
+		}
+		err = migrator.Force(version)
+	default:
+		return fmt.Errorf("usage: migrate up|down [N]|version|force VERSION")
+	}
+	if err != nil {
+		return fmt.Errorf("migrate %v: %v (version: %v, dirty: %v)", args[0], err, migrator.Version(), migrator.Dirty())
+	}
+	fmt.Fprintf(out, "version: %v, dirty: %v\n", migrator.Version(), migrator.Dirty())
+	return nil
+}
+
+// openCommandStorage открывает хранилища как сервер и загружает сохраненные метрики.
+// Миграции не выполняются: если версия базы не совпадает с миграциями, команда завершается ошибкой
+func openCommandStorage(ctx context.Context, config *config.Config, log *zap.SugaredLogger) (storage.Storager, error) {
+	if config.Storage == storage.MemoryStorage {
+		return nil, fmt.Errorf("persistent storage is not configured")
+	}
+	stack, err := newStorageStack(config, log, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = stack.storage.StartupRestore(ctx); err != nil {
+		stack.storage.Close()
+		return nil, err
+	}
+	return stack.storage, nil
+}
+
+func exportCommand(ctx context.Context, config *config.Config, fileName string, log *zap.SugaredLogger, out io.Writer) error {
+	s, err := openCommandStorage(ctx, config, log)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	all, err := s.GetAllMetrics(storage.WithPrimary(ctx))
+	if err != nil {
+		return err
+	}
+
+	w := out
+	if fileName != "-" {
+		file, err := os.Create(fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if strings.HasSuffix(fileName, ".gz") {
+		err = snapshot.WriteGzip(w, all)
+	} else {
+		err = snapshot.Write(w, all)
+	}
+	if err != nil {
+		return fmt.Errorf("can not write snapshot: %v", err)
+	}
+	if fileName != "-" {
+		fmt.Fprintf(out, "%v metrics exported to %v\n", len(all), fileName)
+	}
+	return nil
+}
+
+func importCommand(ctx context.Context, config *config.Config, fileName, mode string, log *zap.SugaredLogger, out io.Writer) error {
+	if mode != snapshot.ModeReplace && mode != snapshot.ModeMerge {
+		return fmt.Errorf("unknown import mode '%v'. Should be '%v' or '%v'", mode, snapshot.ModeReplace, snapshot.ModeMerge)
+	}
+	var r io.Reader = os.Stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	// снапшот проверяется целиком до открытия хранилища
+	metrics, err := snapshot.Read(r)
+	if err != nil {
+		return fmt.Errorf("incorrect snapshot: %v", err)
+	}
+
+	s, err := openCommandStorage(ctx, config, log)
+	if err != nil {
+		return err
+	}
+	if err = handlers.ImportSnapshot(ctx, metrics, mode, s, nil); err != nil {
+		s.Close()
+		return err
+	}
+	if err = s.FlushMetrics(); err != nil {
+		s.Close()
+		return err
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%v metrics imported (mode: %v)\n", len(metrics), mode)
+	return nil
+}
+
+func compactCommand(ctx context.Context, config *config.Config, log *zap.SugaredLogger, out io.Writer) error {
+	if !slices.Contains(config.StorageTypes(), storage.FileStorage) {
+		return fmt.Errorf("compact requires file storage")
+	}
+	fs, err := filestorage.NewFileStorage(config.FileStorage.FileName, true, log)
+	if err != nil {
+		return err
+	}
+	var walSize int64
+	if info, err := os.Stat(fs.WALName); err == nil {
+		walSize = info.Size()
+	}
+	if err = fs.StartupRestore(ctx); err != nil {
+		fs.Close()
+		return err
+	}
+	if err = fs.FlushMetrics(); err != nil {
+		fs.Close()
+		return err
+	}
+	if err = fs.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%v metrics written to %v, %v bytes of WAL compacted\n", len(fs.Metrics), fs.FileName, walSize)
+	return nil
+}
+
+func checkConfigCommand(config *config.Config, out io.Writer) error {
+	fmt.Fprintf(out, "listen address: %v\n", config.Server.ListenAddr)
+	fmt.Fprintf(out, "storage: %v\n", config.Storage)
+	for _, s := range config.Secondaries {
+		fmt.Fprintf(out, "secondary storage: %v (on error: %v)\n", s.Type, s.OnError)
+	}
+	for _, t := range config.StorageTypes() {
+		switch t {
+		case storage.FileStorage:
+			fmt.Fprintf(out, "file storage: %v (fsync: %v, store interval: %vs)\n",
+				config.FileStorage.FileName, config.FileStorage.Fsync, config.Metrics.StoreInterval)
+		case storage.PostgresStorage:
+			fmt.Fprintf(out, "postgres: pool %v-%v connections, %v read replicas\n",
+				config.PostgresStorage.MinConns, config.PostgresStorage.MaxConns, len(config.PostgresStorage.ReplicaDSNs))
+		case storage.SQLiteStorage:
+			fmt.Fprintf(out, "sqlite: %v\n", config.SQLiteStorage.FileName)
+		case storage.RedisStorage:
+			fmt.Fprintf(out, "redis: prefix '%v'\n", config.RedisStorage.Prefix)
+		}
+	}
+	if config.Cache.Enabled {
+		fmt.Fprintf(out, "cache: flush every %vs or %v metrics\n", config.Cache.FlushInterval, config.Cache.FlushSize)
+	}
+	fmt.Fprintf(out, "tls: %v\n", config.Server.TLSCertFile != "")
+	fmt.Fprintf(out, "authentication: %v\n", config.AuthConfig.Enabled())
+	fmt.Fprintf(out, "request signing: %v\n", config.CryptConfig.Key != "")
+	fmt.Fprintln(out, "config is OK")
+	return nil
+}
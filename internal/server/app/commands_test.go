@@ -0,0 +1,143 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"os"
+	"testing"
+)
+
+func fileStorageConfig(t *testing.T, command ...string) *config.Config {
+	return &config.Config{
+		Command:     command,
+		Storage:     storage.FileStorage,
+		LogLevel:    "error",
+		FileStorage: config.FileStorageConfig{FileName: t.TempDir() + "/metrics.json"},
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	dir := t.TempDir()
+	source := dir + "/source.jsonl"
+	snapshotData := `{"id":"a_counter","type":"counter","delta":3}` + "\n" + `{"id":"b_gauge","type":"gauge","value":1.5}` + "\n"
+	require.NoError(t, os.WriteFile(source, []byte(snapshotData), 0644))
+
+	t.Run("import, export and compact", func(t *testing.T) {
+		cfg := fileStorageConfig(t)
+		var out bytes.Buffer
+
+		cfg.Command = []string{"import", source}
+		require.NoError(t, RunCommand(context.TODO(), cfg, &out))
+		assert.Equal(t, "2 metrics imported (mode: replace)\n", out.String())
+
+		cfg.Command = []string{"import", source, "merge"}
+		require.NoError(t, RunCommand(context.TODO(), cfg, &out))
+
+		out.Reset()
+		cfg.Command = []string{"export", "-"}
+		require.NoError(t, RunCommand(context.TODO(), cfg, &out))
+		assert.Equal(t, `{"id":"a_counter","type":"counter","delta":6}`+"\n"+`{"id":"b_gauge","type":"gauge","value":1.5}`+"\n", out.String())
+
+		gzipped := dir + "/export.jsonl.gz"
+		out.Reset()
+		cfg.Command = []string{"export", gzipped}
+		require.NoError(t, RunCommand(context.TODO(), cfg, &out))
+		assert.Equal(t, "2 metrics exported to "+gzipped+"\n", out.String())
+
+		out.Reset()
+		cfg.Command = []string{"compact"}
+		require.NoError(t, RunCommand(context.TODO(), cfg, &out))
+		assert.Contains(t, out.String(), "2 metrics written to "+cfg.FileStorage.FileName)
+
+		// сжатый экспорт читается импортом в другое хранилище
+		other := fileStorageConfig(t, "import", gzipped)
+		require.NoError(t, RunCommand(context.TODO(), other, &out))
+		out.Reset()
+		other.Command = []string{"export", "-"}
+		require.NoError(t, RunCommand(context.TODO(), other, &out))
+		assert.Contains(t, out.String(), `"delta":6`)
+	})
+
+	t.Run("check-config", func(t *testing.T) {
+		var out bytes.Buffer
+		cfg := fileStorageConfig(t, "check-config")
+		cfg.CryptConfig.Key = "secret"
+		require.NoError(t, RunCommand(context.TODO(), cfg, &out))
+		assert.Contains(t, out.String(), "storage: file\n")
+		assert.Contains(t, out.String(), "request signing: true\n")
+		assert.NotContains(t, out.String(), "secret")
+	})
+
+	errorTests := []struct {
+		name    string
+		config  *config.Config
+		wantErr string
+	}{
+		{
+			name:    "unknown command",
+			config:  fileStorageConfig(t, "backup"),
+			wantErr: "unknown command 'backup'",
+		},
+		{
+			name:    "migrate without database",
+			config:  fileStorageConfig(t, "migrate", "up"),
+			wantErr: "migrations require database storage",
+		},
+		{
+			name:    "export from memory storage",
+			config:  &config.Config{Command: []string{"export", "-"}, Storage: storage.MemoryStorage, LogLevel: "error"},
+			wantErr: "persistent storage is not configured",
+		},
+		{
+			name:    "compact without file storage",
+			config:  &config.Config{Command: []string{"compact"}, Storage: storage.MemoryStorage, LogLevel: "error"},
+			wantErr: "compact requires file storage",
+		},
+		{
+			name:    "import with unknown mode",
+			config:  fileStorageConfig(t, "import", source, "append"),
+			wantErr: "unknown import mode 'append'. Should be 'replace' or 'merge'",
+		},
+		{
+			name:    "export without file",
+			config:  fileStorageConfig(t, "export"),
+			wantErr: "usage: export FILE",
+		},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, RunCommand(context.TODO(), tt.config, &bytes.Buffer{}), tt.wantErr)
+		})
+	}
+}
+
+func TestRunCommandSchemaVersion(t *testing.T) {
+	cfg := &config.Config{
+		Command:  []string{"export", "-"},
+		Storage:  storage.SQLiteStorage,
+		LogLevel: "error",
+		SQLiteStorage: config.SQLiteConfig{
+			FileName:      t.TempDir() + "/metrics.db",
+			MigrationsDir: "../../../migrations/sqlite",
+		},
+	}
+	var out bytes.Buffer
+
+	// команда не мигрирует базу сама
+	err := RunCommand(context.TODO(), cfg, &out)
+	assert.ErrorContains(t, err, "database version 0 does not match migrations version")
+	err = RunCommand(context.TODO(), cfg, &out)
+	assert.ErrorContains(t, err, "database version 0 does not match migrations version")
+
+	// после миграций сервером команда работает
+	stack, err := newStorageStack(cfg, zap.NewNop().Sugar(), true)
+	require.NoError(t, err)
+	require.NoError(t, stack.storage.Close())
+	require.NoError(t, RunCommand(context.TODO(), cfg, &out))
+	assert.Empty(t, out.String())
+}
@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/auth"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 1000
+)
+
+type contextKey string
+
+const keyClient contextKey = "audit_client"
+
+// Entry одно изменение метрики. OldValue пустой, если метрики до этого не было.
+// У удаленной метрики Deleted равен true, а NewValue пустой
+type Entry struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	KeyID    string    `json:"key_id,omitempty"`
+	MetricID string    `json:"metric_id"`
+	MType    string    `json:"type"`
+	OldType  string    `json:"old_type,omitempty"`
+	OldValue *string   `json:"old_value,omitempty"`
+	NewValue string    `json:"new_value"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// Filter пустые поля не ограничивают выборку. Client сравнивается и с IP, и с ID ключа
+type Filter struct {
+	MetricID string
+	Client   string
+	Limit    int
+}
+
+func (f Filter) Match(e Entry) bool {
+	if f.MetricID != "" && e.MetricID != f.MetricID {
+		return false
+	}
+	if f.Client != "" && e.ClientIP != f.Client && e.KeyID != f.Client {
+		return false
+	}
+	return true
+}
+
+// Sink хранилище аудит лога. Query возвращает записи от новых к старым
+type Sink interface {
+	Write(ctx context.Context, entries []Entry) error
+	Query(ctx context.Context, filter Filter) ([]Entry, error)
+	Close() error
+}
+
+// Change изменение метрики: Old равен nil, если метрика создается. У удаленной метрики Deleted равен true,
+// а New не заполняется
+type Change struct {
+	Old     *models.Metric
+	New     models.Metric
+	Deleted bool
+}
+
+type client struct {
+	ip    string
+	keyID string
+}
+
+// Auditor записывает принятые изменения метрик в Sink. Методы nil Auditor ничего не делают
+type Auditor struct {
+	sink   Sink
+	logger *zap.SugaredLogger
+	errors *stats.Counter
+}
+
+func NewAuditor(sink Sink, logger *zap.SugaredLogger, registry *stats.Registry) *Auditor {
+	return &Auditor{
+		sink:   sink,
+		logger: logger,
+		errors: registry.Counter("audit_write_errors"),
+	}
+}
+
+func (a *Auditor) Enabled() bool {
+	return a != nil
+}
+
+// Record не возвращает ошибку: изменения к этому моменту уже сохранены, поэтому ошибки записи только логируются
+func (a *Auditor) Record(ctx context.Context, changes []Change) {
+	if a == nil || len(changes) == 0 {
+		return
+	}
+	c, _ := ctx.Value(keyClient).(client)
+	now := time.Now().UTC()
+	entries := make([]Entry, 0, len(changes))
+	for _, ch := range changes {
+		e := Entry{
+			Time:     now,
+			ClientIP: c.ip,
+			KeyID:    c.keyID,
+			MetricID: ch.New.ID,
+			MType:    ch.New.MType,
+			NewValue: ch.New.String(),
+		}
+		if ch.Deleted {
+			e.MetricID = ch.Old.ID
+			e.MType = ch.Old.MType
+			e.NewValue = ""
+			e.Deleted = true
+		}
+		if ch.Old != nil {
+			old := ch.Old.String()
+			e.OldType = ch.Old.MType
+			e.OldValue = &old
+		}
+		entries = append(entries, e)
+	}
+	if err := a.sink.Write(ctx, entries); err != nil {
+		a.errors.Inc()
+		a.logger.Errorf("Can not write %v audit entries: %v", len(entries), err)
+	}
+}
+
+func (a *Auditor) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultQueryLimit
+	}
+	if filter.Limit > MaxQueryLimit {
+		filter.Limit = MaxQueryLimit
+	}
+	return a.sink.Query(ctx, filter)
+}
+
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.sink.Close()
+}
+
+// Middleware сохраняет в контекст запроса данные о клиенте для аудит лога
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := client{ip: auth.ClientIP(r)}
+		if token, ok := auth.FromContext(r.Context()); ok {
+			c.keyID = token.ID
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyClient, c)))
+	})
+}
@@ -0,0 +1,94 @@
+package audit
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "audit.log")
+
+	// размер файла подобран так, чтобы в него помещалось примерно две записи
+	sink, err := NewFileSink(fileName, 300, 2)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	for i, id := range []string{"a", "b", "a", "c", "a", "b"} {
+		value := string(rune('0' + i))
+		err = sink.Write(context.TODO(), []Entry{{ClientIP: "127.0.0.1", KeyID: "agent-" + id, MetricID: id, MType: "gauge", NewValue: value}})
+		require.NoError(t, err)
+	}
+
+	_, err = os.Stat(fileName + ".1")
+	assert.NoError(t, err, "audit file should be rotated")
+	_, err = os.Stat(fileName + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist, "only 2 backups should be kept")
+
+	t.Run("query by metric", func(t *testing.T) {
+		entries, err := sink.Query(context.TODO(), Filter{MetricID: "b"})
+		require.NoError(t, err)
+		require.NotEmpty(t, entries)
+		assert.Equal(t, "5", entries[0].NewValue, "newest entries should go first")
+		for _, e := range entries {
+			assert.Equal(t, "b", e.MetricID)
+		}
+	})
+
+	t.Run("query by client with limit", func(t *testing.T) {
+		entries, err := sink.Query(context.TODO(), Filter{Client: "agent-a", Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "4", entries[0].NewValue)
+	})
+}
+
+func TestAuditor_Record(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	sink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.log"), 0, 0)
+	require.NoError(t, err)
+	auditor := NewAuditor(sink, log, stats.NewRegistry())
+	defer auditor.Close()
+
+	old, err := models.NewMetric("counter", "counter", 5)
+	require.NoError(t, err)
+	updated, err := models.NewMetric("counter", "counter", 7)
+	require.NoError(t, err)
+	created, err := models.NewMetric("gauge", "gauge", 1.5)
+	require.NoError(t, err)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auditor.Record(r.Context(), []Change{{Old: &old, New: updated}, {Old: nil, New: created}})
+	}))
+	request := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	request.RemoteAddr = "10.0.0.1:5555"
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	entries, err := auditor.Query(context.TODO(), Filter{Client: "10.0.0.1"})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, "gauge", entries[0].MetricID)
+	assert.Nil(t, entries[0].OldValue)
+	assert.Equal(t, "1.5", entries[0].NewValue)
+
+	assert.Equal(t, "counter", entries[1].MetricID)
+	require.NotNil(t, entries[1].OldValue)
+	assert.Equal(t, "5", *entries[1].OldValue)
+	assert.Equal(t, "7", entries[1].NewValue)
+	assert.False(t, entries[1].Time.IsZero())
+
+	var nilAuditor *Auditor
+	nilAuditor.Record(context.TODO(), []Change{{New: created}})
+	assert.False(t, nilAuditor.Enabled())
+}
@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+// FileSink пишет аудит лог в JSON lines файл. При превышении maxSize файл ротируется:
+// file -> file.1 -> file.2 ... и хранится не больше maxBackups старых файлов
+type FileSink struct {
+	fileName   string
+	maxSize    int64
+	maxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+func NewFileSink(fileName string, maxSize int64, maxBackups int) (*FileSink, error) {
+	f := &FileSink{
+		fileName:   fileName,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("can not open audit file '%v': %v", f.fileName, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("can not stat audit file '%v': %v", f.fileName, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *FileSink) backupName(i int) string {
+	return fmt.Sprintf("%v.%v", f.fileName, i)
+}
+
+func (f *FileSink) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.maxBackups > 0 {
+		os.Remove(f.backupName(f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(f.backupName(i), f.backupName(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(f.fileName, f.backupName(1)); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(f.fileName, 0); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *FileSink) Write(ctx context.Context, entries []Entry) error {
+	var data []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("can not marshal audit entry: %v", err)
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return fmt.Errorf("can not rotate audit file '%v': %v", f.fileName, err)
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+func readEntries(fileName string) ([]Entry, error) {
+	file, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Query просматривает текущий файл и бэкапы от новых записей к старым
+func (f *FileSink) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files := []string{f.fileName}
+	for i := 1; i <= f.maxBackups; i++ {
+		files = append(files, f.backupName(i))
+	}
+	var result []Entry
+	for _, name := range files {
+		entries, err := readEntries(name)
+		if err != nil {
+			return nil, fmt.Errorf("can not read audit file '%v': %v", name, err)
+		}
+		slices.Reverse(entries)
+		for _, e := range entries {
+			if !filter.Match(e) {
+				continue
+			}
+			result = append(result, e)
+			if filter.Limit > 0 && len(result) >= filter.Limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+func (f *FileSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	// ScopeAdmin дает доступ к административным эндпоинтам и включает в себя все остальные скоупы
+	ScopeAdmin Scope = "admin"
+)
+
+type contextKey string
+
+const keyToken contextKey = "token"
+
+var ErrTokenNotFound = errors.New("token not found")
+
+type Token struct {
+	ID     string  `json:"id"`
+	Hash   string  `json:"hash"`
+	Scopes []Scope `json:"scopes"`
+}
+
+func (s Scope) Valid() bool {
+	return s == ScopeRead || s == ScopeWrite || s == ScopeAdmin
+}
+
+func (t *Token) HasScope(scope Scope) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+// TokenStore ищет токен по sha256 хешу от его значения. Сами токены нигде не хранятся
+type TokenStore interface {
+	LookupToken(ctx context.Context, hash string) (*Token, error)
+}
+
+func HashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, v := range strings.Split(s, ",") {
+		scope := Scope(strings.TrimSpace(v))
+		if scope == "" {
+			continue
+		}
+		if !scope.Valid() {
+			return nil, fmt.Errorf("unknown scope '%v'", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// FileTokenStore загружает токены из JSON файла вида
+// [{"id": "agent-1", "hash": "<sha256 hex>", "scopes": ["write"]}]
+type FileTokenStore struct {
+	tokens map[string]Token
+}
+
+func NewFileTokenStore(filename string) (*FileTokenStore, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can not read tokens file '%v': %v", filename, err)
+	}
+	var tokens []Token
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("can not parse tokens file '%v': %v", filename, err)
+	}
+	store := &FileTokenStore{tokens: make(map[string]Token, len(tokens))}
+	for _, t := range tokens {
+		if t.ID == "" || t.Hash == "" {
+			return nil, fmt.Errorf("token must have 'id' and 'hash' fields")
+		}
+		for _, s := range t.Scopes {
+			if !s.Valid() {
+				return nil, fmt.Errorf("token '%v': unknown scope '%v'", t.ID, s)
+			}
+		}
+		store.tokens[strings.ToLower(t.Hash)] = t
+	}
+	return store, nil
+}
+
+func (f *FileTokenStore) LookupToken(ctx context.Context, hash string) (*Token, error) {
+	if t, ok := f.tokens[hash]; ok {
+		return &t, nil
+	}
+	return nil, ErrTokenNotFound
+}
+
+func FromContext(ctx context.Context) (*Token, bool) {
+	t, ok := ctx.Value(keyToken).(*Token)
+	return t, ok
+}
+
+// ClientIP адрес клиента без порта
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientKey идентификатор клиента для лимитов: ID токена, а для запросов без токена IP адрес
+func ClientKey(r *http.Request) string {
+	if token, ok := FromContext(r.Context()); ok {
+		return "token:" + token.ID
+	}
+	return "ip:" + ClientIP(r)
+}
+
+// Middleware пропускает только запросы с заголовком 'Authorization: Bearer <token>', у которого есть нужный скоуп.
+// Если store не задан, то аутентификация выключена
+func Middleware(store TokenStore, scope Scope, log *zap.SugaredLogger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if store == nil {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			raw, found := strings.CutPrefix(header, "Bearer ")
+			if !found || raw == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "Authorization token is required", http.StatusUnauthorized)
+				return
+			}
+
+			token, err := store.LookupToken(r.Context(), HashToken(raw))
+			if errors.Is(err, ErrTokenNotFound) {
+				log.Errorf("Request with unknown token")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics", error="invalid_token"`)
+				http.Error(w, "Invalid authorization token", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				log.Errorf("Error checking token: %v", err)
+				http.Error(w, "Error checking authorization token", http.StatusInternalServerError)
+				return
+			}
+
+			if !token.HasScope(scope) {
+				log.Errorf("Token '%v' does not have '%v' scope", token.ID, scope)
+				http.Error(w, fmt.Sprintf("Token does not have '%v' scope", scope), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyToken, token)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
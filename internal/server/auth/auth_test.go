@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTokensFile(t *testing.T, content string) string {
+	fileName := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(content), 0600))
+	return fileName
+}
+
+func TestNewFileTokenStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "successful test",
+			content: `[{"id":"agent","hash":"` + HashToken("secret") + `","scopes":["write"]}]`,
+			wantErr: false,
+		},
+		{
+			name:    "unsuccessful test: unknown scope",
+			content: `[{"id":"agent","hash":"` + HashToken("secret") + `","scopes":["delete"]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unsuccessful test: missing hash",
+			content: `[{"id":"agent","scopes":["read"]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unsuccessful test: invalid json",
+			content: `{"id":"agent"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFileTokenStore(writeTokensFile(t, tt.content))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	store, err := NewFileTokenStore(writeTokensFile(t, `[
+		{"id":"reader","hash":"`+HashToken("reader-token")+`","scopes":["read"]},
+		{"id":"writer","hash":"`+HashToken("writer-token")+`","scopes":["read","write"]},
+		{"id":"admin","hash":"`+HashToken("admin-token")+`","scopes":["admin"]}
+	]`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		store    TokenStore
+		scope    Scope
+		header   string
+		wantCode int
+		wantID   string
+	}{
+		{
+			name:     "authentication disabled",
+			store:    nil,
+			scope:    ScopeWrite,
+			header:   "",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "missing token",
+			store:    store,
+			scope:    ScopeRead,
+			header:   "",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "not a bearer token",
+			store:    store,
+			scope:    ScopeRead,
+			header:   "Basic cmVhZGVyOnJlYWRlcg==",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown token",
+			store:    store,
+			scope:    ScopeRead,
+			header:   "Bearer unknown",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "token without scope",
+			store:    store,
+			scope:    ScopeWrite,
+			header:   "Bearer reader-token",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "token with scope",
+			store:    store,
+			scope:    ScopeWrite,
+			header:   "Bearer writer-token",
+			wantCode: http.StatusOK,
+			wantID:   "writer",
+		},
+		{
+			name:     "admin token has all scopes",
+			store:    store,
+			scope:    ScopeWrite,
+			header:   "Bearer admin-token",
+			wantCode: http.StatusOK,
+			wantID:   "admin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotID string
+			handler := Middleware(tt.store, tt.scope, log)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if token, ok := FromContext(r.Context()); ok {
+					gotID = token.ID
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				request.Header.Set("Authorization", tt.header)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			assert.Equal(t, tt.wantCode, recorder.Code)
+			assert.Equal(t, tt.wantID, gotID)
+		})
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("read, write")
+	require.NoError(t, err)
+	assert.Equal(t, []Scope{ScopeRead, ScopeWrite}, scopes)
+
+	_, err = ParseScopes("read,root")
+	assert.Error(t, err)
+
+	_, err = (&FileTokenStore{}).LookupToken(context.TODO(), "missing")
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+}
@@ -6,18 +6,87 @@ import (
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	Storage         storage.SType
+	// Command административная подкоманда и ее аргументы (аргументы после флагов). Пустая - запуск сервера
+	Command []string
+	Storage storage.SType
+	// Secondaries дополнительные хранилища, в которые дублируются записи основного
+	Secondaries     []SecondaryStorageConfig
 	LogLevel        string
 	Server          ServerConfig
 	Metrics         MetricsConfig
 	FileStorage     FileStorageConfig
 	PostgresStorage PostgresConfig
+	SQLiteStorage   SQLiteConfig
+	RedisStorage    RedisConfig
+	Cache           CacheConfig
 	RetryConfig     RetryConfig
 	CryptConfig     CryptConfig
+	AuthConfig      AuthConfig
+	RateLimit       RateLimitConfig
+	Audit           AuditConfig
+}
+
+// SecondaryStorageConfig дополнительное хранилище и политика ошибок записи в него: fail, log или retry
+type SecondaryStorageConfig struct {
+	Type    storage.SType
+	OnError string
+}
+
+// StorageTypes основное и все дополнительные хранилища
+func (c *Config) StorageTypes() []storage.SType {
+	return append([]storage.SType{c.Storage}, typesOf(c.Secondaries)...)
+}
+
+// parseStorages разбирает список хранилищ вида 'postgres,file:retry'. Первое хранилище основное,
+// у остальных через ':' может быть указана политика ошибок (по умолчанию log)
+func parseStorages(list string) (storage.SType, []SecondaryStorageConfig, error) {
+	var primary storage.SType
+	var secondaries []SecondaryStorageConfig
+	seen := make(map[storage.SType]bool)
+	for i, item := range strings.Split(list, ",") {
+		name, policy, found := strings.Cut(strings.TrimSpace(item), ":")
+		t := storage.SType(name)
+		switch t {
+		case storage.MemoryStorage, storage.FileStorage, storage.PostgresStorage, storage.SQLiteStorage, storage.RedisStorage:
+		default:
+			return "", nil, fmt.Errorf("unknown storage type '%v'", name)
+		}
+		if seen[t] {
+			return "", nil, fmt.Errorf("storage '%v' is specified more than once", name)
+		}
+		seen[t] = true
+		if i == 0 {
+			if found {
+				return "", nil, fmt.Errorf("error policy can not be set for the primary storage '%v'", name)
+			}
+			primary = t
+			continue
+		}
+		switch policy {
+		case "":
+			policy = "log"
+		case "fail", "log", "retry":
+		default:
+			return "", nil, fmt.Errorf("unknown error policy '%v' of storage '%v'. Should be 'fail', 'log' or 'retry'", policy, name)
+		}
+		secondaries = append(secondaries, SecondaryStorageConfig{Type: t, OnError: policy})
+	}
+	return primary, secondaries, nil
+}
+
+// CacheConfig write-behind кеш перед базой: метрики хранятся в памяти и сбрасываются в базу
+// раз в FlushInterval секунд или при накоплении FlushSize измененных метрик (0 - только по интервалу)
+type CacheConfig struct {
+	Enabled       bool
+	FlushInterval int
+	FlushSize     int
 }
 
 type RetryConfig struct {
@@ -26,28 +95,90 @@ type RetryConfig struct {
 }
 
 type ServerConfig struct {
-	ListenAddr string
+	ListenAddr      string
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
 }
 
 type MetricsConfig struct {
 	StoreInterval  int
 	StartupRestore bool
+	// ограничения на метрики, нулевые значения отключают ограничение
+	MaxMetrics          int
+	MaxMetricsPerClient int
+	MaxNameLength       int
+	NamePattern         string
 }
 
 type FileStorageConfig struct {
 	FileName string
+	// Fsync политика сброса WAL на диск: always, interval или never.
+	// Если не задана, то always при StoreInterval == 0, иначе interval
+	Fsync string
 }
 
 type PostgresConfig struct {
-	DSN           string
+	DSN string
+	// ReplicaDSNs реплики для чтения метрик
+	ReplicaDSNs   []string
 	Type          string
 	MigrationsDir string
+	// настройки пула соединений, времена в секундах
+	MaxConns          int
+	MinConns          int
+	MaxConnLifetime   int
+	MaxConnIdleTime   int
+	HealthCheckPeriod int
+}
+
+type SQLiteConfig struct {
+	FileName      string
+	MigrationsDir string
+}
+
+type RedisConfig struct {
+	URL    string
+	Prefix string
 }
 
 type CryptConfig struct {
 	Key string
 }
 
+// AuthConfig токены берутся либо из файла, либо из таблицы server.tokens (только для postgres storage)
+type AuthConfig struct {
+	TokensFile  string
+	UseDatabase bool
+}
+
+// RateLimitConfig нулевые значения отключают соответствующий лимит
+type RateLimitConfig struct {
+	RequestsPerSecond float64
+	MetricsPerSecond  float64
+	Key               string
+}
+
+func (r RateLimitConfig) Enabled() bool {
+	return r.RequestsPerSecond > 0 || r.MetricsPerSecond > 0
+}
+
+// AuditConfig аудит лог пишется либо в файл, либо в таблицу server.audit (только для postgres storage)
+type AuditConfig struct {
+	FileName    string
+	MaxSizeMB   int
+	MaxBackups  int
+	UseDatabase bool
+}
+
+func (a AuditConfig) Enabled() bool {
+	return a.FileName != "" || a.UseDatabase
+}
+
+func (a AuthConfig) Enabled() bool {
+	return a.TokensFile != "" || a.UseDatabase
+}
+
 func GetConfig() (*Config, error) {
 	log, err := logger.NewLogger("info")
 	if err != nil {
@@ -58,12 +189,44 @@ func GetConfig() (*Config, error) {
 	metricsStoreInterval := flag.Int("i", 300, "Period in seconds between flushing metrics to the disk (file storage)")
 	fileStorageFileName := flag.String("f", "", "Path to the file for storing metrics (file storage)")
 	fileStorageStartupRestore := flag.Bool("r", true, "Restoring metrics from the file at startup (file storage)")
+	fileStorageFsync := flag.String("fsync", "", "WAL fsync policy: 'always', 'interval' or 'never' (file storage)")
 	databaseDSN := flag.String("d", "", "Postgres connection DSN string (database storage)")
+	databaseReplicaDSNs := flag.String("db-replicas", "", "Comma separated list of postgres read replica DSN strings (database storage)")
+	dbMaxConns := flag.Int("db-max-conns", 10, "Maximum size of the postgres connection pool (database storage)")
+	dbMinConns := flag.Int("db-min-conns", 0, "Minimum count of idle postgres connections kept in the pool (database storage)")
+	dbMaxConnLifetime := flag.Int("db-max-conn-lifetime", 3600, "Lifetime of postgres connection in seconds (database storage)")
+	dbMaxConnIdleTime := flag.Int("db-max-conn-idle-time", 1800, "Idle postgres connection is closed after this period in seconds (database storage)")
+	dbHealthCheckPeriod := flag.Int("db-health-check-period", 60, "Period in seconds between health checks of idle postgres connections (database storage)")
+	sqliteFileName := flag.String("sqlite", "", "Path to the SQLite database file (sqlite storage)")
+	redisURL := flag.String("redis", "", "Redis connection URL, e.g. redis://localhost:6379/0 (redis storage)")
+	redisPrefix := flag.String("redis-prefix", "metrics", "Prefix of metric keys (redis storage)")
+	storages := flag.String("storages", "", "Comma separated storage types, e.g. 'postgres,file:retry'. "+
+		"The first is primary, writes are copied to others with error policy 'fail', 'log' (default) or 'retry'")
+	cacheEnabled := flag.Bool("cache", false, "Keep metrics in memory and write them to the database in background (database storage)")
+	cacheFlushInterval := flag.Int("cache-flush-interval", 10, "Period in seconds between writing changed metrics to the database (cache)")
+	cacheFlushSize := flag.Int("cache-flush-size", 1000, "Count of changed metrics that triggers writing to the database (cache, 0 - only by interval)")
 	cryptKey := flag.String("k", "", "Crypt key for signing requests")
+	authTokensFile := flag.String("auth-tokens", "", "Path to the JSON file with hashed bearer tokens (enables authentication)")
+	authUseDatabase := flag.Bool("auth-db", false, "Read hashed bearer tokens from the database (enables authentication, database storage)")
+	maxMetrics := flag.Int("max-metrics", 0, "Maximum number of distinct metrics (0 - unlimited)")
+	maxClientMetrics := flag.Int("max-client-metrics", 0, "Maximum number of distinct metrics created by one client (0 - unlimited)")
+	maxNameLength := flag.Int("max-name-length", 256, "Maximum length of metric name (0 - unlimited)")
+	namePattern := flag.String("name-pattern", "", "Regular expression that metric names must fully match")
+	auditFileName := flag.String("audit-file", "", "Path to the audit log file (enables audit)")
+	auditMaxSize := flag.Int("audit-max-size", 100, "Audit log file size in megabytes before rotation")
+	auditMaxBackups := flag.Int("audit-max-backups", 5, "Count of rotated audit log files to keep")
+	auditUseDatabase := flag.Bool("audit-db", false, "Write audit log to the database (enables audit, database storage)")
+	rateLimitRPS := flag.Float64("rate-limit-rps", 0, "Max requests per second from one client (0 - unlimited)")
+	rateLimitMPS := flag.Float64("rate-limit-mps", 0, "Max received metrics per second from one client (0 - unlimited)")
+	rateLimitKey := flag.String("rate-limit-key", "ip", "How to identify clients for rate limiting: 'ip' or 'token' (requests are always limited per IP before authentication as well)")
+	tlsCertFile := flag.String("tls-cert", "", "Path to the TLS certificate (enables HTTPS)")
+	tlsKeyFile := flag.String("tls-key", "", "Path to the TLS private key")
+	tlsClientCAFile := flag.String("tls-client-ca", "", "Path to the CA bundle for verifying client certificates (enables mutual TLS)")
 
 	retryAttempts := 3
 	retryWaitTime := 2
 	migrationsDir := "./migrations/postgres"
+	sqliteMigrationsDir := "./migrations/sqlite"
 
 	flag.Parse()
 
@@ -76,9 +239,141 @@ func GetConfig() (*Config, error) {
 	if e := os.Getenv("DATABASE_DSN"); e != "" {
 		databaseDSN = &e
 	}
+	if e := os.Getenv("DATABASE_REPLICA_DSNS"); e != "" {
+		databaseReplicaDSNs = &e
+	}
+	var replicaDSNs []string
+	for _, dsn := range strings.Split(*databaseReplicaDSNs, ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			replicaDSNs = append(replicaDSNs, dsn)
+		}
+	}
+	if len(replicaDSNs) > 0 && *databaseDSN == "" {
+		return nil, fmt.Errorf("database replicas require primary database DSN")
+	}
 	if e := os.Getenv("ADDRESS"); e != "" {
 		serverListenAddr = &e
 	}
+	if e := os.Getenv("TLS_CERT_FILE"); e != "" {
+		tlsCertFile = &e
+	}
+	if e := os.Getenv("TLS_KEY_FILE"); e != "" {
+		tlsKeyFile = &e
+	}
+	if e := os.Getenv("TLS_CLIENT_CA_FILE"); e != "" {
+		tlsClientCAFile = &e
+	}
+	if e := os.Getenv("AUTH_TOKENS_FILE"); e != "" {
+		authTokensFile = &e
+	}
+	if e := os.Getenv("AUTH_DB"); e != "" {
+		v, err := strconv.ParseBool(e)
+		if err != nil {
+			log.Errorf("GetConfig: can not parse value of 'AUTH_DB' (%v) environment variable: %v", e, err)
+			return nil, fmt.Errorf("GetConfig: can not parse value of 'AUTH_DB' (%v) environment variable: %v", e, err)
+		}
+		authUseDatabase = &v
+	}
+	for env, value := range map[string]*int{
+		"MAX_METRICS":            maxMetrics,
+		"MAX_CLIENT_METRICS":     maxClientMetrics,
+		"MAX_NAME_LENGTH":        maxNameLength,
+		"AUDIT_MAX_SIZE":         auditMaxSize,
+		"AUDIT_MAX_BACKUPS":      auditMaxBackups,
+		"DB_MAX_CONNS":           dbMaxConns,
+		"DB_MIN_CONNS":           dbMinConns,
+		"DB_MAX_CONN_LIFETIME":   dbMaxConnLifetime,
+		"DB_MAX_CONN_IDLE_TIME":  dbMaxConnIdleTime,
+		"DB_HEALTH_CHECK_PERIOD": dbHealthCheckPeriod,
+		"CACHE_FLUSH_INTERVAL":   cacheFlushInterval,
+		"CACHE_FLUSH_SIZE":       cacheFlushSize,
+	} {
+		if e := os.Getenv(env); e != "" {
+			v, err := strconv.Atoi(e)
+			if err != nil {
+				log.Errorf("GetConfig: can not parse value of '%v' (%v) environment variable: %v", env, e, err)
+				return nil, fmt.Errorf("GetConfig: can not parse value of '%v' (%v) environment variable: %v", env, e, err)
+			}
+			*value = v
+		}
+	}
+	if *auditMaxSize < 0 || *auditMaxBackups < 0 {
+		return nil, fmt.Errorf("audit log size and backups count must be zero or greather")
+	}
+	if *dbMaxConns < 1 || *dbMinConns < 0 || *dbMinConns > *dbMaxConns {
+		return nil, fmt.Errorf("database pool size must be greather than zero and not less than minimum connections count")
+	}
+	if *dbMaxConnLifetime < 0 || *dbMaxConnIdleTime < 0 || *dbHealthCheckPeriod < 0 {
+		return nil, fmt.Errorf("database pool periods must be zero or greather")
+	}
+	if e := os.Getenv("CACHE"); e != "" {
+		v, err := strconv.ParseBool(e)
+		if err != nil {
+			log.Errorf("GetConfig: can not parse value of 'CACHE' (%v) environment variable: %v", e, err)
+			return nil, fmt.Errorf("GetConfig: can not parse value of 'CACHE' (%v) environment variable: %v", e, err)
+		}
+		cacheEnabled = &v
+	}
+	if *cacheFlushInterval < 1 || *cacheFlushSize < 0 {
+		return nil, fmt.Errorf("cache flush interval must be greather than zero and flush size must be zero or greather")
+	}
+	if e := os.Getenv("AUDIT_FILE"); e != "" {
+		auditFileName = &e
+	}
+	if e := os.Getenv("AUDIT_DB"); e != "" {
+		v, err := strconv.ParseBool(e)
+		if err != nil {
+			log.Errorf("GetConfig: can not parse value of 'AUDIT_DB' (%v) environment variable: %v", e, err)
+			return nil, fmt.Errorf("GetConfig: can not parse value of 'AUDIT_DB' (%v) environment variable: %v", e, err)
+		}
+		auditUseDatabase = &v
+	}
+	if *auditFileName != "" && *auditUseDatabase {
+		return nil, fmt.Errorf("audit file and database audit can not be used together")
+	}
+	if *maxMetrics < 0 || *maxClientMetrics < 0 || *maxNameLength < 0 {
+		return nil, fmt.Errorf("metrics limits must be zero or greather")
+	}
+	if e := os.Getenv("METRIC_NAME_PATTERN"); e != "" {
+		namePattern = &e
+	}
+	if _, err := regexp.Compile(*namePattern); err != nil {
+		return nil, fmt.Errorf("incorrect metric name pattern: %v", err)
+	}
+	if e := os.Getenv("RATE_LIMIT_RPS"); e != "" {
+		v, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Errorf("GetConfig: can not parse value of 'RATE_LIMIT_RPS' (%v) environment variable: %v", e, err)
+			return nil, fmt.Errorf("GetConfig: can not parse value of 'RATE_LIMIT_RPS' (%v) environment variable: %v", e, err)
+		}
+		rateLimitRPS = &v
+	}
+	if e := os.Getenv("RATE_LIMIT_MPS"); e != "" {
+		v, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Errorf("GetConfig: can not parse value of 'RATE_LIMIT_MPS' (%v) environment variable: %v", e, err)
+			return nil, fmt.Errorf("GetConfig: can not parse value of 'RATE_LIMIT_MPS' (%v) environment variable: %v", e, err)
+		}
+		rateLimitMPS = &v
+	}
+	if e := os.Getenv("RATE_LIMIT_KEY"); e != "" {
+		rateLimitKey = &e
+	}
+	if *rateLimitRPS < 0 || *rateLimitMPS < 0 {
+		return nil, fmt.Errorf("rate limits must be zero or greather")
+	}
+	if *rateLimitKey != "ip" && *rateLimitKey != "token" {
+		return nil, fmt.Errorf("unknown rate limit key '%v'. Should be 'ip' or 'token'", *rateLimitKey)
+	}
+	if *authTokensFile != "" && *authUseDatabase {
+		return nil, fmt.Errorf("tokens file and database tokens can not be used together")
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return nil, fmt.Errorf("TLS certificate and key must be specified together")
+	}
+	if *tlsClientCAFile != "" && *tlsCertFile == "" {
+		return nil, fmt.Errorf("client certificate verification requires TLS certificate and key")
+	}
 	if e := os.Getenv("STORE_INTERVAL"); e != "" {
 		v, err := strconv.Atoi(e)
 		if err != nil {
@@ -101,29 +396,112 @@ func GetConfig() (*Config, error) {
 		}
 		fileStorageStartupRestore = &v
 	}
+	if e := os.Getenv("SQLITE_PATH"); e != "" {
+		sqliteFileName = &e
+	}
+	if e := os.Getenv("REDIS_URL"); e != "" {
+		redisURL = &e
+	}
+	if e := os.Getenv("REDIS_PREFIX"); e != "" {
+		redisPrefix = &e
+	}
+	if e := os.Getenv("FSYNC"); e != "" {
+		fileStorageFsync = &e
+	}
+	switch *fileStorageFsync {
+	case "":
+		if *metricsStoreInterval == 0 {
+			*fileStorageFsync = "always"
+		} else {
+			*fileStorageFsync = "interval"
+		}
+	case "always", "interval", "never":
+	default:
+		return nil, fmt.Errorf("unknown fsync policy '%v'", *fileStorageFsync)
+	}
 	s := storage.MemoryStorage
 	if databaseDSN != nil && *databaseDSN != "" {
 		s = storage.PostgresStorage
+	} else if *redisURL != "" {
+		s = storage.RedisStorage
+	} else if *sqliteFileName != "" {
+		s = storage.SQLiteStorage
 	} else if fileStorageFileName != nil && *fileStorageFileName != "" {
 		s = storage.FileStorage
 	}
+	var secondaries []SecondaryStorageConfig
+	if e := os.Getenv("STORAGES"); e != "" {
+		storages = &e
+	}
+	if *storages != "" {
+		primary, list, err := parseStorages(*storages)
+		if err != nil {
+			return nil, err
+		}
+		s, secondaries = primary, list
+		for _, t := range append([]storage.SType{s}, typesOf(secondaries)...) {
+			if (t == storage.PostgresStorage && *databaseDSN == "") || (t == storage.RedisStorage && *redisURL == "") ||
+				(t == storage.SQLiteStorage && *sqliteFileName == "") || (t == storage.FileStorage && *fileStorageFileName == "") {
+				return nil, fmt.Errorf("storage '%v' is not configured", t)
+			}
+		}
+	}
+	usePostgres := s == storage.PostgresStorage || slices.Contains(typesOf(secondaries), storage.PostgresStorage)
+	if *authUseDatabase && !usePostgres {
+		return nil, fmt.Errorf("database tokens require database storage")
+	}
+	if *auditUseDatabase && !usePostgres {
+		return nil, fmt.Errorf("database audit requires database storage")
+	}
+	if *cacheEnabled && (s == storage.MemoryStorage || s == storage.FileStorage) {
+		return nil, fmt.Errorf("cache requires database storage")
+	}
 	return &Config{
-		Storage:  s,
-		LogLevel: *logLevel,
+		Command:     flag.Args(),
+		Storage:     s,
+		Secondaries: secondaries,
+		LogLevel:    *logLevel,
 		Server: ServerConfig{
-			ListenAddr: *serverListenAddr,
+			ListenAddr:      *serverListenAddr,
+			TLSCertFile:     *tlsCertFile,
+			TLSKeyFile:      *tlsKeyFile,
+			TLSClientCAFile: *tlsClientCAFile,
 		},
 		Metrics: MetricsConfig{
-			StoreInterval:  *metricsStoreInterval,
-			StartupRestore: *fileStorageStartupRestore,
+			StoreInterval:       *metricsStoreInterval,
+			StartupRestore:      *fileStorageStartupRestore,
+			MaxMetrics:          *maxMetrics,
+			MaxMetricsPerClient: *maxClientMetrics,
+			MaxNameLength:       *maxNameLength,
+			NamePattern:         *namePattern,
 		},
 		FileStorage: FileStorageConfig{
 			FileName: *fileStorageFileName,
+			Fsync:    *fileStorageFsync,
 		},
 		PostgresStorage: PostgresConfig{
-			DSN:           *databaseDSN,
-			Type:          "postgres",
-			MigrationsDir: migrationsDir,
+			DSN:               *databaseDSN,
+			ReplicaDSNs:       replicaDSNs,
+			Type:              "postgres",
+			MigrationsDir:     migrationsDir,
+			MaxConns:          *dbMaxConns,
+			MinConns:          *dbMinConns,
+			MaxConnLifetime:   *dbMaxConnLifetime,
+			MaxConnIdleTime:   *dbMaxConnIdleTime,
+			HealthCheckPeriod: *dbHealthCheckPeriod,
+		},
+		SQLiteStorage: SQLiteConfig{
+			FileName:      *sqliteFileName,
+			MigrationsDir: sqliteMigrationsDir,
+		},
+		RedisStorage: RedisConfig{
+			URL:    *redisURL,
+			Prefix: *redisPrefix,
+		},
+		Cache: CacheConfig{
+			Enabled:       *cacheEnabled,
+			FlushInterval: *cacheFlushInterval,
+			FlushSize:     *cacheFlushSize,
 		},
 		RetryConfig: RetryConfig{
 			RetryAttempts: retryAttempts,
@@ -132,5 +510,28 @@ func GetConfig() (*Config, error) {
 		CryptConfig: CryptConfig{
 			Key: *cryptKey,
 		},
+		AuthConfig: AuthConfig{
+			TokensFile:  *authTokensFile,
+			UseDatabase: *authUseDatabase,
+		},
+		Audit: AuditConfig{
+			FileName:    *auditFileName,
+			MaxSizeMB:   *auditMaxSize,
+			MaxBackups:  *auditMaxBackups,
+			UseDatabase: *auditUseDatabase,
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerSecond: *rateLimitRPS,
+			MetricsPerSecond:  *rateLimitMPS,
+			Key:               *rateLimitKey,
+		},
 	}, nil
 }
+
+func typesOf(secondaries []SecondaryStorageConfig) []storage.SType {
+	var types []storage.SType
+	for _, s := range secondaries {
+		types = append(types, s.Type)
+	}
+	return types
+}
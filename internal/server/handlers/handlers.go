@@ -7,7 +7,12 @@ import (
 	"fmt"
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
 	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/audit"
+	"github.com/aksenk/go-yandex-metrics/internal/server/auth"
 	"github.com/aksenk/go-yandex-metrics/internal/server/compress"
+	"github.com/aksenk/go-yandex-metrics/internal/server/policy"
+	"github.com/aksenk/go-yandex-metrics/internal/server/ratelimit"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
 	"github.com/aksenk/go-yandex-metrics/internal/signature"
 	"github.com/go-chi/chi/v5"
@@ -16,38 +21,93 @@ import (
 	"io"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 )
 
-func NewRouter(s storage.Storager, log *zap.SugaredLogger, cryptKey string) chi.Router {
+// RouterOptions необязательные зависимости роутера. Пустое значение отключает соответствующий функционал
+type RouterOptions struct {
+	CryptKey string
+	Tokens   auth.TokenStore
+	Limiter  *ratelimit.Limiter
+	Policy   *policy.Policy
+	Stats    *stats.Registry
+	Auditor  *audit.Auditor
+}
+
+// ReadPrimaryHeader заголовок запроса, при значении true метрики читаются с основной базы, а не с реплики
+const ReadPrimaryHeader = "X-Read-Primary"
+
+// readPrimary помечает контекст запроса для чтения с основной базы (storage.WithPrimary).
+// Если always, то помечаются все запросы: обновления должны видеть последние записанные значения
+func readPrimary(always bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if force, _ := strconv.ParseBool(r.Header.Get(ReadPrimaryHeader)); always || force {
+				r = r.WithContext(storage.WithPrimary(r.Context()))
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+func NewRouter(s storage.Storager, log *zap.SugaredLogger, opts RouterOptions) chi.Router {
 	r := chi.NewRouter()
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
 	r.Use(logger.Middleware(log))
 	//r.Use(middleware.Timeout(time.Second * 10))
 	r.Use(compress.Middleware)
-	if cryptKey != "" {
-		r.Use(signature.Middleware(cryptKey, log))
+	if opts.CryptKey != "" {
+		r.Use(signature.Middleware(opts.CryptKey, log))
 	}
-	r.Get("/", ListAllMetrics(s))
 	r.Get("/ping", Ping(s))
-	// TODO почему-то в ответе дублируется текст "Allow: POST" например при запросе GET /update/
-	r.Route("/value", func(r chi.Router) {
-		r.Post("/", JSONGetMetricHandler(s))
-		r.Get("/", PlainGetMetricHandler(s))
-		r.Get("/{type}/", PlainGetMetricHandler(s))
-		r.Get("/{type}/{name}", PlainGetMetricHandler(s))
+	r.Group(func(r chi.Router) {
+		r.Use(ratelimit.IPMiddleware(opts.Limiter, log))
+		r.Use(auth.Middleware(opts.Tokens, auth.ScopeRead, log))
+		r.Use(ratelimit.Middleware(opts.Limiter, log))
+		r.Use(readPrimary(false))
+		r.Get("/", ListAllMetrics(s))
+		if opts.Stats != nil {
+			r.Get("/stats", Stats(opts.Stats))
+		}
+		// TODO почему-то в ответе дублируется текст "Allow: POST" например при запросе GET /update/
+		r.Route("/value", func(r chi.Router) {
+			r.Post("/", JSONGetMetricHandler(s))
+			r.Get("/", PlainGetMetricHandler(s))
+			r.Get("/{type}/", PlainGetMetricHandler(s))
+			r.Get("/{type}/{name}", PlainGetMetricHandler(s))
+		})
+		r.Get("/value/{type}/{name}", PlainGetMetricHandler(s))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(ratelimit.IPMiddleware(opts.Limiter, log))
+		r.Use(auth.Middleware(opts.Tokens, auth.ScopeWrite, log))
+		r.Use(ratelimit.Middleware(opts.Limiter, log))
+		r.Use(audit.Middleware)
+		r.Use(readPrimary(true))
+		r.Post("/updates/", JSONBatchUpdaterHandler(s, opts.Policy, opts.Auditor))
+		// TODO вынести работу со storage в middleware?
+		r.Route("/update", func(r chi.Router) {
+			r.Post("/", JSONUpdaterHandler(s, opts.Policy, opts.Auditor))
+			// TODO вернуть
+			r.Post("/{type}/", PlainUpdaterHandler(s, opts.Policy, opts.Auditor))
+			r.Post("/{type}/{name}/", PlainUpdaterHandler(s, opts.Policy, opts.Auditor))
+			r.Post("/{type}/{name}/{value}", PlainUpdaterHandler(s, opts.Policy, opts.Auditor))
+		})
 	})
-	r.Post("/updates/", JSONBatchUpdaterHandler(s))
-	// TODO вынести работу со storage в middleware?
-	r.Route("/update", func(r chi.Router) {
-		r.Post("/", JSONUpdaterHandler(s))
-		// TODO вернуть
-		r.Post("/{type}/", PlainUpdaterHandler(s))
-		r.Post("/{type}/{name}/", PlainUpdaterHandler(s))
-		r.Post("/{type}/{name}/{value}", PlainUpdaterHandler(s))
+	r.Group(func(r chi.Router) {
+		r.Use(ratelimit.IPMiddleware(opts.Limiter, log))
+		r.Use(auth.Middleware(opts.Tokens, auth.ScopeAdmin, log))
+		r.Use(ratelimit.Middleware(opts.Limiter, log))
+		r.Use(readPrimary(true))
+		if opts.Auditor != nil {
+			r.Get("/audit", AuditQueryHandler(opts.Auditor))
+		}
+		r.Get("/admin/snapshot", ExportSnapshotHandler(s))
+		r.With(audit.Middleware).Post("/admin/snapshot", ImportSnapshotHandler(s, opts.Policy, opts.Auditor))
 	})
-	r.Get("/value/{type}/{name}", PlainGetMetricHandler(s))
 	return r
 }
 
@@ -63,6 +123,92 @@ func Ping(storage storage.Storager) http.HandlerFunc {
 	}
 }
 
+// AuditQueryHandler отдает последние записи аудит лога. Параметры: metric, client, limit
+func AuditQueryHandler(auditor *audit.Auditor) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+
+		log, err := logger.FromContext(ctx)
+		if err != nil {
+			http.Error(writer, "internal logger error", http.StatusInternalServerError)
+			return
+		}
+
+		filter := audit.Filter{
+			MetricID: request.URL.Query().Get("metric"),
+			Client:   request.URL.Query().Get("client"),
+		}
+		if limit := request.URL.Query().Get("limit"); limit != "" {
+			filter.Limit, err = strconv.Atoi(limit)
+			if err != nil || filter.Limit < 0 {
+				http.Error(writer, "Parameter 'limit' must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := auditor.Query(ctx, filter)
+		if err != nil {
+			log.Errorf("Error querying audit log: %v", err)
+			http.Error(writer, fmt.Sprintf("Error querying audit log: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+
+		body, err := json.Marshal(entries)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Error querying audit log: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(body)
+	}
+}
+
+func Stats(registry *stats.Registry) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		body, err := json.Marshal(registry.Snapshot())
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Error getting stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(body)
+	}
+}
+
+// admitMetrics проверяет лимиты кардинальности и при превышении сам отвечает клиенту.
+// Допущенные метрики нужно подтвердить после записи (Commit) или освободить при ошибке (Release)
+func admitMetrics(res http.ResponseWriter, req *http.Request, log *zap.SugaredLogger, p *policy.Policy, names []string) (*policy.Admission, bool) {
+	admission, err := p.Admit(req.Context(), auth.ClientKey(req), names)
+	if err == nil {
+		return admission, true
+	}
+	log.Errorf("Metrics are rejected: %v", err)
+	if errors.Is(err, policy.ErrTooManyMetrics) || errors.Is(err, policy.ErrClientLimitExceed) {
+		http.Error(res, fmt.Sprintf("Metrics are rejected: %v", err), http.StatusUnprocessableEntity)
+	} else {
+		http.Error(res, fmt.Sprintf("Error checking metrics limits: %v", err), http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+// updateFailed отвечает клиенту на ошибку записи метрик. Если метрики уже попали в основное хранилище
+// (storage.ErrPartiallySaved), они остаются в лимитах, а клиент получает 409, чтобы не повторять запрос
+func updateFailed(res http.ResponseWriter, log *zap.SugaredLogger, admission *policy.Admission, err error) {
+	log.Errorf("Error updating metric: %v", err)
+	if errors.Is(err, storage.ErrPartiallySaved) {
+		admission.Commit()
+		http.Error(res, fmt.Sprintf("Error updating metric: %v", err), http.StatusConflict)
+		return
+	}
+	admission.Release()
+	http.Error(res, fmt.Sprintf("Error updating metric: %v", err), http.StatusInternalServerError)
+}
+
 func ListAllMetrics(storage storage.Storager) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		var list []string
@@ -231,68 +377,132 @@ func JSONGetMetricHandler(storage storage.Storager) http.HandlerFunc {
 	}
 }
 
+// currentMetric возвращает сохраненную метрику или nil, если ее еще нет
+func currentMetric(ctx context.Context, name string, s storage.Storager) (*models.Metric, error) {
+	metric, err := s.GetMetric(ctx, name)
+	if errors.Is(err, storage.ErrMetricNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// postgres storage при отсутствии метрики возвращает пустую метрику без ошибки
+	if metric.ID == "" {
+		return nil, nil
+	}
+	return metric, nil
+}
+
+// applyMetric рассчитывает новое значение: counter прибавляется к текущему значению, остальное его заменяет
+func applyMetric(metric models.Metric, current *models.Metric) models.Metric {
+	if metric.MType == "counter" && current != nil && current.MType == "counter" {
+		delta := *metric.Delta + *current.Delta
+		metric.Delta = &delta
+	}
+	return metric
+}
+
 func CalculateCounter(ctx context.Context, metric models.Metric, s storage.Storager) (models.Metric, error) {
-	newMetric := metric
-	currentMetric, err := s.GetMetric(ctx, metric.ID)
-	if err == nil || errors.Is(err, storage.ErrMetricNotExist) {
-		if currentMetric.MType == "counter" {
-			*newMetric.Delta = *newMetric.Delta + *currentMetric.Delta
+	current, err := currentMetric(ctx, metric.ID, s)
+	if err != nil {
+		return metric, err
+	}
+	return applyMetric(metric, current), nil
+}
+
+// incrementMetrics сохраняет метрики в хранилище, которое само атомарно прибавляет counter (storage.Incrementer).
+// Предыдущие значения читаются только для аудит лога
+func incrementMetrics(ctx context.Context, metrics []models.Metric, s storage.Storager, inc storage.Incrementer, auditor *audit.Auditor) ([]models.Metric, error) {
+	var changes []audit.Change
+	if auditor.Enabled() {
+		for _, metric := range metrics {
+			current, err := currentMetric(ctx, metric.ID, s)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, audit.Change{Old: current})
 		}
-		return newMetric, nil
 	}
-	return newMetric, err
+	newMetrics, err := inc.IncrementMetrics(ctx, metrics)
+	if err != nil {
+		return nil, err
+	}
+	for i := range changes {
+		changes[i].New = newMetrics[i]
+	}
+	auditor.Record(ctx, changes)
+	return newMetrics, nil
 }
 
-func UpdateMetric(ctx context.Context, metric models.Metric, storage storage.Storager) (models.Metric, error) {
-	newMetric := metric
+func UpdateMetric(ctx context.Context, metric models.Metric, s storage.Storager, auditor *audit.Auditor) (models.Metric, error) {
+	if inc, ok := s.(storage.Incrementer); ok {
+		newMetrics, err := incrementMetrics(ctx, []models.Metric{metric}, s, inc, auditor)
+		if err != nil {
+			return metric, err
+		}
+		return newMetrics[0], nil
+	}
+	var current *models.Metric
 	var err error
-	if metric.MType == "counter" {
-		newMetric, err = CalculateCounter(ctx, metric, storage)
+	// для gauge текущее значение нужно только для аудит лога
+	if metric.MType == "counter" || auditor.Enabled() {
+		current, err = currentMetric(ctx, metric.ID, s)
 		if err != nil {
-			return newMetric, err
+			return metric, err
 		}
 	}
-	return newMetric, storage.SaveMetric(ctx, metric)
+	newMetric := applyMetric(metric, current)
+	if err = s.SaveMetric(ctx, newMetric); err != nil {
+		return newMetric, err
+	}
+	auditor.Record(ctx, []audit.Change{{Old: current, New: newMetric}})
+	return newMetric, nil
 }
 
-func UpdateBatchMetrics(ctx context.Context, metrics []models.Metric, storage storage.Storager) ([]models.Metric, error) {
+func UpdateBatchMetrics(ctx context.Context, metrics []models.Metric, s storage.Storager, auditor *audit.Auditor) ([]models.Metric, error) {
+	inc, incremental := s.(storage.Incrementer)
 	var newMetrics []models.Metric
-	var err error
-OuterLoop:
+	var changes []audit.Change
+	index := make(map[string]int)
 	for _, metric := range metrics {
-		isExist := false
-		newMetric := metric
-		for _, m := range newMetrics {
-			// если метрика уже встречалась в батче
-			if m.ID == newMetric.ID {
-				isExist = true
-				if m.MType == "counter" {
-					// если это counter, то суммируем с предыдущим значением, которое было в метрике из этого же батча
-					*m.Delta += *newMetric.Delta
-				} else {
-					// если это gauge, то заменяем его значение на новое из этого же батча
-					*m.Value = *newMetric.Value
-				}
-				continue OuterLoop
-			}
-		}
-		// если метрика еще не встречалась в батче, то рассчитываем ее значение (для counter) и сохраняем в список
-		if !isExist {
-			newMetric, err = CalculateCounter(ctx, metric, storage)
+		// если метрика уже встречалась в батче, то counter суммируем с предыдущим значением из этого же батча,
+		// а gauge заменяем новым значением
+		if i, ok := index[metric.ID]; ok {
+			prev := newMetrics[i]
+			newMetrics[i] = applyMetric(metric, &prev)
+			changes[i].New = newMetrics[i]
+			continue
+		}
+		// если метрика еще не встречалась в батче, то рассчитываем ее значение (для counter) и сохраняем в список.
+		// Хранилище с атомарным инкрементом прибавит counter само
+		var current *models.Metric
+		var err error
+		if !incremental && (metric.MType == "counter" || auditor.Enabled()) {
+			current, err = currentMetric(ctx, metric.ID, s)
 			if err != nil {
 				return nil, fmt.Errorf("error calculating counter: %w", err)
 			}
-			newMetrics = append(newMetrics, newMetric)
 		}
+		newMetric := applyMetric(metric, current)
+		index[metric.ID] = len(newMetrics)
+		newMetrics = append(newMetrics, newMetric)
+		changes = append(changes, audit.Change{Old: current, New: newMetric})
 	}
-	err = storage.SaveBatchMetrics(ctx, newMetrics)
-	if err != nil {
+	if incremental {
+		result, err := incrementMetrics(ctx, newMetrics, s, inc, auditor)
+		if err != nil {
+			return nil, fmt.Errorf("error saving metrics: %w", err)
+		}
+		return result, nil
+	}
+	if err := s.SaveBatchMetrics(ctx, newMetrics); err != nil {
 		return nil, fmt.Errorf("error saving metrics: %w", err)
 	}
+	auditor.Record(ctx, changes)
 	return newMetrics, nil
 }
 
-func PlainUpdaterHandler(storage storage.Storager) http.HandlerFunc {
+func PlainUpdaterHandler(storage storage.Storager, p *policy.Policy, auditor *audit.Auditor) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 
@@ -331,19 +541,36 @@ func PlainUpdaterHandler(storage storage.Storager) http.HandlerFunc {
 			return
 		}
 
-		newMetric, err := UpdateMetric(ctx, metric, storage)
+		if err = p.CheckName(metric.ID); err != nil {
+			log.Errorf("Metric '%v' is incorrect: %v", metric.ID, err)
+			http.Error(res, fmt.Sprintf("Metric '%v' is incorrect: %v", metric.ID, err), http.StatusBadRequest)
+			return
+		}
+
+		if ok, wait := ratelimit.AllowMetrics(ctx, 1); !ok {
+			log.Errorf("Metrics rate limit exceeded")
+			ratelimit.TooManyRequests(res, wait, "Metrics rate limit exceeded")
+			return
+		}
+
+		admission, ok := admitMetrics(res, req, log, p, []string{metric.ID})
+		if !ok {
+			return
+		}
+
+		newMetric, err := UpdateMetric(ctx, metric, storage, auditor)
 		if err != nil {
-			log.Errorf("Error updating metric: %v", err)
-			http.Error(res, fmt.Sprintf("Error updating metric: %v", err), http.StatusInternalServerError)
+			updateFailed(res, log, admission, err)
 			return
 		}
+		admission.Commit()
 
 		res.Write([]byte(fmt.Sprintf("Updated metric: %+v", newMetric)))
 		res.WriteHeader(http.StatusOK)
 	}
 }
 
-func JSONUpdaterHandler(storage storage.Storager) http.HandlerFunc {
+func JSONUpdaterHandler(storage storage.Storager, p *policy.Policy, auditor *audit.Auditor) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 
@@ -398,12 +625,29 @@ func JSONUpdaterHandler(storage storage.Storager) http.HandlerFunc {
 			return
 		}
 
-		newMetric, err := UpdateMetric(ctx, receivedMetric, storage)
+		if err = p.CheckName(receivedMetric.ID); err != nil {
+			log.Errorf("Metric '%v' is incorrect: %v", receivedMetric.ID, err)
+			http.Error(res, fmt.Sprintf("Metric '%v' is incorrect: %v", receivedMetric.ID, err), http.StatusBadRequest)
+			return
+		}
+
+		if ok, wait := ratelimit.AllowMetrics(ctx, 1); !ok {
+			log.Errorf("Metrics rate limit exceeded")
+			ratelimit.TooManyRequests(res, wait, "Metrics rate limit exceeded")
+			return
+		}
+
+		admission, ok := admitMetrics(res, req, log, p, []string{receivedMetric.ID})
+		if !ok {
+			return
+		}
+
+		newMetric, err := UpdateMetric(ctx, receivedMetric, storage, auditor)
 		if err != nil {
-			log.Errorf("Error updating metric: %v", err)
-			http.Error(res, fmt.Sprintf("Error updating metric: %v", err), http.StatusInternalServerError)
+			updateFailed(res, log, admission, err)
 			return
 		}
+		admission.Commit()
 
 		newJSONMetric, err := json.Marshal(newMetric)
 		if err != nil {
@@ -418,10 +662,13 @@ func JSONUpdaterHandler(storage storage.Storager) http.HandlerFunc {
 	}
 }
 
-func checkMetricIsCorrect(metric models.Metric) error {
+func checkMetricIsCorrect(metric models.Metric, p *policy.Policy) error {
 	if metric.ID == "" {
 		return fmt.Errorf("field 'id' is required")
 	}
+	if err := p.CheckName(metric.ID); err != nil {
+		return err
+	}
 	if metric.MType == "counter" {
 		if metric.Value != nil {
 			return fmt.Errorf("value field is not allowed for counter metrics")
@@ -436,7 +683,7 @@ func checkMetricIsCorrect(metric models.Metric) error {
 	return nil
 }
 
-func JSONBatchUpdaterHandler(storage storage.Storager) http.HandlerFunc {
+func JSONBatchUpdaterHandler(storage storage.Storager, p *policy.Policy, auditor *audit.Auditor) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 
@@ -467,20 +714,33 @@ func JSONBatchUpdaterHandler(storage storage.Storager) http.HandlerFunc {
 			return
 		}
 
+		names := make([]string, 0, len(receivedMetric))
 		for _, m := range receivedMetric {
-			if err = checkMetricIsCorrect(m); err != nil {
+			names = append(names, m.ID)
+			if err = checkMetricIsCorrect(m, p); err != nil {
 				log.Errorf("Metric '%v' is incorrect: %v", m.ID, err)
 				http.Error(res, fmt.Sprintf("Metric '%v' is incorrect: %v", m.ID, err), http.StatusBadRequest)
 				return
 			}
 		}
 
-		newMetrics, err := UpdateBatchMetrics(ctx, receivedMetric, storage)
+		if ok, wait := ratelimit.AllowMetrics(ctx, len(receivedMetric)); !ok {
+			log.Errorf("Metrics rate limit exceeded")
+			ratelimit.TooManyRequests(res, wait, "Metrics rate limit exceeded")
+			return
+		}
+
+		admission, ok := admitMetrics(res, req, log, p, names)
+		if !ok {
+			return
+		}
+
+		newMetrics, err := UpdateBatchMetrics(ctx, receivedMetric, storage, auditor)
 		if err != nil {
-			log.Errorf("Error updating metric: %v", err)
-			http.Error(res, fmt.Sprintf("Error updating metric: %v", err), http.StatusInternalServerError)
+			updateFailed(res, log, admission, err)
 			return
 		}
+		admission.Commit()
 
 		newMetricsJSON, err := json.Marshal(newMetrics)
 		if err != nil {
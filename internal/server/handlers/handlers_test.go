@@ -2,19 +2,29 @@ package handlers
 
 import (
 	"context"
-	"github.com/DATA-DOG/go-sqlmock"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
 	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/audit"
+	"github.com/aksenk/go-yandex-metrics/internal/server/auth"
 	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/policy"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage/filestorage"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage/postgres"
+	"github.com/pashagolub/pgxmock/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -150,7 +160,7 @@ func TestUpdateMetric(t *testing.T) {
 	for _, tt := range tests {
 		storage := &MemStorageDummy{}
 		t.Run(tt.name, func(t *testing.T) {
-			handler := NewRouter(storage, log, "")
+			handler := NewRouter(storage, log, RouterOptions{})
 			server := httptest.NewServer(handler)
 			request, err := http.NewRequest(tt.args.method, server.URL+tt.args.path, nil)
 			require.NoError(t, err)
@@ -280,7 +290,7 @@ func TestGetMetric(t *testing.T) {
 			storage := &memstorage.MemStorage{
 				Metrics: storageMetrics,
 			}
-			server := httptest.NewServer(NewRouter(storage, log, ""))
+			server := httptest.NewServer(NewRouter(storage, log, RouterOptions{}))
 			response, err := server.Client().Get(server.URL + tt.requestURL)
 			require.NoError(t, err)
 			body, err := io.ReadAll(response.Body)
@@ -377,6 +387,7 @@ func TestPing(t *testing.T) {
 		storage, err := filestorage.NewFileStorage(fileName, false, logger)
 		require.NoError(t, err)
 		defer os.RemoveAll(fileName)
+		defer os.RemoveAll(fileName + ".wal")
 
 		server := httptest.NewServer(Ping(storage))
 		response, err := server.Client().Get(server.URL + "/ping")
@@ -387,10 +398,9 @@ func TestPing(t *testing.T) {
 	})
 
 	t.Run("with working postgres storage", func(t *testing.T) {
-		db, _, err := sqlmock.New()
-		require.NoError(t, err)
-
+		db, err := pgxmock.NewPool()
 		require.NoError(t, err)
+		db.ExpectPing()
 
 		cfg := config.Config{
 			Storage: "postgres",
@@ -435,3 +445,251 @@ func TestPing(t *testing.T) {
 		assert.Equal(t, 500, response.StatusCode)
 	})
 }
+
+type tokenStoreDummy map[string]auth.Token
+
+func (d tokenStoreDummy) LookupToken(ctx context.Context, hash string) (*auth.Token, error) {
+	if t, ok := d[hash]; ok {
+		return &t, nil
+	}
+	return nil, auth.ErrTokenNotFound
+}
+
+func TestRouterAuthentication(t *testing.T) {
+	tokens := tokenStoreDummy{
+		auth.HashToken("reader"): {ID: "reader", Scopes: []auth.Scope{auth.ScopeRead}},
+		auth.HashToken("writer"): {ID: "writer", Scopes: []auth.Scope{auth.ScopeWrite}},
+	}
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		wantCode int
+	}{
+		{name: "ping without token", method: "GET", path: "/ping", token: "", wantCode: 200},
+		{name: "list without token", method: "GET", path: "/", token: "", wantCode: 401},
+		{name: "list with read token", method: "GET", path: "/", token: "reader", wantCode: 200},
+		{name: "value with write token", method: "GET", path: "/value/gauge/name", token: "writer", wantCode: 403},
+		{name: "update with read token", method: "POST", path: "/update/gauge/name/1", token: "reader", wantCode: 403},
+		{name: "update with write token", method: "POST", path: "/update/gauge/name/1", token: "writer", wantCode: 200},
+	}
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	server := httptest.NewServer(NewRouter(memstorage.NewMemStorage(log), log, RouterOptions{Tokens: tokens}))
+	defer server.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			require.NoError(t, err)
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			result, err := server.Client().Do(request)
+			require.NoError(t, err)
+			result.Body.Close()
+			assert.Equal(t, tt.wantCode, result.StatusCode)
+		})
+	}
+}
+
+func TestRouterMetricsPolicy(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	s := memstorage.NewMemStorage(log)
+	registry := stats.NewRegistry()
+	p := policy.New(policy.Config{MaxMetrics: 1, NamePattern: regexp.MustCompile(`^[a-z]+$`)}, s, registry)
+	server := httptest.NewServer(NewRouter(s, log, RouterOptions{Policy: p, Stats: registry}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{name: "name does not match pattern", path: "/update/gauge/Name1/1", wantCode: 400},
+		{name: "first metric", path: "/update/gauge/first/1", wantCode: 200},
+		{name: "existing metric", path: "/update/gauge/first/2", wantCode: 200},
+		{name: "too many metrics", path: "/update/gauge/second/1", wantCode: 422},
+		{name: "batch with incorrect name", path: "/updates/", body: `[{"id":"first","type":"gauge","value":1},{"id":"BAD","type":"gauge","value":1}]`, wantCode: 400},
+		{name: "batch with too many metrics", path: "/updates/", body: `[{"id":"first","type":"gauge","value":1},{"id":"third","type":"gauge","value":1}]`, wantCode: 422},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := server.Client().Post(server.URL+tt.path, "application/json", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			response.Body.Close()
+			assert.Equal(t, tt.wantCode, response.StatusCode)
+		})
+	}
+
+	response, err := server.Client().Get(server.URL + "/stats")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	var gotStats map[string]float64
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&gotStats))
+	assert.EqualValues(t, 2, gotStats["policy_rejected_name_pattern"])
+	assert.EqualValues(t, 2, gotStats["policy_rejected_max_metrics"])
+}
+
+func TestRouterAudit(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	sink, err := audit.NewFileSink(t.TempDir()+"/audit.log", 0, 0)
+	require.NoError(t, err)
+	auditor := audit.NewAuditor(sink, log, nil)
+	defer auditor.Close()
+
+	server := httptest.NewServer(NewRouter(memstorage.NewMemStorage(log), log, RouterOptions{Auditor: auditor}))
+	defer server.Close()
+
+	for _, body := range []string{
+		`[{"id":"c","type":"counter","delta":2},{"id":"g","type":"gauge","value":1}]`,
+		`[{"id":"c","type":"counter","delta":3},{"id":"c","type":"counter","delta":1}]`,
+	} {
+		response, err := server.Client().Post(server.URL+"/updates/", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		response.Body.Close()
+		require.Equal(t, 200, response.StatusCode)
+	}
+
+	response, err := server.Client().Get(server.URL + "/audit?metric=c")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, 200, response.StatusCode)
+
+	var entries []audit.Entry
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&entries))
+	require.Len(t, entries, 2)
+	require.NotNil(t, entries[0].OldValue)
+	assert.Equal(t, "2", *entries[0].OldValue)
+	assert.Equal(t, "6", entries[0].NewValue)
+	assert.Nil(t, entries[1].OldValue)
+	assert.Equal(t, "2", entries[1].NewValue)
+	assert.Equal(t, "127.0.0.1", entries[1].ClientIP)
+}
+
+// incrementerDummy memstorage, который сам прибавляет counter и запрещает чтение текущих значений
+type incrementerDummy struct {
+	*memstorage.MemStorage
+}
+
+func (s incrementerDummy) GetMetric(ctx context.Context, name string) (*models.Metric, error) {
+	panic("GetMetric must not be called for incrementer storage")
+}
+
+func (s incrementerDummy) IncrementMetrics(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
+	var result []models.Metric
+	for _, m := range metrics {
+		if current, ok := s.Metrics[m.ID]; ok && m.MType == "counter" && current.MType == "counter" {
+			delta := *m.Delta + *current.Delta
+			m.Delta = &delta
+		}
+		s.Metrics[m.ID] = m
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+func TestUpdateBatchMetricsIncrementer(t *testing.T) {
+	s := incrementerDummy{&memstorage.MemStorage{Metrics: map[string]models.Metric{}}}
+	first, err := models.NewMetric("test_counter", "counter", 3)
+	require.NoError(t, err)
+	_, err = UpdateMetric(context.TODO(), first, s, nil)
+	require.NoError(t, err)
+
+	second, err := models.NewMetric("test_counter", "counter", 2)
+	require.NoError(t, err)
+	gauge, err := models.NewMetric("test_gauge", "gauge", 1.5)
+	require.NoError(t, err)
+	result, err := UpdateBatchMetrics(context.TODO(), []models.Metric{second, gauge, second}, s, nil)
+	require.NoError(t, err)
+	require.Len(t, result, 2)
+	assert.EqualValues(t, 7, *result[0].Delta)
+	assert.Equal(t, gauge, result[1])
+	assert.EqualValues(t, 7, *s.Metrics["test_counter"].Delta)
+}
+
+// primaryReadsDummy memstorage, который запоминает, с какой базы запрошено чтение
+type primaryReadsDummy struct {
+	*memstorage.MemStorage
+	primary []bool
+}
+
+func (s *primaryReadsDummy) GetMetric(ctx context.Context, name string) (*models.Metric, error) {
+	s.primary = append(s.primary, storage.ReadFromPrimary(ctx))
+	return s.MemStorage.GetMetric(ctx, name)
+}
+
+func TestRouterReadPrimary(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		header      string
+		wantPrimary bool
+	}{
+		{name: "read without header", method: "GET", path: "/value/gauge/test", wantPrimary: false},
+		{name: "read with header", method: "GET", path: "/value/gauge/test", header: "true", wantPrimary: true},
+		{name: "read with disabled header", method: "GET", path: "/value/gauge/test", header: "false", wantPrimary: false},
+		{name: "update without header", method: "POST", path: "/update/counter/test/1", wantPrimary: true},
+	}
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &primaryReadsDummy{MemStorage: memstorage.NewMemStorage(log)}
+			server := httptest.NewServer(NewRouter(s, log, RouterOptions{}))
+			defer server.Close()
+			request, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			require.NoError(t, err)
+			if tt.header != "" {
+				request.Header.Set(ReadPrimaryHeader, tt.header)
+			}
+			response, err := server.Client().Do(request)
+			require.NoError(t, err)
+			response.Body.Close()
+			assert.Equal(t, []bool{tt.wantPrimary}, s.primary)
+		})
+	}
+}
+
+// failingSaveDummy memstorage, запись в который сохраняет метрику и возвращает err
+type failingSaveDummy struct {
+	*memstorage.MemStorage
+	err error
+}
+
+func (s *failingSaveDummy) SaveMetric(ctx context.Context, metric models.Metric) error {
+	if err := s.MemStorage.SaveMetric(ctx, metric); err != nil {
+		return err
+	}
+	return s.err
+}
+
+func TestRouterUpdateFailed(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{name: "storage error", err: errors.New("connection refused"), wantCode: http.StatusInternalServerError},
+		{name: "partially saved", err: fmt.Errorf("%w: file storage: disk full", storage.ErrPartiallySaved), wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &failingSaveDummy{MemStorage: memstorage.NewMemStorage(log), err: tt.err}
+			server := httptest.NewServer(NewRouter(s, log, RouterOptions{}))
+			defer server.Close()
+
+			response, err := server.Client().Post(server.URL+"/update/gauge/test/1", "text/plain", nil)
+			require.NoError(t, err)
+			response.Body.Close()
+			assert.Equal(t, tt.wantCode, response.StatusCode)
+		})
+	}
+}
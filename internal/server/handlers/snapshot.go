@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/audit"
+	"github.com/aksenk/go-yandex-metrics/internal/server/policy"
+	"github.com/aksenk/go-yandex-metrics/internal/server/snapshot"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// ExportSnapshotHandler отдает все метрики хранилища в формате JSON lines (snapshot.Write).
+// С параметром gzip=true снапшот отдается сжатым файлом
+func ExportSnapshotHandler(s storage.Storager) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+
+		log, err := logger.FromContext(ctx)
+		if err != nil {
+			http.Error(writer, "internal logger error", http.StatusInternalServerError)
+			return
+		}
+
+		compressed := false
+		if v := request.URL.Query().Get("gzip"); v != "" {
+			compressed, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(writer, "Parameter 'gzip' must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// GetAllMetrics возвращает согласованное состояние на момент вызова, дальше пишется уже копия
+		all, err := s.GetAllMetrics(ctx)
+		if err != nil {
+			log.Errorf("Error getting metrics for snapshot: %v", err)
+			http.Error(writer, fmt.Sprintf("Error getting metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if compressed {
+			writer.Header().Set("Content-Type", "application/gzip")
+			writer.Header().Set("Content-Disposition", `attachment; filename="metrics.jsonl.gz"`)
+			writer.WriteHeader(http.StatusOK)
+			err = snapshot.WriteGzip(writer, all)
+		} else {
+			writer.Header().Set("Content-Type", "application/x-ndjson")
+			writer.WriteHeader(http.StatusOK)
+			err = snapshot.Write(writer, all)
+		}
+		if err != nil {
+			// заголовки уже отправлены, клиент увидит оборванный снапшот
+			log.Errorf("Error writing snapshot: %v", err)
+			return
+		}
+		log.Infof("Snapshot of %v metrics exported", len(all))
+	}
+}
+
+// ImportSnapshot сохраняет метрики снапшота в хранилище. В режиме snapshot.ModeMerge counter прибавляются
+// к текущим значениям так же, как при обновлении через API, в режиме snapshot.ModeReplace хранилище
+// должно поддерживать storage.Replacer. В аудит лог попадают все записанные и удаленные метрики
+func ImportSnapshot(ctx context.Context, metrics []models.Metric, mode string, s storage.Storager, auditor *audit.Auditor) error {
+	switch mode {
+	case snapshot.ModeReplace:
+		replacer, ok := s.(storage.Replacer)
+		if !ok {
+			return storage.ErrReplaceNotSupported
+		}
+		var current map[string]models.Metric
+		if auditor.Enabled() {
+			var err error
+			if current, err = s.GetAllMetrics(ctx); err != nil {
+				return err
+			}
+		}
+		if err := replacer.ReplaceAllMetrics(ctx, metrics); err != nil {
+			return err
+		}
+		auditor.Record(ctx, replaceChanges(current, metrics))
+		return nil
+	case snapshot.ModeMerge:
+		if len(metrics) == 0 {
+			return nil
+		}
+		_, err := UpdateBatchMetrics(ctx, metrics, s, auditor)
+		return err
+	}
+	return fmt.Errorf("unknown import mode '%v'. Should be '%v' or '%v'", mode, snapshot.ModeReplace, snapshot.ModeMerge)
+}
+
+// replaceChanges изменения при замене метрик current на metrics: записанные метрики и удаленные,
+// которых нет в metrics. Удаленные упорядочены по имени
+func replaceChanges(current map[string]models.Metric, metrics []models.Metric) []audit.Change {
+	changes := make([]audit.Change, 0, len(metrics))
+	replaced := make(map[string]bool, len(metrics))
+	for _, metric := range metrics {
+		change := audit.Change{New: metric}
+		if old, ok := current[metric.ID]; ok {
+			change.Old = &old
+		}
+		changes = append(changes, change)
+		replaced[metric.ID] = true
+	}
+	var deleted []string
+	for name := range current {
+		if !replaced[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	slices.Sort(deleted)
+	for _, name := range deleted {
+		old := current[name]
+		changes = append(changes, audit.Change{Old: &old, Deleted: true})
+	}
+	return changes
+}
+
+// ImportSnapshotHandler загружает снапшот, выгруженный ExportSnapshotHandler, в том числе с другого сервера или хранилища.
+// Параметр mode: replace (по умолчанию) или merge.
+// Снапшот проверяется целиком до записи: при ошибке в любой строке хранилище не меняется.
+// Имена метрик проверяются политикой p так же, как при обновлении через API, а лимиты количества метрик
+// на импорт администратором не распространяются. После импорта политика заново загружает известные метрики
+func ImportSnapshotHandler(s storage.Storager, p *policy.Policy, auditor *audit.Auditor) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+
+		log, err := logger.FromContext(ctx)
+		if err != nil {
+			http.Error(writer, "internal logger error", http.StatusInternalServerError)
+			return
+		}
+
+		mode := request.URL.Query().Get("mode")
+		if mode == "" {
+			mode = snapshot.ModeReplace
+		}
+		if mode != snapshot.ModeReplace && mode != snapshot.ModeMerge {
+			http.Error(writer, fmt.Sprintf("Unknown import mode '%v'. Should be '%v' or '%v'", mode, snapshot.ModeReplace, snapshot.ModeMerge), http.StatusBadRequest)
+			return
+		}
+
+		metrics, err := snapshot.Read(request.Body)
+		if err != nil {
+			log.Errorf("Incorrect snapshot: %v", err)
+			http.Error(writer, fmt.Sprintf("Incorrect snapshot: %v", err), http.StatusBadRequest)
+			return
+		}
+		for _, metric := range metrics {
+			if err = checkMetricIsCorrect(metric, p); err != nil {
+				log.Errorf("Metric '%v' is incorrect: %v", metric.ID, err)
+				http.Error(writer, fmt.Sprintf("Metric '%v' is incorrect: %v", metric.ID, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = ImportSnapshot(ctx, metrics, mode, s, auditor)
+		if errors.Is(err, storage.ErrReplaceNotSupported) {
+			http.Error(writer, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			log.Errorf("Error importing snapshot: %v", err)
+			http.Error(writer, fmt.Sprintf("Error importing snapshot: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// импорт мог удалить или добавить метрики в обход Admit
+		if err = p.Load(ctx); err != nil {
+			log.Errorf("Error reloading metrics policy: %v", err)
+		}
+
+		log.Infof("Snapshot of %v metrics imported (mode: %v)", len(metrics), mode)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		json.NewEncoder(writer).Encode(map[string]any{"imported": len(metrics), "mode": mode})
+	}
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/audit"
+	"github.com/aksenk/go-yandex-metrics/internal/server/policy"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/filestorage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func exportSnapshot(t *testing.T, s storage.Storager, query string) []byte {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	server := httptest.NewServer(NewRouter(s, log, RouterOptions{}))
+	defer server.Close()
+	response, err := server.Client().Get(server.URL + "/admin/snapshot" + query)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	return body
+}
+
+func importSnapshot(t *testing.T, s storage.Storager, query string, body []byte) int {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	server := httptest.NewServer(NewRouter(s, log, RouterOptions{}))
+	defer server.Close()
+	response, err := server.Client().Post(server.URL+"/admin/snapshot"+query, "application/x-ndjson", bytes.NewReader(body))
+	require.NoError(t, err)
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func mustMetric(t *testing.T, name, mtype string, value any) models.Metric {
+	m, err := models.NewMetric(name, mtype, value)
+	require.NoError(t, err)
+	return m
+}
+
+func TestExportSnapshotHandler(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	s := memstorage.NewMemStorage(log)
+	require.NoError(t, s.SaveBatchMetrics(context.TODO(), []models.Metric{
+		mustMetric(t, "b_gauge", "gauge", 1.5),
+		mustMetric(t, "a_counter", "counter", 3),
+	}))
+	want := `{"id":"a_counter","type":"counter","delta":3}` + "\n" + `{"id":"b_gauge","type":"gauge","value":1.5}` + "\n"
+
+	t.Run("plain", func(t *testing.T) {
+		assert.Equal(t, want, string(exportSnapshot(t, s, "")))
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		gzr, err := gzip.NewReader(bytes.NewReader(exportSnapshot(t, s, "?gzip=true")))
+		require.NoError(t, err)
+		got, err := io.ReadAll(gzr)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(got))
+	})
+}
+
+func TestImportSnapshotHandler(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	snapshot := []byte(`{"id":"a_counter","type":"counter","delta":3}` + "\n" + `{"id":"b_gauge","type":"gauge","value":1.5}` + "\n")
+
+	tests := []struct {
+		name     string
+		query    string
+		body     []byte
+		wantCode int
+		want     map[string]models.Metric
+	}{
+		{
+			name:     "replace",
+			body:     snapshot,
+			wantCode: http.StatusOK,
+			want: map[string]models.Metric{
+				"a_counter": mustMetric(t, "a_counter", "counter", 3),
+				"b_gauge":   mustMetric(t, "b_gauge", "gauge", 1.5),
+			},
+		},
+		{
+			name:     "merge",
+			query:    "?mode=merge",
+			body:     snapshot,
+			wantCode: http.StatusOK,
+			want: map[string]models.Metric{
+				"a_counter": mustMetric(t, "a_counter", "counter", 13),
+				"b_gauge":   mustMetric(t, "b_gauge", "gauge", 1.5),
+				"old_gauge": mustMetric(t, "old_gauge", "gauge", 1),
+			},
+		},
+		{
+			name:     "replace with empty snapshot",
+			wantCode: http.StatusOK,
+			want:     map[string]models.Metric{},
+		},
+		{
+			name:     "incorrect metric does not change storage",
+			body:     append(snapshot, []byte(`{"id":"c_gauge","type":"gauge"}`)...),
+			wantCode: http.StatusBadRequest,
+			want: map[string]models.Metric{
+				"a_counter": mustMetric(t, "a_counter", "counter", 10),
+				"old_gauge": mustMetric(t, "old_gauge", "gauge", 1),
+			},
+		},
+		{
+			name:     "unknown mode",
+			query:    "?mode=append",
+			body:     snapshot,
+			wantCode: http.StatusBadRequest,
+			want: map[string]models.Metric{
+				"a_counter": mustMetric(t, "a_counter", "counter", 10),
+				"old_gauge": mustMetric(t, "old_gauge", "gauge", 1),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := memstorage.NewMemStorage(log)
+			require.NoError(t, s.SaveBatchMetrics(context.TODO(), []models.Metric{
+				mustMetric(t, "a_counter", "counter", 10),
+				mustMetric(t, "old_gauge", "gauge", 1),
+			}))
+			assert.Equal(t, tt.wantCode, importSnapshot(t, s, tt.query, tt.body))
+			got, err := s.GetAllMetrics(context.TODO())
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("replace is not supported", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotImplemented, importSnapshot(t, &MemStorageDummy{}, "", snapshot))
+	})
+}
+
+func TestSnapshotMigration(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	source := memstorage.NewMemStorage(log)
+	var metrics []models.Metric
+	for _, name := range []string{"alloc", "frees", "heap"} {
+		metrics = append(metrics, mustMetric(t, name, "gauge", len(name)))
+	}
+	metrics = append(metrics, mustMetric(t, "poll_count", "counter", 42))
+	require.NoError(t, source.SaveBatchMetrics(context.TODO(), metrics))
+
+	fileName := t.TempDir() + "/metrics.json"
+	target, err := filestorage.NewFileStorage(fileName, true, log)
+	require.NoError(t, err)
+	snapshot := exportSnapshot(t, source, "?gzip=true")
+	require.Equal(t, http.StatusOK, importSnapshot(t, target, "", snapshot))
+	require.NoError(t, target.Close())
+
+	restored, err := filestorage.NewFileStorage(fileName, true, log)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.StartupRestore(context.TODO()))
+	assert.Equal(t, string(exportSnapshot(t, source, "")), string(exportSnapshot(t, restored, "")))
+	assert.True(t, strings.HasPrefix(string(exportSnapshot(t, restored, "")), `{"id":"alloc"`))
+}
+
+func TestImportSnapshotPolicy(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	s := memstorage.NewMemStorage(log)
+	require.NoError(t, s.SaveBatchMetrics(context.TODO(), []models.Metric{
+		mustMetric(t, "a_counter", "counter", 10),
+		mustMetric(t, "old_gauge", "gauge", 1),
+	}))
+	p := policy.New(policy.Config{MaxMetrics: 2, NamePattern: regexp.MustCompile(`^[a-z_]+$`)}, s, stats.NewRegistry())
+	server := httptest.NewServer(NewRouter(s, log, RouterOptions{Policy: p}))
+	defer server.Close()
+	post := func(path, body string) int {
+		response, err := server.Client().Post(server.URL+path, "application/x-ndjson", strings.NewReader(body))
+		require.NoError(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post("/update/gauge/old_gauge/2", ""))
+	assert.Equal(t, http.StatusBadRequest, post("/admin/snapshot", `{"id":"BAD","type":"gauge","value":1}`))
+	// импорт не ограничен лимитом количества метрик, но после него политика знает только новые метрики
+	assert.Equal(t, http.StatusOK, post("/admin/snapshot", `{"id":"a_counter","type":"counter","delta":3}`+"\n"+
+		`{"id":"b_gauge","type":"gauge","value":1.5}`+"\n"+`{"id":"c_gauge","type":"gauge","value":1.5}`))
+	assert.Equal(t, http.StatusOK, post("/update/gauge/b_gauge/2", ""))
+	assert.Equal(t, http.StatusUnprocessableEntity, post("/update/gauge/old_gauge/1", ""))
+}
+
+func TestImportSnapshotAudit(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	sink, err := audit.NewFileSink(t.TempDir()+"/audit.log", 0, 0)
+	require.NoError(t, err)
+	auditor := audit.NewAuditor(sink, log, nil)
+	defer auditor.Close()
+
+	s := memstorage.NewMemStorage(log)
+	require.NoError(t, s.SaveBatchMetrics(context.TODO(), []models.Metric{
+		mustMetric(t, "a_counter", "counter", 10),
+		mustMetric(t, "old_gauge", "gauge", 1),
+	}))
+	server := httptest.NewServer(NewRouter(s, log, RouterOptions{Auditor: auditor}))
+	defer server.Close()
+
+	body := `{"id":"a_counter","type":"counter","delta":3}` + "\n" + `{"id":"b_gauge","type":"gauge","value":1.5}` + "\n"
+	response, err := server.Client().Post(server.URL+"/admin/snapshot", "application/x-ndjson", strings.NewReader(body))
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	entries, err := auditor.Query(context.TODO(), audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	// записи от новых к старым: сначала удаленные метрики
+	assert.Equal(t, "old_gauge", entries[0].MetricID)
+	assert.True(t, entries[0].Deleted)
+	require.NotNil(t, entries[0].OldValue)
+	assert.Equal(t, "1", *entries[0].OldValue)
+	assert.Empty(t, entries[0].NewValue)
+
+	assert.Equal(t, "b_gauge", entries[1].MetricID)
+	assert.Nil(t, entries[1].OldValue)
+	assert.Equal(t, "1.5", entries[1].NewValue)
+
+	assert.Equal(t, "a_counter", entries[2].MetricID)
+	require.NotNil(t, entries[2].OldValue)
+	assert.Equal(t, "10", *entries[2].OldValue)
+	assert.Equal(t, "3", entries[2].NewValue)
+	assert.False(t, entries[2].Deleted)
+	assert.Equal(t, "127.0.0.1", entries[2].ClientIP)
+}
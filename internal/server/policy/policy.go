@@ -0,0 +1,193 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"regexp"
+	"sync"
+)
+
+var (
+	ErrNameTooLong       = errors.New("metric name is too long")
+	ErrNameNotAllowed    = errors.New("metric name does not match allowed pattern")
+	ErrTooManyMetrics    = errors.New("maximum number of metrics exceeded")
+	ErrClientLimitExceed = errors.New("maximum number of metrics for client exceeded")
+)
+
+// Config нулевые значения отключают соответствующее ограничение
+type Config struct {
+	MaxMetrics          int
+	MaxMetricsPerClient int
+	MaxNameLength       int
+	NamePattern         *regexp.Regexp
+}
+
+// Policy ограничивает имена метрик и их количество (кардинальность).
+// Для подсчета кардинальности известные имена метрик держатся в памяти и загружаются из storage при старте (Load).
+// Владелец метрики в storage не хранится, поэтому лимит клиента считает метрики, созданные им после старта сервера
+type Policy struct {
+	cfg      Config
+	storage  storage.Storager
+	mu       sync.Mutex
+	loaded   bool
+	known    map[string]struct{}
+	byClient map[string]int
+	// новые метрики допущенных, но еще не записанных запросов: сколько запросов зарезервировали имя
+	reserved         map[string]int
+	reservedByClient map[string]int
+
+	rejectedNameLength    *stats.Counter
+	rejectedNamePattern   *stats.Counter
+	rejectedMaxMetrics    *stats.Counter
+	rejectedClientMetrics *stats.Counter
+}
+
+func New(cfg Config, s storage.Storager, st *stats.Registry) *Policy {
+	return &Policy{
+		cfg:                   cfg,
+		storage:               s,
+		known:                 make(map[string]struct{}),
+		byClient:              make(map[string]int),
+		reserved:              make(map[string]int),
+		reservedByClient:      make(map[string]int),
+		rejectedNameLength:    st.Counter("policy_rejected_name_length"),
+		rejectedNamePattern:   st.Counter("policy_rejected_name_pattern"),
+		rejectedMaxMetrics:    st.Counter("policy_rejected_max_metrics"),
+		rejectedClientMetrics: st.Counter("policy_rejected_client_max_metrics"),
+	}
+}
+
+// CheckName проверяет длину имени метрики и его соответствие шаблону. У nil политики ограничений нет
+func (p *Policy) CheckName(name string) error {
+	if p == nil {
+		return nil
+	}
+	if p.cfg.MaxNameLength > 0 && len(name) > p.cfg.MaxNameLength {
+		p.rejectedNameLength.Inc()
+		return fmt.Errorf("%w: %v characters, maximum is %v", ErrNameTooLong, len(name), p.cfg.MaxNameLength)
+	}
+	if p.cfg.NamePattern != nil && !p.cfg.NamePattern.MatchString(name) {
+		p.rejectedNamePattern.Inc()
+		return fmt.Errorf("%w '%v'", ErrNameNotAllowed, p.cfg.NamePattern)
+	}
+	return nil
+}
+
+func (p *Policy) load(ctx context.Context) error {
+	if p.loaded {
+		return nil
+	}
+	all, err := p.storage.GetAllMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("can not load existing metrics: %v", err)
+	}
+	clear(p.known)
+	for name := range all {
+		p.known[name] = struct{}{}
+	}
+	p.loaded = true
+	return nil
+}
+
+// Load загружает имена существующих метрик из storage. Вызывается при старте и после замены всех метрик
+func (p *Policy) Load(ctx context.Context) error {
+	if p == nil || p.storage == nil || (p.cfg.MaxMetrics == 0 && p.cfg.MaxMetricsPerClient == 0) {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loaded = false
+	return p.load(ctx)
+}
+
+// Admission новые метрики, допущенные Admit. До вызова Commit или Release место под них зарезервировано
+type Admission struct {
+	p      *Policy
+	client string
+	names  []string
+	done   bool
+}
+
+// Admit проверяет, что новые метрики из списка не превысят общий лимит и лимит клиента.
+// Метрики принимаются или отклоняются целиком. После записи в storage нужно вызвать Commit,
+// при ошибке записи - Release, иначе метрики останутся зарезервированными
+func (p *Policy) Admit(ctx context.Context, client string, names []string) (*Admission, error) {
+	if p == nil || (p.cfg.MaxMetrics == 0 && p.cfg.MaxMetricsPerClient == 0) {
+		return nil, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(ctx); err != nil {
+		return nil, err
+	}
+
+	newNames := make(map[string]struct{})
+	for _, name := range names {
+		if _, ok := p.known[name]; !ok {
+			newNames[name] = struct{}{}
+		}
+	}
+	if len(newNames) == 0 {
+		return nil, nil
+	}
+
+	pending := len(p.reserved)
+	for name := range newNames {
+		if _, ok := p.reserved[name]; !ok {
+			pending++
+		}
+	}
+	if p.cfg.MaxMetrics > 0 && len(p.known)+pending > p.cfg.MaxMetrics {
+		p.rejectedMaxMetrics.Inc()
+		return nil, fmt.Errorf("%w: limit is %v", ErrTooManyMetrics, p.cfg.MaxMetrics)
+	}
+	if p.cfg.MaxMetricsPerClient > 0 && p.byClient[client]+p.reservedByClient[client]+len(newNames) > p.cfg.MaxMetricsPerClient {
+		p.rejectedClientMetrics.Inc()
+		return nil, fmt.Errorf("%w: limit is %v", ErrClientLimitExceed, p.cfg.MaxMetricsPerClient)
+	}
+
+	a := &Admission{p: p, client: client}
+	for name := range newNames {
+		p.reserved[name]++
+		a.names = append(a.names, name)
+	}
+	p.reservedByClient[client] += len(a.names)
+	return a, nil
+}
+
+// finish снимает резерв. Если commit, то метрики становятся известными и засчитываются клиенту
+func (a *Admission) finish(commit bool) {
+	if a == nil || a.done {
+		return
+	}
+	a.done = true
+	p := a.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, name := range a.names {
+		if p.reserved[name]--; p.reserved[name] <= 0 {
+			delete(p.reserved, name)
+		}
+		if _, ok := p.known[name]; commit && !ok {
+			// метрику мог уже создать параллельный запрос, тогда она не засчитывается второй раз
+			p.known[name] = struct{}{}
+			p.byClient[a.client]++
+		}
+	}
+	if p.reservedByClient[a.client] -= len(a.names); p.reservedByClient[a.client] <= 0 {
+		delete(p.reservedByClient, a.client)
+	}
+}
+
+// Commit засчитывает метрики после успешной записи
+func (a *Admission) Commit() {
+	a.finish(true)
+}
+
+// Release освобождает резерв после неудачной записи
+func (a *Admission) Release() {
+	a.finish(false)
+}
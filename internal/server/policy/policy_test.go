@@ -0,0 +1,137 @@
+package policy
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPolicy_CheckName(t *testing.T) {
+	registry := stats.NewRegistry()
+	p := New(Config{MaxNameLength: 10, NamePattern: regexp.MustCompile(`^[A-Za-z0-9_]+$`)}, nil, registry)
+
+	tests := []struct {
+		name    string
+		metric  string
+		wantErr error
+	}{
+		{name: "allowed name", metric: "Alloc", wantErr: nil},
+		{name: "too long name", metric: strings.Repeat("a", 11), wantErr: ErrNameTooLong},
+		{name: "not allowed symbols", metric: "cpu.load", wantErr: ErrNameNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.CheckName(tt.metric)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+
+	snapshot := registry.Snapshot()
+	assert.EqualValues(t, 1, snapshot["policy_rejected_name_length"])
+	assert.EqualValues(t, 1, snapshot["policy_rejected_name_pattern"])
+
+	var nilPolicy *Policy
+	assert.NoError(t, nilPolicy.CheckName(strings.Repeat("a", 1000)))
+}
+
+func TestPolicy_Admit(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	s := memstorage.NewMemStorage(log)
+	existing, err := models.NewMetric("existing", "gauge", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), existing))
+
+	registry := stats.NewRegistry()
+	p := New(Config{MaxMetrics: 4, MaxMetricsPerClient: 2}, s, registry)
+	require.NoError(t, p.Load(context.TODO()))
+
+	admit := func(client string, names ...string) error {
+		a, err := p.Admit(context.TODO(), client, names)
+		a.Commit()
+		return err
+	}
+
+	// существующие метрики не учитываются в лимите клиента
+	assert.NoError(t, admit("a", "existing", "a1", "a2"))
+	assert.ErrorIs(t, admit("a", "a3"), ErrClientLimitExceed)
+	// повторная запись уже известных метрик всегда разрешена
+	assert.NoError(t, admit("a", "a1", "a2"))
+
+	assert.NoError(t, admit("b", "b1"))
+	assert.ErrorIs(t, admit("c", "c1"), ErrTooManyMetrics)
+
+	snapshot := registry.Snapshot()
+	assert.EqualValues(t, 1, snapshot["policy_rejected_max_metrics"])
+	assert.EqualValues(t, 1, snapshot["policy_rejected_client_max_metrics"])
+}
+
+func TestPolicy_AdmitReservation(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	s := memstorage.NewMemStorage(log)
+	p := New(Config{MaxMetrics: 2, MaxMetricsPerClient: 1}, s, stats.NewRegistry())
+
+	// параллельные запросы не могут вместе превысить лимит
+	first, err := p.Admit(context.TODO(), "a", []string{"a1"})
+	require.NoError(t, err)
+	_, err = p.Admit(context.TODO(), "a", []string{"a2"})
+	assert.ErrorIs(t, err, ErrClientLimitExceed)
+
+	// неудачная запись не расходует лимиты
+	first.Release()
+	first.Release()
+	second, err := p.Admit(context.TODO(), "a", []string{"a2"})
+	require.NoError(t, err)
+	second.Commit()
+	_, err = p.Admit(context.TODO(), "a", []string{"a3"})
+	assert.ErrorIs(t, err, ErrClientLimitExceed)
+
+	// одну и ту же новую метрику одновременно пишут два клиента: засчитывается только первому
+	b, err := p.Admit(context.TODO(), "b", []string{"shared"})
+	require.NoError(t, err)
+	c, err := p.Admit(context.TODO(), "c", []string{"shared"})
+	require.NoError(t, err)
+	b.Commit()
+	c.Commit()
+	_, err = p.Admit(context.TODO(), "c", []string{"c1"})
+	assert.ErrorIs(t, err, ErrTooManyMetrics)
+	assert.Equal(t, 0, p.byClient["c"])
+}
+
+func TestPolicy_Load(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	s := memstorage.NewMemStorage(log)
+	p := New(Config{MaxMetrics: 1}, s, stats.NewRegistry())
+	require.NoError(t, p.Load(context.TODO()))
+
+	// метрика появилась в storage в обход политики, например при импорте снапшота
+	m, err := models.NewMetric("imported", "gauge", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), m))
+	a, err := p.Admit(context.TODO(), "a", []string{"new"})
+	require.NoError(t, err)
+	a.Release()
+
+	require.NoError(t, p.Load(context.TODO()))
+	_, err = p.Admit(context.TODO(), "a", []string{"other"})
+	assert.ErrorIs(t, err, ErrTooManyMetrics)
+
+	var nilPolicy *Policy
+	assert.NoError(t, nilPolicy.Load(context.TODO()))
+	var nilAdmission *Admission
+	nilAdmission.Commit()
+}
@@ -0,0 +1,201 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/server/auth"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type KeyType string
+
+const (
+	KeyIP KeyType = "ip"
+	// KeyToken лимитирует по ID токена, а для запросов без токена по IP
+	KeyToken KeyType = "token"
+)
+
+type contextKey string
+
+const keyClient contextKey = "ratelimit"
+
+// клиенты, от которых не было запросов дольше этого времени, удаляются из памяти
+const idleTimeout = 10 * time.Minute
+
+type Config struct {
+	RequestsPerSecond float64
+	MetricsPerSecond  float64
+	Key               KeyType
+}
+
+// bucket классический token bucket. Емкость равна лимиту за одну секунду
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	return &bucket{rate: rate, tokens: math.Max(rate, 1), last: now}
+}
+
+// take списывает n токенов. Если n больше емкости, то запрос пропускается при полном бакете,
+// а баланс уходит в минус, чтобы следующие запросы подождали пропорционально размеру
+func (b *bucket) take(n float64, now time.Time) (bool, time.Duration) {
+	capacity := math.Max(b.rate, 1)
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	need := math.Min(n, capacity)
+	if b.tokens >= need {
+		b.tokens -= n
+		return true, 0
+	}
+	wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+type client struct {
+	requests *bucket
+	metrics  *bucket
+	lastSeen time.Time
+}
+
+type Limiter struct {
+	cfg       Config
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLimiter(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		clients: make(map[string]*client),
+		now:     time.Now,
+	}
+}
+
+func (l *Limiter) client(key string, now time.Time) *client {
+	if now.Sub(l.lastSweep) > idleTimeout {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > idleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{}
+		if l.cfg.RequestsPerSecond > 0 {
+			c.requests = newBucket(l.cfg.RequestsPerSecond, now)
+		}
+		if l.cfg.MetricsPerSecond > 0 {
+			c.metrics = newBucket(l.cfg.MetricsPerSecond, now)
+		}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// AllowRequest возвращает false и время, через которое стоит повторить запрос, если клиент превысил лимит запросов
+func (l *Limiter) AllowRequest(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	c := l.client(key, now)
+	if c.requests == nil {
+		return true, 0
+	}
+	return c.requests.take(1, now)
+}
+
+// AllowMetrics аналогично AllowRequest, но для количества принимаемых метрик
+func (l *Limiter) AllowMetrics(key string, n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	c := l.client(key, now)
+	if c.metrics == nil {
+		return true, 0
+	}
+	return c.metrics.take(float64(n), now)
+}
+
+type limitedClient struct {
+	limiter *Limiter
+	key     string
+}
+
+// AllowMetrics проверяет квоту на количество метрик для клиента из контекста запроса.
+// Если middleware не подключен, то квота не ограничена
+func AllowMetrics(ctx context.Context, n int) (bool, time.Duration) {
+	c, ok := ctx.Value(keyClient).(limitedClient)
+	if !ok {
+		return true, 0
+	}
+	return c.limiter.AllowMetrics(c.key, n)
+}
+
+// TooManyRequests отдает клиенту 429 с заголовком Retry-After (в целых секундах, не меньше одной)
+func TooManyRequests(w http.ResponseWriter, wait time.Duration, msg string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("%v, retry after %v seconds", msg, seconds), http.StatusTooManyRequests)
+}
+
+// limit проверяет лимит запросов клиента key и передает его дальше для квоты метрик
+func (l *Limiter) limit(w http.ResponseWriter, r *http.Request, next http.Handler, key string, log *zap.SugaredLogger) {
+	if ok, wait := l.AllowRequest(key); !ok {
+		log.Errorf("Client '%v' exceeded requests rate limit", key)
+		TooManyRequests(w, wait, "Requests rate limit exceeded")
+		return
+	}
+	ctx := context.WithValue(r.Context(), keyClient, limitedClient{limiter: l, key: key})
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// IPMiddleware ограничивает количество запросов с одного IP. Подключается до аутентификации,
+// чтобы запросы с неверными токенами тоже ограничивались и не нагружали хранилище токенов.
+// Если limiter не задан, то ограничения выключены
+func IPMiddleware(l *Limiter, log *zap.SugaredLogger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l == nil {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			l.limit(w, r, next, "ip:"+auth.ClientIP(r), log)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Middleware подключается после аутентификации. При KeyToken дополнительно ограничивает запросы по токену
+// и считает квоту метрик по токену. Запросы без токена уже ограничены по IP в IPMiddleware
+func Middleware(l *Limiter, log *zap.SugaredLogger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l == nil || l.cfg.Key != KeyToken {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			key := auth.ClientKey(r)
+			if !strings.HasPrefix(key, "token:") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			l.limit(w, r, next, key, log)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
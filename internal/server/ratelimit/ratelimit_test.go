@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/server/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func newTestLimiter(cfg Config) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := NewLimiter(cfg)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestLimiter_AllowRequest(t *testing.T) {
+	l, clock := newTestLimiter(Config{RequestsPerSecond: 2})
+
+	ok, _ := l.AllowRequest("a")
+	assert.True(t, ok)
+	ok, _ = l.AllowRequest("a")
+	assert.True(t, ok)
+	ok, wait := l.AllowRequest("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// у другого клиента свой бакет
+	ok, _ = l.AllowRequest("b")
+	assert.True(t, ok)
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	ok, _ = l.AllowRequest("a")
+	assert.True(t, ok)
+}
+
+func TestLimiter_AllowMetrics(t *testing.T) {
+	t.Run("unlimited", func(t *testing.T) {
+		l, _ := newTestLimiter(Config{RequestsPerSecond: 1})
+		ok, _ := l.AllowMetrics("a", 1000000)
+		assert.True(t, ok)
+	})
+
+	t.Run("batch bigger than bucket", func(t *testing.T) {
+		l, clock := newTestLimiter(Config{MetricsPerSecond: 10})
+
+		// большой батч пропускается при полном бакете, но следующий придется ждать пропорционально
+		ok, _ := l.AllowMetrics("a", 30)
+		assert.True(t, ok)
+		ok, wait := l.AllowMetrics("a", 1)
+		assert.False(t, ok)
+		assert.Equal(t, 2100*time.Millisecond, wait)
+
+		clock.now = clock.now.Add(wait)
+		ok, _ = l.AllowMetrics("a", 1)
+		assert.True(t, ok)
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	l, _ := newTestLimiter(Config{RequestsPerSecond: 1, MetricsPerSecond: 5, Key: KeyIP})
+	handler := IPMiddleware(l, log)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := AllowMetrics(r.Context(), 10); !ok {
+			TooManyRequests(w, wait, "Metrics rate limit exceeded")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	do := func(remoteAddr string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		request.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, do("10.0.0.1:1000").Code)
+
+	res := do("10.0.0.1:1001")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "1", res.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, do("10.0.0.2:1000").Code)
+
+	t.Run("metrics quota without middleware", func(t *testing.T) {
+		ok, _ := AllowMetrics(context.TODO(), 100)
+		assert.True(t, ok)
+	})
+
+	t.Run("disabled limiter", func(t *testing.T) {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		h := Middleware(nil, log)(next)
+		assert.NotNil(t, h)
+		h = IPMiddleware(nil, log)(next)
+		assert.NotNil(t, h)
+	})
+}
+
+type countingTokenStore struct {
+	lookups int
+}
+
+func (s *countingTokenStore) LookupToken(ctx context.Context, hash string) (*auth.Token, error) {
+	s.lookups++
+	for _, id := range []string{"a", "b"} {
+		if hash == auth.HashToken(id) {
+			return &auth.Token{ID: id, Scopes: []auth.Scope{auth.ScopeWrite}}, nil
+		}
+	}
+	return nil, auth.ErrTokenNotFound
+}
+
+func TestMiddleware_withAuth(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+
+	store := &countingTokenStore{}
+	l, _ := newTestLimiter(Config{RequestsPerSecond: 2, Key: KeyToken})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := IPMiddleware(l, log)(auth.Middleware(store, auth.ScopeWrite, log)(Middleware(l, log)(next)))
+
+	do := func(remoteAddr, token string) int {
+		request := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	t.Run("unauthenticated flood is limited before token lookup", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			do("10.0.0.1:1000", "wrong")
+		}
+		assert.Equal(t, 2, store.lookups)
+	})
+
+	t.Run("token bucket is shared between addresses", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("10.0.0.2:1000", "a"))
+		assert.Equal(t, http.StatusOK, do("10.0.0.2:1000", "a"))
+		assert.Equal(t, http.StatusTooManyRequests, do("10.0.0.3:1000", "a"))
+		assert.Equal(t, http.StatusOK, do("10.0.0.3:1000", "b"))
+	})
+}
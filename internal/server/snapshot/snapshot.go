@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"io"
+	"sort"
+)
+
+// режимы импорта снапшота
+const (
+	// ModeReplace заменяет все метрики хранилища метриками из снапшота
+	ModeReplace = "replace"
+	// ModeMerge сохраняет gauge из снапшота, а counter прибавляет к текущим значениям
+	ModeMerge = "merge"
+)
+
+// Write записывает метрики в формате JSON lines, по метрике на строку, отсортированные по имени
+func Write(w io.Writer, metrics map[string]models.Metric) error {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	encoder := json.NewEncoder(w)
+	for _, name := range names {
+		if err := encoder.Encode(metrics[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteGzip записывает метрики как Write, но сжатыми gzip
+func WriteGzip(w io.Writer, metrics map[string]models.Metric) error {
+	gzw := gzip.NewWriter(w)
+	if err := Write(gzw, metrics); err != nil {
+		gzw.Close()
+		return err
+	}
+	return gzw.Close()
+}
+
+func checkMetric(metric models.Metric) error {
+	if metric.ID == "" {
+		return fmt.Errorf("field 'id' is required")
+	}
+	switch metric.MType {
+	case models.Gauge.String():
+		if metric.Value == nil || metric.Delta != nil {
+			return fmt.Errorf("gauge metric '%v' must have only value field", metric.ID)
+		}
+	case models.Counter.String():
+		if metric.Delta == nil || metric.Value != nil {
+			return fmt.Errorf("counter metric '%v' must have only delta field", metric.ID)
+		}
+	default:
+		return fmt.Errorf("unknown type '%v' of metric '%v'", metric.MType, metric.ID)
+	}
+	return nil
+}
+
+// Read читает и проверяет все метрики снапшота. Сжатый gzip снапшот распознается по сигнатуре
+func Read(r io.Reader) ([]models.Metric, error) {
+	reader := bufio.NewReader(r)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("can not ungzip snapshot: %v", err)
+		}
+		defer gzr.Close()
+		reader = bufio.NewReader(gzr)
+	}
+
+	var metrics []models.Metric
+	decoder := json.NewDecoder(reader)
+	for line := 1; ; line++ {
+		var metric models.Metric
+		err := decoder.Decode(&metric)
+		if errors.Is(err, io.EOF) {
+			return metrics, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("metric #%v: %v", line, err)
+		}
+		if err = checkMetric(metric); err != nil {
+			return nil, fmt.Errorf("metric #%v: %v", line, err)
+		}
+		metrics = append(metrics, metric)
+	}
+}
@@ -0,0 +1,64 @@
+package snapshot
+
+import (
+	"bytes"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	gauge, err := models.NewMetric("b_gauge", "gauge", 1.5)
+	require.NoError(t, err)
+	counter, err := models.NewMetric("a_counter", "counter", 3)
+	require.NoError(t, err)
+	metrics := map[string]models.Metric{gauge.ID: gauge, counter.ID: counter}
+
+	t.Run("plain", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, Write(&buf, metrics))
+		assert.Equal(t, `{"id":"a_counter","type":"counter","delta":3}`+"\n"+`{"id":"b_gauge","type":"gauge","value":1.5}`+"\n", buf.String())
+
+		got, err := Read(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{counter, gauge}, got)
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteGzip(&buf, metrics))
+		got, err := Read(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, []models.Metric{counter, gauge}, got)
+	})
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantLen int
+		wantErr string
+	}{
+		{name: "empty snapshot", data: "", wantLen: 0},
+		{name: "metrics without trailing newline", data: `{"id":"a","type":"gauge","value":1}` + "\n" + `{"id":"b","type":"counter","delta":1}`, wantLen: 2},
+		{name: "gauge without value", data: `{"id":"a","type":"gauge"}`, wantErr: "metric #1: gauge metric 'a' must have only value field"},
+		{name: "counter with value", data: `{"id":"a","type":"gauge","value":1}` + "\n" + `{"id":"b","type":"counter","value":1,"delta":1}`, wantErr: "metric #2: counter metric 'b' must have only delta field"},
+		{name: "metric without name", data: `{"type":"gauge","value":1}`, wantErr: "metric #1: field 'id' is required"},
+		{name: "unknown type", data: `{"id":"a","type":"histogram"}`, wantErr: "metric #1: unknown type 'histogram' of metric 'a'"},
+		{name: "broken json", data: `{"id":"a",`, wantErr: "metric #1: unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(strings.NewReader(tt.data))
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, got, tt.wantLen)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counter монотонный счетчик собственных метрик сервера
+type Counter struct {
+	value atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	c.value.Add(n)
+}
+
+func (c *Counter) Get() int64 {
+	return c.value.Load()
+}
+
+// Registry собственные метрики сервера (self-metrics): счетчики и gauge, значение которых вычисляется при запросе
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]*Counter
+	gauges   map[string]func() float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*Counter),
+		gauges:   make(map[string]func() float64),
+	}
+}
+
+// Counter возвращает счетчик с указанным именем, создавая его при первом обращении.
+// У nil реестра возвращается счетчик, который никуда не публикуется
+func (r *Registry) Counter(name string) *Counter {
+	if r == nil {
+		return &Counter{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.counters[name]
+	if !ok {
+		c = &Counter{}
+		r.counters[name] = c
+	}
+	return c
+}
+
+func (r *Registry) RegisterGauge(name string, fn func() float64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = fn
+}
+
+func (r *Registry) Snapshot() map[string]float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make(map[string]float64, len(r.counters)+len(r.gauges))
+	for name, c := range r.counters {
+		result[name] = float64(c.Get())
+	}
+	for name, fn := range r.gauges {
+		result[name] = fn()
+	}
+	return result
+}
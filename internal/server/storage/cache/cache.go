@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CachedStorage write-behind кеш перед базой. Актуальное состояние метрик хранится в памяти,
+// чтение в базу не ходит, а измененные метрики накапливаются и сбрасываются в базу одним SaveBatchMetrics.
+// Кеш считает себя единственным писателем: изменения других серверов в той же базе будут перезаписаны
+type CachedStorage struct {
+	Backend       storage.Storager
+	FlushInterval time.Duration
+	// FlushSize количество измененных метрик, при котором сброс запускается до истечения интервала (0 - только по интервалу)
+	FlushSize int
+	Logger    *zap.SugaredLogger
+	mem       *memstorage.MemStorage
+	// mu защищает согласованность mem и pending при записи
+	mu sync.Mutex
+	// pending измененные метрики, еще не записанные в базу. По каждому имени хранится только последнее значение
+	pending map[string]models.Metric
+	// flushMu не дает двум сбросам писать в базу одновременно
+	flushMu     sync.Mutex
+	flushCh     chan struct{}
+	flushErrors atomic.Int64
+}
+
+func NewCachedStorage(backend storage.Storager, cfg config.CacheConfig, log *zap.SugaredLogger) *CachedStorage {
+	return &CachedStorage{
+		Backend:       backend,
+		FlushInterval: time.Duration(cfg.FlushInterval) * time.Second,
+		FlushSize:     cfg.FlushSize,
+		Logger:        log,
+		mem:           memstorage.NewMemStorage(log),
+		pending:       make(map[string]models.Metric),
+		flushCh:       make(chan struct{}, 1),
+	}
+}
+
+// checkMetric не дает некорректной метрике попасть в pending: база отклонит ее при каждом сбросе
+func checkMetric(metric models.Metric) error {
+	switch {
+	case metric.MType == models.Gauge.String() && metric.Value != nil:
+	case metric.MType == models.Counter.String() && metric.Delta != nil:
+	default:
+		return fmt.Errorf("incorrect metric '%v' with type '%v'", metric.ID, metric.MType)
+	}
+	return nil
+}
+
+// save сохраняет метрики в память и помечает их для записи в базу. Вызывается под mu
+func (c *CachedStorage) save(ctx context.Context, metrics []models.Metric) error {
+	if err := c.mem.SaveBatchMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	for _, metric := range metrics {
+		c.pending[metric.ID] = metric
+	}
+	if c.FlushSize > 0 && len(c.pending) >= c.FlushSize {
+		select {
+		case c.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *CachedStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
+	return c.SaveBatchMetrics(ctx, []models.Metric{metric})
+}
+
+func (c *CachedStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	for _, metric := range metrics {
+		if err := checkMetric(metric); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save(ctx, metrics)
+}
+
+// IncrementMetrics прибавляет counter к значениям в памяти под одной блокировкой (storage.Incrementer)
+func (c *CachedStorage) IncrementMetrics(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
+	for _, metric := range metrics {
+		if err := checkMetric(metric); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]models.Metric, len(metrics))
+	for i, metric := range metrics {
+		current, err := c.mem.GetMetric(ctx, metric.ID)
+		if err == nil && metric.MType == models.Counter.String() && current.MType == models.Counter.String() {
+			delta := *metric.Delta + *current.Delta
+			metric.Delta = &delta
+		}
+		if err = c.save(ctx, []models.Metric{metric}); err != nil {
+			return nil, err
+		}
+		result[i] = metric
+	}
+	return result, nil
+}
+
+// ReplaceAllMetrics заменяет метрики в базе и в памяти. Накопленные изменения при этом отбрасываются
+func (c *CachedStorage) ReplaceAllMetrics(ctx context.Context, metrics []models.Metric) error {
+	replacer, ok := c.Backend.(storage.Replacer)
+	if !ok {
+		return storage.ErrReplaceNotSupported
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := replacer.ReplaceAllMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	c.pending = make(map[string]models.Metric)
+	return c.mem.ReplaceAllMetrics(ctx, metrics)
+}
+
+func (c *CachedStorage) GetMetric(ctx context.Context, name string) (*models.Metric, error) {
+	return c.mem.GetMetric(ctx, name)
+}
+
+func (c *CachedStorage) GetAllMetrics(ctx context.Context) (map[string]models.Metric, error) {
+	return c.mem.GetAllMetrics(ctx)
+}
+
+// StartupRestore загружает метрики из базы в память. Должен выполняться до приема метрик
+func (c *CachedStorage) StartupRestore(ctx context.Context) error {
+	if err := c.Backend.StartupRestore(ctx); err != nil {
+		return err
+	}
+	all, err := c.Backend.GetAllMetrics(storage.WithPrimary(ctx))
+	if err != nil {
+		return fmt.Errorf("can not load metrics from the database: %v", err)
+	}
+	metrics := make([]models.Metric, 0, len(all))
+	for _, metric := range all {
+		metrics = append(metrics, metric)
+	}
+	c.Logger.Infof("Loaded %v metrics from the database to the cache", len(metrics))
+	return c.mem.SaveBatchMetrics(ctx, metrics)
+}
+
+// FlushMetrics записывает накопленные изменения в базу. При ошибке изменения возвращаются в pending,
+// если метрику не успели изменить еще раз, и будут записаны при следующем сбросе
+func (c *CachedStorage) FlushMetrics() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]models.Metric)
+	c.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	metrics := make([]models.Metric, 0, len(pending))
+	for _, metric := range pending {
+		metrics = append(metrics, metric)
+	}
+	if err := c.Backend.SaveBatchMetrics(context.Background(), metrics); err != nil {
+		c.mu.Lock()
+		for name, metric := range pending {
+			if _, ok := c.pending[name]; !ok {
+				c.pending[name] = metric
+			}
+		}
+		c.mu.Unlock()
+		c.flushErrors.Add(1)
+		return fmt.Errorf("can not write %v metrics to the database: %v", len(metrics), err)
+	}
+	c.Logger.Debugf("Cache flushed %v metrics to the database", len(metrics))
+	return nil
+}
+
+// Pending количество измененных метрик, еще не записанных в базу
+func (c *CachedStorage) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Run сбрасывает изменения в базу по интервалу и при накоплении FlushSize метрик до отмены контекста.
+// Оставшиеся изменения записываются в Close
+func (c *CachedStorage) Run(ctx context.Context) {
+	c.Logger.Infof("Starting cache flushing every %v", c.FlushInterval)
+	ticker := time.NewTicker(c.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.flushCh:
+		case <-ctx.Done():
+			c.Logger.Info("Cache flusher stopped")
+			return
+		}
+		if err := c.FlushMetrics(); err != nil {
+			c.Logger.Errorf("Cache flush error: %v", err)
+		}
+	}
+}
+
+// RegisterStats добавляет статистику кеша в метрики сервера
+func (c *CachedStorage) RegisterStats(registry *stats.Registry) {
+	registry.RegisterGauge("cache_pending_metrics", func() float64 { return float64(c.Pending()) })
+	registry.RegisterGauge("cache_flush_errors", func() float64 { return float64(c.flushErrors.Load()) })
+}
+
+func (c *CachedStorage) Status(ctx context.Context) error {
+	return c.Backend.Status(ctx)
+}
+
+// Close записывает оставшиеся изменения и закрывает базу
+func (c *CachedStorage) Close() error {
+	flushErr := c.FlushMetrics()
+	if err := c.Backend.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backendDummy memstorage, который запоминает записи в базу и запрещает чтение отдельных метрик
+type backendDummy struct {
+	*memstorage.MemStorage
+	mu      sync.Mutex
+	batches [][]models.Metric
+	err     error
+	closed  bool
+}
+
+func (b *backendDummy) GetMetric(ctx context.Context, name string) (*models.Metric, error) {
+	panic("GetMetric must not be called for cached storage")
+}
+
+func (b *backendDummy) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.batches = append(b.batches, metrics)
+	return b.MemStorage.SaveBatchMetrics(ctx, metrics)
+}
+
+func (b *backendDummy) Batches() [][]models.Metric {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.batches
+}
+
+func (b *backendDummy) Close() error {
+	b.closed = true
+	return nil
+}
+
+func CreateTestStorage(t *testing.T, cfg config.CacheConfig) (*CachedStorage, *backendDummy) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	backend := &backendDummy{MemStorage: memstorage.NewMemStorage(log)}
+	return NewCachedStorage(backend, cfg, log), backend
+}
+
+func mustMetric(t *testing.T, name, mtype string, value any) models.Metric {
+	m, err := models.NewMetric(name, mtype, value)
+	require.NoError(t, err)
+	return m
+}
+
+func TestCachedStorage_IncrementMetrics(t *testing.T) {
+	t.Run("changes are coalesced until flush", func(t *testing.T) {
+		c, backend := CreateTestStorage(t, config.CacheConfig{FlushInterval: 10})
+		counter := mustMetric(t, "test_counter", "counter", 2)
+		for i := 0; i < 5; i++ {
+			_, err := c.IncrementMetrics(context.TODO(), []models.Metric{counter})
+			require.NoError(t, err)
+		}
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge", "gauge", 1)))
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge", "gauge", 2.5)))
+
+		gotMetric, err := c.GetMetric(context.TODO(), "test_counter")
+		require.NoError(t, err)
+		assert.EqualValues(t, 10, *gotMetric.Delta)
+		assert.Empty(t, backend.Batches())
+		assert.Equal(t, 2, c.Pending())
+
+		require.NoError(t, c.FlushMetrics())
+		require.Len(t, backend.Batches(), 1)
+		assert.Len(t, backend.Batches()[0], 2)
+		assert.EqualValues(t, 10, *backend.Metrics["test_counter"].Delta)
+		assert.EqualValues(t, 2.5, *backend.Metrics["test_gauge"].Value)
+		assert.Equal(t, 0, c.Pending())
+
+		require.NoError(t, c.FlushMetrics())
+		assert.Len(t, backend.Batches(), 1)
+	})
+
+	t.Run("concurrent increments are not lost", func(t *testing.T) {
+		c, _ := CreateTestStorage(t, config.CacheConfig{FlushInterval: 10})
+		counter := mustMetric(t, "test_counter", "counter", 1)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := c.IncrementMetrics(context.TODO(), []models.Metric{counter})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		gotMetric, err := c.GetMetric(context.TODO(), "test_counter")
+		require.NoError(t, err)
+		assert.EqualValues(t, 50, *gotMetric.Delta)
+	})
+
+	t.Run("incorrect metric", func(t *testing.T) {
+		c, _ := CreateTestStorage(t, config.CacheConfig{FlushInterval: 10})
+		_, err := c.IncrementMetrics(context.TODO(), []models.Metric{{ID: "broken", MType: "counter"}})
+		assert.Error(t, err)
+		assert.Equal(t, 0, c.Pending())
+	})
+}
+
+func TestCachedStorage_FlushMetrics(t *testing.T) {
+	t.Run("failed flush keeps newer values", func(t *testing.T) {
+		c, backend := CreateTestStorage(t, config.CacheConfig{FlushInterval: 10})
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge", "gauge", 1)))
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge2", "gauge", 1)))
+
+		backend.err = errors.New("connection refused")
+		assert.Error(t, c.FlushMetrics())
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge", "gauge", 2)))
+		assert.Equal(t, 2, c.Pending())
+
+		backend.err = nil
+		require.NoError(t, c.FlushMetrics())
+		assert.EqualValues(t, 2, *backend.Metrics["test_gauge"].Value)
+		assert.EqualValues(t, 1, *backend.Metrics["test_gauge2"].Value)
+	})
+
+	t.Run("flush by size", func(t *testing.T) {
+		c, backend := CreateTestStorage(t, config.CacheConfig{FlushInterval: 3600, FlushSize: 2})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go c.Run(ctx)
+
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge", "gauge", 1)))
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge2", "gauge", 1)))
+		assert.Eventually(t, func() bool { return len(backend.Batches()) == 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("close flushes pending changes", func(t *testing.T) {
+		c, backend := CreateTestStorage(t, config.CacheConfig{FlushInterval: 10})
+		require.NoError(t, c.SaveMetric(context.TODO(), mustMetric(t, "test_gauge", "gauge", 1)))
+		require.NoError(t, c.Close())
+		assert.Len(t, backend.Batches(), 1)
+		assert.True(t, backend.closed)
+	})
+}
+
+func TestCachedStorage_StartupRestore(t *testing.T) {
+	c, backend := CreateTestStorage(t, config.CacheConfig{FlushInterval: 10})
+	require.NoError(t, backend.MemStorage.SaveMetric(context.TODO(), mustMetric(t, "test_counter", "counter", 5)))
+	require.NoError(t, c.StartupRestore(context.TODO()))
+
+	gotMetrics, err := c.GetAllMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, gotMetrics, 1)
+	assert.Equal(t, 0, c.Pending())
+
+	_, err = c.GetMetric(context.TODO(), "test_gauge")
+	assert.ErrorIs(t, err, storage.ErrMetricNotExist)
+}
@@ -0,0 +1,286 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/retry"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorPolicy что делать при ошибке записи в дополнительное хранилище
+type ErrorPolicy string
+
+const (
+	// PolicyFail возвращает ошибку клиенту. Основное хранилище к этому моменту уже записано,
+	// поэтому ошибка оборачивает storage.ErrPartiallySaved и запрос нельзя повторять
+	PolicyFail ErrorPolicy = "fail"
+	// PolicyLog записывает ошибку в лог и продолжает работу
+	PolicyLog ErrorPolicy = "log"
+	// PolicyRetry ставит запись в очередь, которая выполняется в фоне с повторами
+	PolicyRetry ErrorPolicy = "retry"
+)
+
+// queueSize сколько записей может ждать в очереди хранилища с PolicyRetry, остальные отбрасываются
+const queueSize = 10000
+
+// Secondary дополнительное хранилище, в которое дублируются записи
+type Secondary struct {
+	Name    string
+	Storage storage.Storager
+	OnError ErrorPolicy
+}
+
+type secondary struct {
+	Secondary
+	queue   chan func(ctx context.Context) error
+	done    chan struct{}
+	errors  atomic.Int64
+	dropped atomic.Int64
+}
+
+// FanOutStorage пишет метрики в основное хранилище и во все дополнительные, а читает только из основного.
+// Нужен, например, при переезде на другое хранилище, чтобы какое-то время вести оба и сравнивать их
+type FanOutStorage struct {
+	Primary     storage.Storager
+	Logger      *zap.SugaredLogger
+	secondaries []*secondary
+	retryCfg    config.RetryConfig
+	// mu делает чтение и запись counter атомарными, если основное хранилище не умеет инкремент само
+	mu sync.Mutex
+}
+
+func NewFanOutStorage(primary storage.Storager, secondaries []Secondary, retryCfg config.RetryConfig, log *zap.SugaredLogger) *FanOutStorage {
+	f := &FanOutStorage{
+		Primary:  primary,
+		Logger:   log,
+		retryCfg: retryCfg,
+	}
+	for _, s := range secondaries {
+		sec := &secondary{Secondary: s}
+		if s.OnError == PolicyRetry {
+			sec.queue = make(chan func(ctx context.Context) error, queueSize)
+			sec.done = make(chan struct{})
+			go f.worker(sec)
+		}
+		f.secondaries = append(f.secondaries, sec)
+	}
+	return f
+}
+
+// worker выполняет записи из очереди по порядку. Запись, которая не удалась после всех повторов, отбрасывается
+func (f *FanOutStorage) worker(s *secondary) {
+	defer close(s.done)
+	for write := range s.queue {
+		retryer := retry.NewRetryer(f.Logger, f.retryCfg.RetryAttempts, time.Duration(f.retryCfg.RetryWaitTime), func(ctx context.Context) (bool, error) {
+			return false, write(ctx)
+		})
+		if err := retryer.Do(context.Background()); err != nil {
+			s.errors.Add(1)
+			s.dropped.Add(1)
+			f.Logger.Errorf("Write to the %v storage is dropped: %v", s.Name, err)
+		}
+	}
+}
+
+// write дублирует запись в дополнительные хранилища согласно их политике ошибок
+func (f *FanOutStorage) write(ctx context.Context, write func(ctx context.Context, s storage.Storager) error) error {
+	var errs []error
+	for _, s := range f.secondaries {
+		sec := s
+		if sec.OnError == PolicyRetry {
+			select {
+			case sec.queue <- func(ctx context.Context) error { return write(ctx, sec.Storage) }:
+			default:
+				sec.dropped.Add(1)
+				f.Logger.Errorf("Write queue of the %v storage is full, write is dropped", sec.Name)
+			}
+			continue
+		}
+		if err := write(ctx, sec.Storage); err != nil {
+			sec.errors.Add(1)
+			if sec.OnError == PolicyFail {
+				errs = append(errs, fmt.Errorf("%v storage: %w", sec.Name, err))
+				continue
+			}
+			f.Logger.Errorf("Error writing to the %v storage: %v", sec.Name, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", storage.ErrPartiallySaved, errors.Join(errs...))
+	}
+	return nil
+}
+
+func (f *FanOutStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
+	if err := f.Primary.SaveMetric(ctx, metric); err != nil {
+		return err
+	}
+	return f.write(ctx, func(ctx context.Context, s storage.Storager) error {
+		return s.SaveMetric(ctx, metric)
+	})
+}
+
+func (f *FanOutStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	if err := f.Primary.SaveBatchMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	return f.write(ctx, func(ctx context.Context, s storage.Storager) error {
+		return s.SaveBatchMetrics(ctx, metrics)
+	})
+}
+
+// IncrementMetrics рассчитывает итоговые значения в основном хранилище (storage.Incrementer),
+// а в дополнительные записывает уже итоговые значения, чтобы все хранилища совпадали
+func (f *FanOutStorage) IncrementMetrics(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
+	result, err := f.increment(ctx, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return result, f.write(ctx, func(ctx context.Context, s storage.Storager) error {
+		return s.SaveBatchMetrics(ctx, result)
+	})
+}
+
+// increment без storage.Incrementer читает текущие значения под mu и сохраняет итоговые одной пачкой.
+// Хранилища без Incrementer (memstorage, filestorage) записывают пачку целиком или не записывают совсем,
+// поэтому при ошибке counter не применяются частично и запрос можно повторить
+func (f *FanOutStorage) increment(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
+	if inc, ok := f.Primary.(storage.Incrementer); ok {
+		return inc.IncrementMetrics(ctx, metrics)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// итоговые значения по именам: повторяющиеся counter в пачке суммируются
+	saved := make(map[string]models.Metric, len(metrics))
+	var batch []models.Metric
+	for _, metric := range metrics {
+		current, ok := saved[metric.ID]
+		if !ok {
+			stored, err := f.Primary.GetMetric(storage.WithPrimary(ctx), metric.ID)
+			if err != nil && !errors.Is(err, storage.ErrMetricNotExist) {
+				return nil, err
+			}
+			if err == nil {
+				current, ok = *stored, true
+			}
+			batch = append(batch, metric)
+		}
+		if ok && metric.MType == models.Counter.String() && current.MType == models.Counter.String() {
+			delta := *metric.Delta + *current.Delta
+			metric.Delta = &delta
+		}
+		saved[metric.ID] = metric
+	}
+	for i := range batch {
+		batch[i] = saved[batch[i].ID]
+	}
+	if err := f.Primary.SaveBatchMetrics(ctx, batch); err != nil {
+		return nil, err
+	}
+	result := make([]models.Metric, len(metrics))
+	for i, metric := range metrics {
+		result[i] = saved[metric.ID]
+	}
+	return result, nil
+}
+
+// ReplaceAllMetrics заменяет метрики во всех хранилищах. Основное хранилище должно это поддерживать
+func (f *FanOutStorage) ReplaceAllMetrics(ctx context.Context, metrics []models.Metric) error {
+	replace := func(ctx context.Context, s storage.Storager) error {
+		replacer, ok := s.(storage.Replacer)
+		if !ok {
+			return storage.ErrReplaceNotSupported
+		}
+		return replacer.ReplaceAllMetrics(ctx, metrics)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := replace(ctx, f.Primary); err != nil {
+		return err
+	}
+	return f.write(ctx, replace)
+}
+
+func (f *FanOutStorage) GetMetric(ctx context.Context, name string) (*models.Metric, error) {
+	return f.Primary.GetMetric(ctx, name)
+}
+
+func (f *FanOutStorage) GetAllMetrics(ctx context.Context) (map[string]models.Metric, error) {
+	return f.Primary.GetAllMetrics(ctx)
+}
+
+// StartupRestore восстанавливает каждое хранилище из его собственных данных
+func (f *FanOutStorage) StartupRestore(ctx context.Context) error {
+	if err := f.Primary.StartupRestore(ctx); err != nil {
+		return err
+	}
+	for _, s := range f.secondaries {
+		if err := s.Storage.StartupRestore(ctx); err != nil {
+			return fmt.Errorf("%v storage: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+func (f *FanOutStorage) FlushMetrics() error {
+	if err := f.Primary.FlushMetrics(); err != nil {
+		return err
+	}
+	return f.write(context.Background(), func(ctx context.Context, s storage.Storager) error {
+		return s.FlushMetrics()
+	})
+}
+
+// Status проверяет основное хранилище и дополнительные с PolicyFail: без них запись метрик не работает
+func (f *FanOutStorage) Status(ctx context.Context) error {
+	if err := f.Primary.Status(ctx); err != nil {
+		return err
+	}
+	for _, s := range f.secondaries {
+		if s.OnError != PolicyFail {
+			continue
+		}
+		if err := s.Storage.Status(ctx); err != nil {
+			return fmt.Errorf("%v storage: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// RegisterStats добавляет количество ошибок и отброшенных записей дополнительных хранилищ в метрики сервера
+func (f *FanOutStorage) RegisterStats(registry *stats.Registry) {
+	for _, s := range f.secondaries {
+		sec := s
+		registry.RegisterGauge("fanout_"+sec.Name+"_errors", func() float64 { return float64(sec.errors.Load()) })
+		registry.RegisterGauge("fanout_"+sec.Name+"_dropped", func() float64 { return float64(sec.dropped.Load()) })
+		if sec.queue != nil {
+			registry.RegisterGauge("fanout_"+sec.Name+"_queued", func() float64 { return float64(len(sec.queue)) })
+		}
+	}
+}
+
+// Close дожидается выполнения очередей и закрывает все хранилища
+func (f *FanOutStorage) Close() error {
+	var errs []error
+	for _, s := range f.secondaries {
+		if s.queue != nil {
+			close(s.queue)
+			<-s.done
+		}
+		if err := s.Storage.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%v storage: %w", s.Name, err))
+		}
+	}
+	if err := f.Primary.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
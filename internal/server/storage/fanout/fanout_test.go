@@ -0,0 +1,193 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+// failingStorage memstorage, запись в который завершается ошибкой, пока fails > 0
+type failingStorage struct {
+	*memstorage.MemStorage
+	mu    sync.Mutex
+	fails int
+}
+
+func (f *failingStorage) fail() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fails > 0 {
+		f.fails--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (f *failingStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.MemStorage.SaveMetric(ctx, metric)
+}
+
+func (f *failingStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.MemStorage.SaveBatchMetrics(ctx, metrics)
+}
+
+func mustMetric(t *testing.T, name, mtype string, value any) models.Metric {
+	m, err := models.NewMetric(name, mtype, value)
+	require.NoError(t, err)
+	return m
+}
+
+func TestFanOutStorage_Write(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	retryCfg := config.RetryConfig{RetryAttempts: 2, RetryWaitTime: 1}
+	gauge := mustMetric(t, "test_gauge", "gauge", 1.5)
+
+	tests := []struct {
+		name       string
+		policy     ErrorPolicy
+		fails      int
+		wantErr    bool
+		wantSaved  bool
+		wantErrors float64
+	}{
+		{name: "successful write", policy: PolicyFail, wantSaved: true},
+		{name: "fail policy returns error", policy: PolicyFail, fails: 1, wantErr: true, wantErrors: 1},
+		{name: "log policy ignores error", policy: PolicyLog, fails: 1, wantErrors: 1},
+		{name: "retry policy writes later", policy: PolicyRetry, fails: 1, wantSaved: true},
+		{name: "retry policy drops write after all attempts", policy: PolicyRetry, fails: 3, wantErrors: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := memstorage.NewMemStorage(log)
+			secondary := &failingStorage{MemStorage: memstorage.NewMemStorage(log), fails: tt.fails}
+			f := NewFanOutStorage(primary, []Secondary{{Name: "file", Storage: secondary, OnError: tt.policy}}, retryCfg, log)
+			registry := stats.NewRegistry()
+			f.RegisterStats(registry)
+
+			err := f.SaveMetric(context.TODO(), gauge)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, storage.ErrPartiallySaved)
+			} else {
+				assert.NoError(t, err)
+			}
+			// Close дожидается выполнения очереди
+			require.NoError(t, f.Close())
+
+			assert.Equal(t, gauge, primary.Metrics["test_gauge"])
+			_, saved := secondary.Metrics["test_gauge"]
+			assert.Equal(t, tt.wantSaved, saved)
+			assert.Equal(t, tt.wantErrors, registry.Snapshot()["fanout_file_errors"])
+		})
+	}
+}
+
+func TestFanOutStorage_Read(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	primary := memstorage.NewMemStorage(log)
+	secondary := memstorage.NewMemStorage(log)
+	f := NewFanOutStorage(primary, []Secondary{{Name: "file", Storage: secondary, OnError: PolicyLog}}, config.RetryConfig{}, log)
+	require.NoError(t, secondary.SaveMetric(context.TODO(), mustMetric(t, "only_secondary", "gauge", 1)))
+	require.NoError(t, f.SaveMetric(context.TODO(), mustMetric(t, "test_gauge", "gauge", 1)))
+
+	gotMetrics, err := f.GetAllMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, gotMetrics, 1)
+	_, err = f.GetMetric(context.TODO(), "only_secondary")
+	assert.Error(t, err)
+}
+
+func TestFanOutStorage_IncrementMetrics(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	primary := memstorage.NewMemStorage(log)
+	secondary := memstorage.NewMemStorage(log)
+	f := NewFanOutStorage(primary, []Secondary{{Name: "file", Storage: secondary, OnError: PolicyFail}}, config.RetryConfig{}, log)
+	counter := mustMetric(t, "test_counter", "counter", 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := f.IncrementMetrics(context.TODO(), []models.Metric{counter})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	result, err := f.IncrementMetrics(context.TODO(), []models.Metric{counter, mustMetric(t, "test_gauge", "gauge", 1)})
+	require.NoError(t, err)
+	assert.EqualValues(t, 42, *result[0].Delta)
+	assert.EqualValues(t, 42, *primary.Metrics["test_counter"].Delta)
+	assert.EqualValues(t, 42, *secondary.Metrics["test_counter"].Delta)
+	assert.Len(t, secondary.Metrics, 2)
+}
+
+// rejectingStorage memstorage, который не записывает метрику с именем rejected. Пачка с ней не записывается целиком
+type rejectingStorage struct {
+	*memstorage.MemStorage
+	rejected string
+}
+
+func (r *rejectingStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
+	return r.SaveBatchMetrics(ctx, []models.Metric{metric})
+}
+
+func (r *rejectingStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	for _, m := range metrics {
+		if m.ID == r.rejected {
+			return errors.New("connection reset")
+		}
+	}
+	return r.MemStorage.SaveBatchMetrics(ctx, metrics)
+}
+
+func TestFanOutStorage_IncrementMetricsError(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	primary := &rejectingStorage{MemStorage: memstorage.NewMemStorage(log), rejected: "second"}
+	f := NewFanOutStorage(primary, nil, config.RetryConfig{}, log)
+	require.NoError(t, primary.MemStorage.SaveMetric(context.TODO(), mustMetric(t, "first", "counter", 10)))
+
+	batch := []models.Metric{mustMetric(t, "first", "counter", 1), mustMetric(t, "second", "counter", 2)}
+	_, err = f.IncrementMetrics(context.TODO(), batch)
+	require.Error(t, err)
+	// ни один counter пачки не применен, поэтому повтор не считает их дважды
+	assert.EqualValues(t, 10, *primary.Metrics["first"].Delta)
+	assert.NotContains(t, primary.Metrics, "second")
+
+	primary.rejected = ""
+	result, err := f.IncrementMetrics(context.TODO(), batch)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metric{mustMetric(t, "first", "counter", 11), mustMetric(t, "second", "counter", 2)}, result)
+	assert.EqualValues(t, 11, *primary.Metrics["first"].Delta)
+}
+
+func TestFanOutStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		log, err := logger.NewLogger("info")
+		require.NoError(t, err)
+		f := NewFanOutStorage(memstorage.NewMemStorage(log),
+			[]Secondary{{Name: "memory", Storage: memstorage.NewMemStorage(log), OnError: PolicyFail}}, config.RetryConfig{}, log)
+		t.Cleanup(func() { f.Close() })
+		return f
+	})
+}
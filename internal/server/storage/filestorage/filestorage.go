@@ -2,140 +2,398 @@ package filestorage
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aksenk/go-yandex-metrics/internal/models"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage/memstorage"
 	"go.uber.org/zap"
+	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
+// FsyncPolicy определяет, когда записи WAL сбрасываются на диск
+type FsyncPolicy string
+
+const (
+	// FsyncAlways fsync после каждой записи в WAL
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval fsync не чаще, чем раз в FsyncInterval. Данные при этом сразу отдаются ОС,
+	// а если после записи новых не было, fsync выполняется в фоне через FsyncInterval
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever fsync выполняется только при создании снапшота и закрытии
+	FsyncNever FsyncPolicy = "never"
+)
+
+const (
+	defaultFsyncInterval = time.Second
+	// при превышении этого размера WAL автоматически делается снапшот
+	defaultCompactSize = 64 * 1024 * 1024
+)
+
+// walFile файл WAL, открытый на дозапись (O_APPEND). В тестах подменяется, чтобы проверить ошибки записи
+type walFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// FileStorage хранит метрики в памяти, а на диске в виде снапшота (FileName) и журнала изменений (FileName.wal).
+// Каждое изменение сначала дописывается в WAL, FlushMetrics атомарно пишет снапшот и очищает WAL
 type FileStorage struct {
 	*memstorage.MemStorage
-	FileName         string
-	File             *os.File
-	Writer           *bufio.Writer
-	SynchronousFlush bool
-	FileLock         *sync.Mutex
-	Logger           *zap.SugaredLogger
+	FileName      string
+	WALName       string
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+	CompactSize   int64
+	FileLock      *sync.Mutex
+	Logger        *zap.SugaredLogger
+	wal           walFile
+	walSize       int64
+	lastSync      time.Time
+	// отложенный fsync для политики FsyncInterval, nil - несброшенных на диск записей нет
+	syncTimer *time.Timer
+	closed    bool
 }
 
 func NewFileStorage(filename string, synchronousFlush bool, logger *zap.SugaredLogger) (*FileStorage, error) {
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if filename == "" {
+		logger.Errorf("FileStorage.NewFileStorage: file name is empty")
+		return nil, fmt.Errorf("FileStorage.NewFileStorage: file name is empty")
+	}
+	walName := filename + ".wal"
+	wal, err := os.OpenFile(walName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		logger.Errorf("FileStorage.NewFileStorage: can not open file '%v': %v'", walName, err)
+		return nil, fmt.Errorf("FileStorage.NewFileStorage: can not open file '%v': %v'", walName, err)
+	}
+	info, err := wal.Stat()
 	if err != nil {
-		logger.Errorf("FileStorage.NewFileStorage: can not open file '%v': %v'", filename, err)
-		return nil, fmt.Errorf("FileStorage.NewFileStorage: can not open file '%v': %v'", filename, err)
+		wal.Close()
+		return nil, fmt.Errorf("FileStorage.NewFileStorage: can not stat file '%v': %v'", walName, err)
+	}
+	walSize, err := terminateWAL(wal, walName, info.Size())
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("FileStorage.NewFileStorage: %v", err)
+	}
+	fsync := FsyncInterval
+	if synchronousFlush {
+		fsync = FsyncAlways
 	}
 	memStorage := memstorage.NewMemStorage(logger)
 	return &FileStorage{
-		MemStorage:       memStorage,
-		File:             file,
-		FileName:         filename,
-		Writer:           bufio.NewWriter(file),
-		SynchronousFlush: synchronousFlush,
-		FileLock:         &sync.Mutex{},
-		Logger:           logger,
+		MemStorage:    memStorage,
+		FileName:      filename,
+		WALName:       walName,
+		Fsync:         fsync,
+		FsyncInterval: defaultFsyncInterval,
+		CompactSize:   defaultCompactSize,
+		FileLock:      &sync.Mutex{},
+		Logger:        logger,
+		wal:           wal,
+		walSize:       walSize,
+		lastSync:      time.Now(),
 	}, nil
 }
 
-func (f *FileStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
-	err := f.MemStorage.SaveMetric(ctx, metric)
+// terminateWAL дописывает перевод строки, если последняя запись WAL оборвана на нем (падение во время записи).
+// Иначе новые записи склеятся с последней в одну строку и следующий запуск не сможет прочитать WAL.
+// Возвращает новый размер WAL
+func terminateWAL(wal walFile, walName string, size int64) (int64, error) {
+	if size == 0 {
+		return 0, nil
+	}
+	r, err := os.Open(walName)
 	if err != nil {
-		return err
+		return size, fmt.Errorf("can not open file '%v': %v", walName, err)
 	}
-	if f.SynchronousFlush {
-		f.FlushMetrics()
+	defer r.Close()
+	last := make([]byte, 1)
+	if _, err = r.ReadAt(last, size-1); err != nil {
+		return size, fmt.Errorf("can not read file '%v': %v", walName, err)
 	}
-	return nil
+	if last[0] == '\n' {
+		return size, nil
+	}
+	n, err := wal.Write([]byte{'\n'})
+	if err != nil {
+		return size, fmt.Errorf("can not write to the WAL '%v': %v", walName, err)
+	}
+	return size + int64(n), nil
 }
 
-func (f *FileStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
-	for _, metric := range metrics {
-		err := f.MemStorage.SaveMetric(ctx, metric)
+// appendWAL дописывает метрики в WAL одним вызовом write. Вызывается под FileLock
+func (f *FileStorage) appendWAL(metrics []models.Metric) error {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		jsonMetric, err := json.Marshal(m)
 		if err != nil {
-			return err
+			return fmt.Errorf("FileStorage.appendWAL: can not marshal metric '%v': %v", m, err)
 		}
+		buf.Write(jsonMetric)
+		buf.WriteByte('\n')
+	}
+	n, err := f.wal.Write(buf.Bytes())
+	if err != nil {
+		f.Logger.Errorf("Сan not write to the WAL '%v': %v", f.WALName, err)
+		// оборванная запись в середине WAL не дала бы восстановиться при следующем запуске, поэтому ее надо отрезать.
+		// Файл открыт с O_APPEND, следующая запись пойдет сразу за обрезанным концом
+		if n > 0 {
+			if truncErr := f.wal.Truncate(f.walSize); truncErr != nil {
+				f.walSize += int64(n)
+				f.Logger.Errorf("Сan not truncate torn record of the WAL '%v': %v", f.WALName, truncErr)
+			}
+		}
+		return fmt.Errorf("FileStorage.appendWAL: can not write to the WAL '%v': %v", f.WALName, err)
+	}
+	f.walSize += int64(n)
+	switch f.Fsync {
+	case FsyncAlways:
+		err = f.wal.Sync()
+	case FsyncInterval:
+		if wait := f.FsyncInterval - time.Since(f.lastSync); wait <= 0 {
+			err = f.wal.Sync()
+			f.lastSync = time.Now()
+		} else if f.syncTimer == nil {
+			f.syncTimer = time.AfterFunc(wait, f.delayedSync)
+		}
+	}
+	if err != nil {
+		f.Logger.Errorf("Сan not sync the WAL '%v': %v", f.WALName, err)
+		return fmt.Errorf("FileStorage.appendWAL: can not sync the WAL '%v': %v", f.WALName, err)
+	}
+	return nil
+}
+
+// delayedSync сбрасывает на диск записи WAL, после которых не было новых записей
+func (f *FileStorage) delayedSync() {
+	f.FileLock.Lock()
+	defer f.FileLock.Unlock()
+	f.syncTimer = nil
+	if f.closed {
+		return
+	}
+	if err := f.wal.Sync(); err != nil {
+		f.Logger.Errorf("Сan not sync the WAL '%v': %v", f.WALName, err)
+		return
+	}
+	f.lastSync = time.Now()
+}
+
+func (f *FileStorage) save(ctx context.Context, metrics []models.Metric) error {
+	f.FileLock.Lock()
+	defer f.FileLock.Unlock()
+	if err := f.appendWAL(metrics); err != nil {
+		return err
+	}
+	if err := f.MemStorage.SaveBatchMetrics(ctx, metrics); err != nil {
+		return err
 	}
-	if f.SynchronousFlush {
-		f.FlushMetrics()
+	if f.CompactSize > 0 && f.walSize >= f.CompactSize {
+		f.Logger.Infof("WAL size exceeded %v bytes, writing snapshot", f.CompactSize)
+		return f.snapshot()
 	}
 	return nil
 }
 
-func (f *FileStorage) StartupRestore(ctx context.Context) error {
-	counter := 0
-	f.Logger.Infof("Restoring metrics from a file '%v'", f.FileName)
-	// saving current state of SynchronousFlush because we need to disable it for startup restoring
-	sf := f.SynchronousFlush
-	f.SynchronousFlush = false
-	file, err := os.OpenFile(f.FileName, os.O_RDONLY|os.O_CREATE, 0660)
+func (f *FileStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
+	return f.save(ctx, []models.Metric{metric})
+}
+
+func (f *FileStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return f.save(ctx, metrics)
+}
+
+// restoreFile загружает метрики из файла в память. Если tolerateTorn, то неполная последняя запись
+// (например после падения во время записи) отбрасывается и возвращается длина корректной части файла
+func (f *FileStorage) restoreFile(ctx context.Context, fileName string, tolerateTorn bool) (counter int, validSize int64, err error) {
+	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0660)
 	if err != nil {
-		return fmt.Errorf("can not openfile: %v", err)
+		return 0, 0, fmt.Errorf("can not openfile: %v", err)
 	}
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var metric *models.Metric
-		counter++
-		line := scanner.Bytes()
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) == 0 && errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return counter, validSize, fmt.Errorf("FileStorage.restoreMetrics: can not read file '%v': %v", fileName, readErr)
+		}
+		var metric models.Metric
 		f.Logger.Debugf("Proccessing line: %v", string(line))
 		if err := json.Unmarshal(line, &metric); err != nil {
+			// битой может быть только последняя запись, которую не успели дописать целиком
+			if tolerateTorn {
+				if _, peekErr := reader.Peek(1); errors.Is(peekErr, io.EOF) {
+					f.Logger.Warnf("FileStorage.restoreMetrics: dropping torn last record of '%v': %v", fileName, string(line))
+					return counter, validSize, nil
+				}
+			}
 			f.Logger.Errorf("FileStorage.restoreMetrics: can not unmarshal metric. Error: %v. Line: %v", err, line)
-			return fmt.Errorf("FileStorage.restoreMetrics: can not unmarshal metric. Error: %v. Line: %v", err, line)
+			return counter, validSize, fmt.Errorf("FileStorage.restoreMetrics: can not unmarshal metric. Error: %v. Line: %v", err, line)
 		}
-		if err := f.SaveMetric(ctx, *metric); err != nil {
+		if err := f.MemStorage.SaveMetric(ctx, metric); err != nil {
 			f.Logger.Errorf("FileStorage.restoreMetrics: can not restore metric '%v': %v", metric, err)
-			return fmt.Errorf("FileStorage.restoreMetrics: can not restore metric '%v': %v", metric, err)
+			return counter, validSize, fmt.Errorf("FileStorage.restoreMetrics: can not restore metric '%v': %v", metric, err)
+		}
+		counter++
+		validSize += int64(len(line))
+		if errors.Is(readErr, io.EOF) {
+			break
 		}
 	}
-	if scanner.Err() != nil {
-		f.Logger.Errorf("FileStorage.restoreMetrics: can not restore metrics from the FileName: %v", scanner.Err())
-		return fmt.Errorf("ileStorage.restoreMetrics: can not restore metrics from the FileName: %v", scanner.Err())
+	return counter, validSize, nil
+}
+
+// StartupRestore загружает снапшот и применяет к нему хвост WAL
+func (f *FileStorage) StartupRestore(ctx context.Context) error {
+	f.FileLock.Lock()
+	defer f.FileLock.Unlock()
+
+	f.Logger.Infof("Restoring metrics from a file '%v'", f.FileName)
+	counter, _, err := f.restoreFile(ctx, f.FileName, false)
+	if err != nil {
+		return err
 	}
 	f.Logger.Infof("Successfully restored %v metrics from a file", counter)
-	// restoring state of SynchronousFlush
-	f.SynchronousFlush = sf
+
+	f.Logger.Infof("Replaying WAL '%v'", f.WALName)
+	counter, validSize, err := f.restoreFile(ctx, f.WALName, true)
+	if err != nil {
+		return err
+	}
+	if validSize < f.walSize {
+		f.Logger.Warnf("Truncating WAL '%v' from %v to %v bytes", f.WALName, f.walSize, validSize)
+		if err = f.wal.Truncate(validSize); err != nil {
+			return fmt.Errorf("FileStorage.StartupRestore: can not truncate WAL '%v': %v", f.WALName, err)
+		}
+		f.walSize = validSize
+	}
+	f.Logger.Infof("Successfully replayed %v WAL records", counter)
 	return nil
 }
 
-func (f *FileStorage) FlushMetrics() error {
+// snapshot пишет все метрики во временный файл, атомарно переименовывает его в FileName и очищает WAL.
+// Вызывается под FileLock, поэтому между снапшотом и очисткой WAL изменения потеряться не могут
+func (f *FileStorage) snapshot() error {
 	counter := 0
 	f.Logger.Debug("Start collecting metrics for flushing to the file")
-	for _, v := range f.Metrics {
+	all, err := f.MemStorage.GetAllMetrics(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.FileName), filepath.Base(f.FileName)+".tmp-*")
+	if err != nil {
+		f.Logger.Errorf("Сan not create temporary file for '%v': %v", f.FileName, err)
+		return fmt.Errorf("FileStorage.FlushMetrics: can not create temporary file: %v", err)
+	}
+	// после успешного переименования удалять уже нечего
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, v := range all {
 		jsonMetric, err := json.Marshal(v)
 		if err != nil {
-			f.Logger.Errorf("Сan not marsgal metric '%v': %v", v, err)
+			tmp.Close()
+			f.Logger.Errorf("Сan not marshal metric '%v': %v", v, err)
 			return fmt.Errorf("FileStorage.FlushMetrics: can not marshal metric '%v': %v", v, err)
 		}
 		jsonMetric = append(jsonMetric, '\n')
-		_, err = f.Writer.Write(jsonMetric)
-		if err != nil {
+		if _, err = writer.Write(jsonMetric); err != nil {
+			tmp.Close()
 			f.Logger.Errorf("Сan not write metric '%v' to the file: %v", v, err)
 			return fmt.Errorf("FileStorage.FlushMetrics: can not write metric '%v' to the file: %v", v, err)
 		}
 		counter++
 	}
 	f.Logger.Debugf("Start saving %v metrics to the file", counter)
-	f.FileLock.Lock()
-	err := f.File.Truncate(0)
-	if err != nil {
-		f.Logger.Errorf("Сan not truncate file '%v': %v", f.FileName, err)
+	if err = writer.Flush(); err != nil {
+		tmp.Close()
+		f.Logger.Errorf("Сan not flush file '%v': %v", tmp.Name(), err)
 		return err
 	}
-	err = f.Writer.Flush()
-	if err != nil {
-		f.Logger.Errorf("Сan not flush file '%v': %v", f.FileName, err)
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		f.Logger.Errorf("Сan not sync file '%v': %v", tmp.Name(), err)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), f.FileName); err != nil {
+		f.Logger.Errorf("Сan not rename '%v' to '%v': %v", tmp.Name(), f.FileName, err)
+		return err
+	}
+	syncDir(filepath.Dir(f.FileName))
+
+	// снапшот на диске, теперь WAL можно очистить
+	if err = f.wal.Truncate(0); err != nil {
+		f.Logger.Errorf("Сan not truncate WAL '%v': %v", f.WALName, err)
+		return err
+	}
+	if err = f.wal.Sync(); err != nil {
 		return err
 	}
-	f.FileLock.Unlock()
-	f.Logger.Info("Metrics successfully saved")
+	f.walSize = 0
+	f.lastSync = time.Now()
+	f.Logger.Infof("Metrics successfully saved (%v metrics)", counter)
 	return nil
 }
 
+// syncDir фиксирует переименование файла в директории. Ошибки игнорируются: не все ФС это поддерживают
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// ReplaceAllMetrics заменяет метрики в памяти и сразу записывает снапшот, WAL при этом очищается
+func (f *FileStorage) ReplaceAllMetrics(ctx context.Context, metrics []models.Metric) error {
+	f.FileLock.Lock()
+	defer f.FileLock.Unlock()
+	if err := f.MemStorage.ReplaceAllMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	return f.snapshot()
+}
+
+// FlushMetrics делает снапшот всех метрик и очищает WAL
+func (f *FileStorage) FlushMetrics() error {
+	f.FileLock.Lock()
+	defer f.FileLock.Unlock()
+	return f.snapshot()
+}
+
 func (f *FileStorage) Close() error {
-	return f.File.Close()
+	f.FileLock.Lock()
+	defer f.FileLock.Unlock()
+	if f.syncTimer != nil {
+		f.syncTimer.Stop()
+		f.syncTimer = nil
+	}
+	f.closed = true
+	if err := f.wal.Sync(); err != nil {
+		f.wal.Close()
+		return err
+	}
+	return f.wal.Close()
 }
 
 func (f *FileStorage) Status(ctx context.Context) error {
@@ -4,12 +4,18 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
 	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/storagetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNewFileStorage(t *testing.T) {
@@ -55,6 +61,7 @@ func TestNewFileStorage(t *testing.T) {
 			var got any
 			var err error
 			defer os.RemoveAll(tt.args.filename)
+			defer os.RemoveAll(tt.args.filename + ".wal")
 			got, err = NewFileStorage(tt.args.filename, tt.args.synchronousFlush, logger)
 			if tt.wantErr {
 				require.Error(t, err)
@@ -292,6 +299,7 @@ func TestFileStorageSaveMetric(t *testing.T) {
 	}
 	logger, err := logger.NewLogger("info")
 	require.NoError(t, err)
+	defer os.RemoveAll("./test-storage.wal")
 	for _, tt := range tests {
 		s, err := NewFileStorage(tt.args.filename, tt.args.synchronousFlush, logger)
 		require.NoError(t, err)
@@ -356,6 +364,7 @@ func TestFileStorage_FlushMetrics(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			defer os.RemoveAll(tt.args.filename)
+			defer os.RemoveAll(tt.args.filename + ".wal")
 			var err error
 
 			s, err := NewFileStorage(tt.args.filename, tt.args.synchronousFlush, logger)
@@ -459,6 +468,7 @@ func TestFileStorage_StartupRestore(t *testing.T) {
 			err := os.RemoveAll(tt.args.filename)
 			require.NoError(t, err)
 			defer os.RemoveAll(tt.args.filename)
+			defer os.RemoveAll(tt.args.filename + ".wal")
 
 			f, err := os.OpenFile(tt.args.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 			require.NoError(t, err)
@@ -485,3 +495,220 @@ func TestFileStorage_StartupRestore(t *testing.T) {
 		})
 	}
 }
+
+func TestFileStorage_WAL(t *testing.T) {
+	snapshot := `{"id":"test_counter","type":"counter","delta":10}
+{"id":"test_gauge","type":"gauge","value":1.123}
+`
+	tests := []struct {
+		name       string
+		wal        string
+		wantCount  int64
+		wantGauge  float64
+		wantWALLen int
+		wantErr    bool
+	}{
+		{
+			name:       "successful test: replay wal tail",
+			wal:        "{\"id\":\"test_counter\",\"type\":\"counter\",\"delta\":15}\n{\"id\":\"test_gauge\",\"type\":\"gauge\",\"value\":2}\n",
+			wantCount:  15,
+			wantGauge:  2,
+			wantWALLen: 95,
+		},
+		{
+			name:       "successful test: torn last record",
+			wal:        "{\"id\":\"test_counter\",\"type\":\"counter\",\"delta\":15}\n{\"id\":\"test_gauge\",\"type\":\"ga",
+			wantCount:  15,
+			wantGauge:  1.123,
+			wantWALLen: 50,
+		},
+		{
+			name:    "unsuccessful test: corrupted record in the middle",
+			wal:     "{\"id\":\"test_counter\",\"ty\n{\"id\":\"test_gauge\",\"type\":\"gauge\",\"value\":2}\n",
+			wantErr: true,
+		},
+	}
+	logger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "storage.json")
+			require.NoError(t, os.WriteFile(filename, []byte(snapshot), 0644))
+			require.NoError(t, os.WriteFile(filename+".wal", []byte(tt.wal), 0644))
+
+			s, err := NewFileStorage(filename, true, logger)
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.StartupRestore(context.TODO())
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCount, *s.Metrics["test_counter"].Delta)
+			assert.Equal(t, tt.wantGauge, *s.Metrics["test_gauge"].Value)
+
+			info, err := os.Stat(filename + ".wal")
+			require.NoError(t, err)
+			assert.Equal(t, int64(tt.wantWALLen), info.Size())
+		})
+	}
+
+	t.Run("successful test: append after unterminated last record", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "storage.json")
+		require.NoError(t, os.WriteFile(filename+".wal", []byte("{\"id\":\"test_counter\",\"type\":\"counter\",\"delta\":15}"), 0644))
+		s, err := NewFileStorage(filename, true, logger)
+		require.NoError(t, err)
+		require.NoError(t, s.StartupRestore(context.TODO()))
+		assert.Equal(t, int64(15), *s.Metrics["test_counter"].Delta)
+		m, err := models.NewMetric("test_gauge", "gauge", 2)
+		require.NoError(t, err)
+		require.NoError(t, s.SaveMetric(context.TODO(), m))
+		require.NoError(t, s.Close())
+
+		restored, err := NewFileStorage(filename, true, logger)
+		require.NoError(t, err)
+		defer restored.Close()
+		require.NoError(t, restored.StartupRestore(context.TODO()))
+		assert.Equal(t, int64(15), *restored.Metrics["test_counter"].Delta)
+		assert.Equal(t, float64(2), *restored.Metrics["test_gauge"].Value)
+	})
+
+	t.Run("successful test: updates survive restart and flush truncates wal", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "storage.json")
+		s, err := NewFileStorage(filename, true, logger)
+		require.NoError(t, err)
+		m, err := models.NewMetric("test_gauge", "gauge", 3.5)
+		require.NoError(t, err)
+		require.NoError(t, s.SaveMetric(context.TODO(), m))
+		// без Close и FlushMetrics, как при падении процесса
+		restored, err := NewFileStorage(filename, true, logger)
+		require.NoError(t, err)
+		require.NoError(t, restored.StartupRestore(context.TODO()))
+		assert.Equal(t, 3.5, *restored.Metrics["test_gauge"].Value)
+
+		require.NoError(t, restored.FlushMetrics())
+		info, err := os.Stat(filename + ".wal")
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), info.Size())
+		require.NoError(t, restored.Close())
+		require.NoError(t, s.Close())
+
+		restored, err = NewFileStorage(filename, true, logger)
+		require.NoError(t, err)
+		defer restored.Close()
+		require.NoError(t, restored.StartupRestore(context.TODO()))
+		assert.Equal(t, 3.5, *restored.Metrics["test_gauge"].Value)
+	})
+}
+
+// failingWAL записывает в WAL только limit байт и возвращает ошибку, как при нехватке места на диске
+type failingWAL struct {
+	walFile
+	limit int
+}
+
+func (w *failingWAL) Write(p []byte) (int, error) {
+	n, _ := w.walFile.Write(p[:min(len(p), w.limit)])
+	return n, errors.New("no space left on device")
+}
+
+// syncCountingWAL считает вызовы Sync
+type syncCountingWAL struct {
+	walFile
+	syncs atomic.Int32
+}
+
+func (w *syncCountingWAL) Sync() error {
+	w.syncs.Add(1)
+	return w.walFile.Sync()
+}
+
+func TestFileStorage_WALWriteError(t *testing.T) {
+	logger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	s, err := NewFileStorage(filename, true, logger)
+	require.NoError(t, err)
+	first, err := models.NewMetric("test_counter", "counter", 5)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), first))
+
+	wal := s.wal
+	s.wal = &failingWAL{walFile: wal, limit: 10}
+	failed, err := models.NewMetric("test_gauge", "gauge", 1)
+	require.NoError(t, err)
+	require.Error(t, s.SaveMetric(context.TODO(), failed))
+	s.wal = wal
+
+	second, err := models.NewMetric("test_counter", "counter", 3)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), second))
+	require.NoError(t, s.Close())
+
+	info, err := os.Stat(filename + ".wal")
+	require.NoError(t, err)
+	assert.Equal(t, s.walSize, info.Size())
+
+	restored, err := NewFileStorage(filename, true, logger)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.StartupRestore(context.TODO()))
+	assert.Equal(t, int64(3), *restored.Metrics["test_counter"].Delta)
+	assert.NotContains(t, restored.Metrics, "test_gauge")
+}
+
+func TestFileStorage_FsyncIntervalIdle(t *testing.T) {
+	logger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	s, err := NewFileStorage(filepath.Join(t.TempDir(), "storage.json"), false, logger)
+	require.NoError(t, err)
+	defer s.Close()
+	s.FsyncInterval = 50 * time.Millisecond
+	wal := &syncCountingWAL{walFile: s.wal}
+	s.wal = wal
+
+	m, err := models.NewMetric("test_gauge", "gauge", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), m))
+	require.NoError(t, s.SaveMetric(context.TODO(), m))
+	assert.Zero(t, wal.syncs.Load())
+	// новых записей нет, но WAL все равно сбрасывается на диск
+	assert.Eventually(t, func() bool { return wal.syncs.Load() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestFileStorage_ReplaceAllMetrics(t *testing.T) {
+	logger, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "storage.json")
+	s, err := NewFileStorage(filename, true, logger)
+	require.NoError(t, err)
+	old, err := models.NewMetric("old_counter", "counter", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), old))
+	gauge, err := models.NewMetric("test_gauge", "gauge", 1.5)
+	require.NoError(t, err)
+
+	require.NoError(t, s.ReplaceAllMetrics(context.TODO(), []models.Metric{gauge}))
+	info, err := os.Stat(filename + ".wal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	require.NoError(t, s.Close())
+
+	restored, err := NewFileStorage(filename, true, logger)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.StartupRestore(context.TODO()))
+	assert.Equal(t, map[string]models.Metric{"test_gauge": gauge}, restored.Metrics)
+}
+
+func TestFileStorage_Conformance(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		s, err := NewFileStorage(filepath.Join(t.TempDir(), "metrics.json"), true, log)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
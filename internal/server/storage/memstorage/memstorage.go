@@ -5,6 +5,7 @@ import (
 	"github.com/aksenk/go-yandex-metrics/internal/models"
 	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
 	"go.uber.org/zap"
+	"maps"
 	"sync"
 )
 
@@ -37,6 +38,17 @@ func (s *MemStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metr
 	return nil
 }
 
+func (s *MemStorage) ReplaceAllMetrics(ctx context.Context, metrics []models.Metric) error {
+	replaced := make(map[string]models.Metric, len(metrics))
+	for _, metric := range metrics {
+		replaced[metric.ID] = metric
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Metrics = replaced
+	return nil
+}
+
 func (s *MemStorage) GetMetric(ctx context.Context, name string) (*models.Metric, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -46,10 +58,11 @@ func (s *MemStorage) GetMetric(ctx context.Context, name string) (*models.Metric
 	return &models.Metric{}, storage.ErrMetricNotExist
 }
 
+// GetAllMetrics возвращает копию метрик, чтобы вызывающий мог читать ее без блокировки хранилища
 func (s *MemStorage) GetAllMetrics(ctx context.Context) (map[string]models.Metric, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.Metrics, nil
+	return maps.Clone(s.Metrics), nil
 }
 
 func (s *MemStorage) FlushMetrics() error {
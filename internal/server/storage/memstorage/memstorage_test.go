@@ -4,6 +4,8 @@ import (
 	"context"
 	"github.com/aksenk/go-yandex-metrics/internal/logger"
 	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/storagetest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"sync"
@@ -299,3 +301,30 @@ func TestMemStorage_GetAllMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestMemStorage_GetAllMetricsCopy(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	s := NewMemStorage(log)
+	gauge, err := models.NewMetric("test_metric", "gauge", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), gauge))
+
+	got, err := s.GetAllMetrics(context.TODO())
+	require.NoError(t, err)
+	delete(got, "test_metric")
+	counter, err := models.NewMetric("test_metric2", "counter", 1)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveMetric(context.TODO(), counter))
+
+	assert.Len(t, got, 0)
+	assert.Len(t, s.Metrics, 2)
+}
+
+func TestMemStorage_Conformance(t *testing.T) {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		return NewMemStorage(log)
+	})
+}
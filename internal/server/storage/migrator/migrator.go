@@ -0,0 +1,116 @@
+package migrator
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"go.uber.org/zap"
+)
+
+// DriverFunc создает драйвер golang-migrate для соединения с базой
+type DriverFunc func(conn *sql.DB) (database.Driver, error)
+
+// Migrator выполняет миграции из каталога migrationsDir и хранит состояние базы после последнего действия
+type Migrator struct {
+	conn          *sql.DB
+	logger        *zap.SugaredLogger
+	databaseName  string
+	newDriver     DriverFunc
+	migrationsDir string
+	state         MigrationStatus
+}
+
+type MigrationStatus struct {
+	version uint
+	dirty   bool
+	err     error
+}
+
+func New(conn *sql.DB, databaseName string, newDriver DriverFunc, migrationsDir string, log *zap.SugaredLogger) *Migrator {
+	return &Migrator{
+		conn:          conn,
+		logger:        log,
+		databaseName:  databaseName,
+		newDriver:     newDriver,
+		migrationsDir: migrationsDir,
+	}
+}
+
+func (m *Migrator) Err() error {
+	return m.state.err
+}
+
+func (m *Migrator) Dirty() bool {
+	return m.state.dirty
+}
+
+func (m *Migrator) Version() uint {
+	return m.state.version
+}
+
+// Run применяет все новые миграции
+func (m *Migrator) Run() {
+	m.Up()
+}
+
+// Up применяет все новые миграции. Отсутствие новых миграций не считается ошибкой
+func (m *Migrator) Up() error {
+	return m.do(func(migration *migrate.Migrate) error {
+		return migration.Up()
+	})
+}
+
+// Down откатывает steps последних миграций
+func (m *Migrator) Down(steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("count of migrations to roll back must be greather than zero")
+	}
+	return m.do(func(migration *migrate.Migrate) error {
+		return migration.Steps(-steps)
+	})
+}
+
+// Force записывает версию без выполнения миграций и снимает признак dirty.
+// Нужен, чтобы вручную исправить состояние после упавшей миграции
+func (m *Migrator) Force(version int) error {
+	return m.do(func(migration *migrate.Migrate) error {
+		return migration.Force(version)
+	})
+}
+
+// Status читает текущую версию и признак dirty без выполнения миграций
+func (m *Migrator) Status() error {
+	return m.do(func(migration *migrate.Migrate) error {
+		return nil
+	})
+}
+
+// do выполняет действие с миграциями и сохраняет итоговое состояние базы (Version, Dirty, Err).
+// При ошибке действия сохраняются версия и признак dirty, на которых миграции остановились
+func (m *Migrator) do(action func(migration *migrate.Migrate) error) error {
+	driver, err := m.newDriver(m.conn)
+	if err != nil {
+		m.state = MigrationStatus{version: 0, dirty: false, err: err}
+		return err
+	}
+	migration, err := migrate.NewWithDatabaseInstance("file://"+m.migrationsDir, m.databaseName, driver)
+	if err != nil {
+		m.state = MigrationStatus{version: 0, dirty: false, err: err}
+		return err
+	}
+	if err = action(migration); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		v, d, _ := migration.Version()
+		m.state = MigrationStatus{version: v, dirty: d, err: err}
+		return err
+	}
+	v, d, err := migration.Version()
+	// в пустой базе версии еще нет
+	if errors.Is(err, migrate.ErrNilVersion) {
+		err = nil
+	}
+	m.state = MigrationStatus{version: v, dirty: d, err: err}
+	return err
+}
@@ -0,0 +1,60 @@
+package migrator
+
+import (
+	"database/sql"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestMigrator(t *testing.T, migrations map[string]string) *Migrator {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	for name, query := range migrations {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(query), 0644))
+	}
+	conn, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return New(conn, "sqlite", func(conn *sql.DB) (database.Driver, error) {
+		return sqlite.WithInstance(conn, &sqlite.Config{})
+	}, dir, log)
+}
+
+func TestMigrator(t *testing.T) {
+	t.Run("empty database", func(t *testing.T) {
+		m := newTestMigrator(t, map[string]string{"000001_test.up.sql": "CREATE TABLE test (id INTEGER);"})
+		require.NoError(t, m.Status())
+		assert.Equal(t, uint(0), m.Version())
+		assert.False(t, m.Dirty())
+
+		m.Run()
+		require.NoError(t, m.Err())
+		assert.Equal(t, uint(1), m.Version())
+
+		require.NoError(t, m.Down(1))
+		assert.Equal(t, uint(0), m.Version())
+	})
+
+	t.Run("failed migration keeps version and dirty status", func(t *testing.T) {
+		m := newTestMigrator(t, map[string]string{
+			"000001_test.up.sql": "CREATE TABLE test (id INTEGER);",
+			"000002_test.up.sql": "CREATE TABLE test (id INTEGER);",
+		})
+		require.Error(t, m.Up())
+		assert.Error(t, m.Err())
+		assert.Equal(t, uint(2), m.Version())
+		assert.True(t, m.Dirty())
+
+		require.NoError(t, m.Force(1))
+		assert.Equal(t, uint(1), m.Version())
+		assert.False(t, m.Dirty())
+	})
+}
@@ -0,0 +1,69 @@
+package postgres
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/retry"
+	"github.com/aksenk/go-yandex-metrics/internal/server/audit"
+	"time"
+)
+
+// AuditSink хранит аудит лог в таблице server.audit, используя соединение PostgresStorage
+type AuditSink struct {
+	storage *PostgresStorage
+}
+
+func NewAuditSink(p *PostgresStorage) *AuditSink {
+	return &AuditSink{storage: p}
+}
+
+func (a *AuditSink) Write(ctx context.Context, entries []audit.Entry) error {
+	p := a.storage
+	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
+		tx, err := p.Conn.Begin(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer tx.Rollback(ctx)
+		for _, e := range entries {
+			_, err = tx.Exec(ctx, "INSERT INTO server.audit "+
+				"(time, client_ip, key_id, metric_id, type, old_type, old_value, new_value, deleted) "+
+				"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+				e.Time, e.ClientIP, e.KeyID, e.MetricID, e.MType, e.OldType, e.OldValue, e.NewValue, e.Deleted)
+			if err != nil {
+				return false, err
+			}
+		}
+		return false, tx.Commit(ctx)
+	})
+	return retryer.Do(ctx)
+}
+
+func (a *AuditSink) Query(ctx context.Context, filter audit.Filter) ([]audit.Entry, error) {
+	p := a.storage
+	var entries []audit.Entry
+	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
+		entries = nil
+		rows, err := p.Conn.Query(ctx, "SELECT time, client_ip, key_id, metric_id, type, old_type, old_value, new_value, deleted "+
+			"FROM server.audit WHERE ($1 = '' OR metric_id = $1) AND ($2 = '' OR client_ip = $2 OR key_id = $2) "+
+			"ORDER BY id DESC LIMIT $3",
+			filter.MetricID, filter.Client, filter.Limit)
+		if err != nil {
+			return false, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var e audit.Entry
+			if err = rows.Scan(&e.Time, &e.ClientIP, &e.KeyID, &e.MetricID, &e.MType, &e.OldType, &e.OldValue, &e.NewValue, &e.Deleted); err != nil {
+				return true, err
+			}
+			entries = append(entries, e)
+		}
+		return false, rows.Err()
+	})
+	return entries, retryer.Do(ctx)
+}
+
+// Close соединение принадлежит PostgresStorage и закрывается вместе с ним
+func (a *AuditSink) Close() error {
+	return nil
+}
@@ -4,136 +4,423 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/aksenk/go-yandex-metrics/internal/models"
 	"github.com/aksenk/go-yandex-metrics/internal/retry"
+	"github.com/aksenk/go-yandex-metrics/internal/server/auth"
 	"github.com/aksenk/go-yandex-metrics/internal/server/config"
-	"github.com/golang-migrate/migrate/v4"
+	"github.com/aksenk/go-yandex-metrics/internal/server/stats"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/migrator"
+	"github.com/golang-migrate/migrate/v4/database"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 	"go.uber.org/zap"
 	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-type Migrator struct {
-	conn          *sql.DB
-	logger        *zap.SugaredLogger
-	cfg           *config.Config
-	migrationsDir string
-	state         MigrationStatus
+// Migrator мигратор схемы server в PostgreSQL
+type Migrator = migrator.Migrator
+
+func NewMigrator(conn *sql.DB, cfg *config.Config, log *zap.SugaredLogger) *Migrator {
+	return migrator.New(conn, "postgres", func(conn *sql.DB) (database.Driver, error) {
+		return postgres.WithInstance(conn, &postgres.Config{})
+	}, cfg.PostgresStorage.MigrationsDir, log)
 }
 
-type MigrationStatus struct {
-	version uint
-	dirty   bool
-	err     error
+// PgxConn методы pgxpool.Pool, которые использует хранилище (в тестах подменяется на pgxmock)
+type PgxConn interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Ping(ctx context.Context) error
+	Close()
 }
 
-func NewMigrator(conn *sql.DB, cfg *config.Config, log *zap.SugaredLogger) *Migrator {
-	return &Migrator{
-		conn:          conn,
-		logger:        log,
-		cfg:           cfg,
-		migrationsDir: cfg.PostgresStorage.MigrationsDir,
-	}
+const (
+	saveMetricQuery = "INSERT INTO server.metrics (name, type, value, delta) " +
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (name) DO UPDATE SET type=$2, value=$3, delta=$4"
+	getMetricQuery     = "SELECT name, type, value, delta FROM server.metrics WHERE name = $1"
+	getAllMetricsQuery = "SELECT name, type, value, delta FROM server.metrics"
+	deleteMetricsQuery = "DELETE FROM server.metrics"
+	lookupTokenQuery   = "SELECT id, hash, scopes FROM server.tokens WHERE hash = $1"
+)
+
+// preparedQueries запросы, которые подготавливаются на каждом соединении пула.
+// Имя подготовленного запроса совпадает с его текстом, поэтому pgx использует его автоматически
+var preparedQueries = []string{
+	saveMetricQuery,
+	getMetricQuery,
+	getAllMetricsQuery,
+	lookupTokenQuery,
+	incrementMetricQuery,
 }
 
-func (m *Migrator) Err() error {
-	return m.state.err
+// replicaQueries запросы, которые подготавливаются на соединениях реплик: на них выполняется только чтение
+var replicaQueries = []string{
+	getMetricQuery,
+	getAllMetricsQuery,
 }
 
-func (m *Migrator) Dirty() bool {
-	return m.state.dirty
+// replica реплика для чтения метрик. Недоступная реплика исключается из выборки до следующей успешной проверки в Status
+type replica struct {
+	conn    PgxConn
+	host    string
+	healthy atomic.Bool
 }
 
-func (m *Migrator) Version() uint {
-	return m.state.version
+type PostgresStorage struct {
+	Conn   PgxConn
+	Pool   *pgxpool.Pool
+	Logger *zap.SugaredLogger
+	cfg    *config.Config
+	// реплики для GetMetric и GetAllMetrics, выбираются по кругу
+	replicas []*replica
+	next     atomic.Uint32
 }
 
-func (m *Migrator) Run() {
-	driver, err := postgres.WithInstance(m.conn, &postgres.Config{})
+// poolConfig переносит настройки пула из конфига. Нулевые периоды оставляют значения pgx по умолчанию
+func poolConfig(cfg config.PostgresConfig, dsn string, queries []string) (*pgxpool.Config, error) {
+	poolCfg, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
-		m.state = MigrationStatus{version: 0, dirty: false, err: err}
-		return
+		return nil, err
 	}
-	migration, err := migrate.NewWithDatabaseInstance("file://"+m.migrationsDir, "postgres", driver)
-	if err != nil {
-		m.state = MigrationStatus{version: 0, dirty: false, err: err}
-		return
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = int32(cfg.MaxConns)
 	}
-	if err = migration.Up(); err != nil {
-		if !errors.Is(err, migrate.ErrNoChange) {
-			m.state = MigrationStatus{version: 0, dirty: false, err: err}
-			return
+	poolCfg.MinConns = int32(cfg.MinConns)
+	if cfg.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = time.Duration(cfg.MaxConnLifetime) * time.Second
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = time.Duration(cfg.MaxConnIdleTime) * time.Second
+	}
+	if cfg.HealthCheckPeriod > 0 {
+		poolCfg.HealthCheckPeriod = time.Duration(cfg.HealthCheckPeriod) * time.Second
+	}
+	poolCfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		for _, query := range queries {
+			if _, err := conn.Prepare(ctx, query, query); err != nil {
+				return fmt.Errorf("can not prepare statement '%v': %w", query, err)
+			}
 		}
+		return nil
 	}
-	v, d, e := migration.Version()
-	m.state = MigrationStatus{version: v, dirty: d, err: e}
-}
-
-type PostgresStorage struct {
-	Conn   *sql.DB
-	Logger *zap.SugaredLogger
-	cfg    *config.Config
+	return poolCfg, nil
 }
 
+// NewPostgresStorage создает пул соединений. Соединения открываются при первом запросе,
+// поэтому миграции нужно выполнить через OpenDB до первого обращения к хранилищу
 func NewPostgresStorage(cfg *config.Config, log *zap.SugaredLogger) (*PostgresStorage, error) {
-	db, err := sql.Open("pgx", cfg.PostgresStorage.DSN)
+	poolCfg, err := poolConfig(cfg.PostgresStorage, cfg.PostgresStorage.DSN, preparedQueries)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
 	if err != nil {
 		return nil, err
 	}
-	return &PostgresStorage{
-		Conn:   db,
+	p := &PostgresStorage{
+		Conn:   pool,
+		Pool:   pool,
 		Logger: log,
 		cfg:    cfg,
-	}, nil
+	}
+	for i, dsn := range cfg.PostgresStorage.ReplicaDSNs {
+		replicaCfg, err := poolConfig(cfg.PostgresStorage, dsn, replicaQueries)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("replica #%v: %w", i+1, err)
+		}
+		replicaPool, err := pgxpool.NewWithConfig(context.Background(), replicaCfg)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("replica #%v: %w", i+1, err)
+		}
+		p.AddReplica(replicaPool, fmt.Sprintf("%v:%v", replicaCfg.ConnConfig.Host, replicaCfg.ConnConfig.Port))
+	}
+	return p, nil
+}
+
+// AddReplica добавляет реплику для чтения метрик. Реплика считается доступной до первой неудачной проверки
+func (p *PostgresStorage) AddReplica(conn PgxConn, host string) {
+	r := &replica{conn: conn, host: host}
+	r.healthy.Store(true)
+	p.replicas = append(p.replicas, r)
+}
+
+// readConn выбирает соединение для чтения: следующую по кругу доступную реплику.
+// Основная база используется, если реплик нет, все недоступны или контекст помечен через storage.WithPrimary
+func (p *PostgresStorage) readConn(ctx context.Context) (PgxConn, *replica) {
+	if len(p.replicas) == 0 || storage.ReadFromPrimary(ctx) {
+		return p.Conn, nil
+	}
+	start := p.next.Add(1)
+	for i := range p.replicas {
+		r := p.replicas[(int(start)+i)%len(p.replicas)]
+		if r.healthy.Load() {
+			return r.conn, r
+		}
+	}
+	return p.Conn, nil
+}
+
+// isConnError возвращает true для ошибок соединения, после которых запрос стоит повторить
+func isConnError(err error) bool {
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &netErr) || errors.As(err, &connectErr)
+}
+
+// readFailed исключает реплику из выборки при ошибке соединения с ней
+func (p *PostgresStorage) readFailed(r *replica, err error) {
+	if r == nil || !isConnError(err) {
+		return
+	}
+	if r.healthy.CompareAndSwap(true, false) {
+		p.Logger.Warnf("Postgres replica %v is unavailable: %v", r.host, err)
+	}
+}
+
+// CheckReplicas проверяет доступность реплик и возвращает в выборку восстановившиеся
+func (p *PostgresStorage) CheckReplicas(ctx context.Context) {
+	for _, r := range p.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		err := r.conn.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			if r.healthy.CompareAndSwap(true, false) {
+				p.Logger.Warnf("Postgres replica %v is unavailable: %v", r.host, err)
+			}
+			continue
+		}
+		if r.healthy.CompareAndSwap(false, true) {
+			p.Logger.Infof("Postgres replica %v is available again", r.host)
+		}
+	}
+}
+
+// HealthyReplicas количество доступных реплик
+func (p *PostgresStorage) HealthyReplicas() int {
+	var n int
+	for _, r := range p.replicas {
+		if r.healthy.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+// OpenDB открывает отдельное от пула соединение database/sql, например для миграций.
+// Подготовленные запросы на нем не создаются, поэтому схема к этому моменту может еще не существовать
+func (p *PostgresStorage) OpenDB() *sql.DB {
+	return stdlib.OpenDB(*p.Pool.Config().ConnConfig)
+}
+
+// RegisterStats добавляет статистику пула соединений в метрики сервера
+func (p *PostgresStorage) RegisterStats(registry *stats.Registry) {
+	if p.Pool == nil {
+		return
+	}
+	pool := p.Pool
+	registry.RegisterGauge("db_pool_max_conns", func() float64 { return float64(pool.Stat().MaxConns()) })
+	registry.RegisterGauge("db_pool_total_conns", func() float64 { return float64(pool.Stat().TotalConns()) })
+	registry.RegisterGauge("db_pool_idle_conns", func() float64 { return float64(pool.Stat().IdleConns()) })
+	registry.RegisterGauge("db_pool_acquired_conns", func() float64 { return float64(pool.Stat().AcquiredConns()) })
+	registry.RegisterGauge("db_pool_constructing_conns", func() float64 { return float64(pool.Stat().ConstructingConns()) })
+	registry.RegisterGauge("db_pool_acquire_count", func() float64 { return float64(pool.Stat().AcquireCount()) })
+	registry.RegisterGauge("db_pool_empty_acquire_count", func() float64 { return float64(pool.Stat().EmptyAcquireCount()) })
+	registry.RegisterGauge("db_pool_canceled_acquire_count", func() float64 { return float64(pool.Stat().CanceledAcquireCount()) })
+	registry.RegisterGauge("db_pool_acquire_duration_seconds", func() float64 { return pool.Stat().AcquireDuration().Seconds() })
+	if len(p.replicas) > 0 {
+		registry.RegisterGauge("db_replicas_healthy", func() float64 { return float64(p.HealthyReplicas()) })
+	}
 }
 
 func (p *PostgresStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
 	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
-		_, err := p.Conn.ExecContext(ctx, "INSERT INTO server.metrics (name, type, value, delta) "+
-			"VALUES ($1, $2, $3, $4) ON CONFLICT (name) DO UPDATE SET type=$2, value=$3, delta=$4",
-			metric.ID, metric.MType, metric.Value, metric.Delta)
+		_, err := p.Conn.Exec(ctx, saveMetricQuery, metric.ID, metric.MType, metric.Value, metric.Delta)
 		return false, err
 	})
 	return retryer.Do(ctx)
 }
 
+const (
+	// количество метрик в одном INSERT: 4 параметра на метрику, лимит postgres 65535 параметров на запрос
+	maxUpsertRows = 1000
+	upsertPrefix  = "INSERT INTO server.metrics AS m (name, type, value, delta) VALUES "
+	saveConflict  = " ON CONFLICT (name) DO UPDATE SET type = EXCLUDED.type, value = EXCLUDED.value, delta = EXCLUDED.delta"
+	// counter прибавляется на стороне базы, если метрика и раньше была counter
+	incrementConflict = " ON CONFLICT (name) DO UPDATE SET type = EXCLUDED.type, value = EXCLUDED.value, " +
+		"delta = CASE WHEN m.type = 'counter' AND EXCLUDED.type = 'counter' THEN m.delta + EXCLUDED.delta ELSE EXCLUDED.delta END " +
+		"RETURNING name, type, value, delta"
+)
+
+// incrementMetricQuery запрос для одной метрики, самый частый при обновлении через API
+var incrementMetricQuery, _ = upsertQuery(make([]models.Metric, 1), incrementConflict)
+
+// mergeMetrics оставляет по одной метрике на имя, потому что один INSERT ... ON CONFLICT не может изменить строку дважды.
+// Если sum, то counter метрики с одинаковым именем суммируются, иначе побеждает последняя.
+// Результат отсортирован по имени, чтобы параллельные транзакции блокировали строки в одном порядке и не ловили deadlock
+func mergeMetrics(metrics []models.Metric, sum bool) []models.Metric {
+	index := make(map[string]int, len(metrics))
+	merged := make([]models.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		i, ok := index[metric.ID]
+		if !ok {
+			index[metric.ID] = len(merged)
+			merged = append(merged, metric)
+			continue
+		}
+		if sum && metric.MType == "counter" && merged[i].MType == "counter" {
+			delta := *merged[i].Delta + *metric.Delta
+			metric.Delta = &delta
+		}
+		merged[i] = metric
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].ID < merged[j].ID
+	})
+	return merged
+}
+
+// upsertQuery собирает многострочный INSERT для метрик и его параметры
+func upsertQuery(metrics []models.Metric, onConflict string) (string, []any) {
+	var query strings.Builder
+	args := make([]any, 0, len(metrics)*4)
+	query.WriteString(upsertPrefix)
+	for i, metric := range metrics {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		n := i * 4
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4)
+		args = append(args, metric.ID, metric.MType, metric.Value, metric.Delta)
+	}
+	query.WriteString(onConflict)
+	return query.String(), args
+}
+
+// chunkMetrics делит метрики на части не больше maxUpsertRows
+func chunkMetrics(metrics []models.Metric) [][]models.Metric {
+	var chunks [][]models.Metric
+	for len(metrics) > maxUpsertRows {
+		chunks = append(chunks, metrics[:maxUpsertRows])
+		metrics = metrics[maxUpsertRows:]
+	}
+	return append(chunks, metrics)
+}
+
 func (p *PostgresStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return p.saveBatch(ctx, metrics, false)
+}
+
+// ReplaceAllMetrics удаляет все метрики и сохраняет переданные в одной транзакции
+func (p *PostgresStorage) ReplaceAllMetrics(ctx context.Context, metrics []models.Metric) error {
+	return p.saveBatch(ctx, metrics, true)
+}
+
+func (p *PostgresStorage) saveBatch(ctx context.Context, metrics []models.Metric, replace bool) error {
+	merged := mergeMetrics(metrics, false)
 	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
-		tx, err := p.Conn.BeginTx(ctx, nil)
+		tx, err := p.Conn.Begin(ctx)
 		if err != nil {
 			return false, err
 		}
-		defer tx.Rollback()
-		for _, metric := range metrics {
-			_, err = p.Conn.ExecContext(ctx, "INSERT INTO server.metrics (name, type, value, delta) "+
-				"VALUES ($1, $2, $3, $4) ON CONFLICT (name) DO UPDATE SET type=$2, value=$3, delta=$4",
-				metric.ID, metric.MType, metric.Value, metric.Delta)
-			if err != nil {
+		defer tx.Rollback(ctx)
+		if replace {
+			if _, err = tx.Exec(ctx, deleteMetricsQuery); err != nil {
+				return false, err
+			}
+		}
+		if len(merged) == 0 {
+			return false, tx.Commit(ctx)
+		}
+		for _, chunk := range chunkMetrics(merged) {
+			query, args := upsertQuery(chunk, saveConflict)
+			if _, err = tx.Exec(ctx, query, args...); err != nil {
 				return false, err
 			}
 		}
-		return false, tx.Commit()
+		return false, tx.Commit(ctx)
 	})
 	return retryer.Do(ctx)
 }
 
+// IncrementMetrics сохраняет метрики одной транзакцией, прибавляя counter к значениям в базе (storage.Incrementer)
+func (p *PostgresStorage) IncrementMetrics(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	merged := mergeMetrics(metrics, true)
+	saved := make(map[string]models.Metric, len(merged))
+	// повторяются только ошибки до отправки запроса в базу: Begin и обрыв соединения
+	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
+		tx, err := p.Conn.Begin(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer tx.Rollback(ctx)
+		for _, chunk := range chunkMetrics(merged) {
+			query, args := upsertQuery(chunk, incrementConflict)
+			if err = p.queryMetrics(ctx, tx, query, args, saved); err != nil {
+				return !pgconn.SafeToRetry(err), err
+			}
+		}
+		// после ошибки Commit неизвестно, применилась ли транзакция: повтор мог бы прибавить delta второй раз
+		return true, tx.Commit(ctx)
+	})
+	if err := retryer.Do(ctx); err != nil {
+		return nil, err
+	}
+	result := make([]models.Metric, len(metrics))
+	for i, metric := range metrics {
+		result[i] = saved[metric.ID]
+	}
+	return result, nil
+}
+
+func (p *PostgresStorage) queryMetrics(ctx context.Context, tx pgx.Tx, query string, args []any, result map[string]models.Metric) error {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metric models.Metric
+		if err = rows.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta); err != nil {
+			return err
+		}
+		result[metric.ID] = metric
+	}
+	return rows.Err()
+}
+
 func (p *PostgresStorage) GetMetric(ctx context.Context, metricName string) (*models.Metric, error) {
 	var metric models.Metric
 	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
-		err := p.Conn.QueryRowContext(ctx, "SELECT name, type, value, delta FROM server.metrics WHERE name = $1",
-			metricName).
+		conn, r := p.readConn(ctx)
+		err := conn.QueryRow(ctx, getMetricQuery, metricName).
 			Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta)
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return true, nil
 		}
 
 		if err != nil {
-			var netErr net.Error
-			// возвращаем ошибку (для выполнения ретрая) только при сетевых ошибках
-			if errors.As(err, &netErr) {
+			p.readFailed(r, err)
+			// возвращаем ошибку (для выполнения ретрая) только при ошибках соединения
+			if isConnError(err) {
 				p.Logger.Errorf("Connection error: %s", err)
 				return false, err
 			}
@@ -146,20 +433,27 @@ func (p *PostgresStorage) GetMetric(ctx context.Context, metricName string) (*mo
 
 func (p *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]models.Metric, error) {
 	allMetrics := make(map[string]models.Metric)
-	var metric models.Metric
 
 	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
-		rows, err := p.Conn.QueryContext(ctx, "SELECT name, type, value, delta FROM server.metrics")
+		conn, r := p.readConn(ctx)
+		rows, err := conn.Query(ctx, getAllMetricsQuery)
 		if err != nil {
+			p.readFailed(r, err)
 			return false, err
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			rows.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta)
+			var metric models.Metric
+			if err = rows.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta); err != nil {
+				return true, err
+			}
 			allMetrics[metric.ID] = metric
 		}
 		if err = rows.Err(); err != nil {
+			p.readFailed(r, err)
+			// повторная попытка читает метрики заново
+			clear(allMetrics)
 			return false, err
 		}
 		return true, nil
@@ -167,6 +461,36 @@ func (p *PostgresStorage) GetAllMetrics(ctx context.Context) (map[string]models.
 	return allMetrics, retryer.Do(ctx)
 }
 
+func (p *PostgresStorage) LookupToken(ctx context.Context, hash string) (*auth.Token, error) {
+	var token auth.Token
+	var scopes string
+	retryer := retry.NewRetryer(p.Logger, p.cfg.RetryConfig.RetryAttempts, time.Duration(p.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
+		err := p.Conn.QueryRow(ctx, lookupTokenQuery, hash).
+			Scan(&token.ID, &token.Hash, &scopes)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return true, auth.ErrTokenNotFound
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) {
+				p.Logger.Errorf("Connection error: %s", err)
+				return false, err
+			}
+			return true, err
+		}
+		return true, nil
+	})
+	if err := retryer.Do(ctx); err != nil {
+		return nil, err
+	}
+	parsedScopes, err := auth.ParseScopes(scopes)
+	if err != nil {
+		return nil, fmt.Errorf("token '%v' has incorrect scopes: %v", token.ID, err)
+	}
+	token.Scopes = parsedScopes
+	return &token, nil
+}
+
 func (p *PostgresStorage) StartupRestore(ctx context.Context) error {
 	return nil
 }
@@ -180,16 +504,23 @@ func (p *PostgresStorage) Status(ctx context.Context) error {
 		timeout := 3 * time.Second
 		DBCtx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
-		err := p.Conn.PingContext(DBCtx)
+		err := p.Conn.Ping(DBCtx)
 		if err != nil {
 			return false, err
 		}
 		return true, nil
 	})
-	return retryer.Do(ctx)
+	err := retryer.Do(ctx)
+	// недоступные реплики не влияют на статус: чтение переключается на основную базу
+	p.CheckReplicas(ctx)
+	return err
 }
 
 func (p *PostgresStorage) Close() error {
-	p.Logger.Debug("Closing postgres connection")
-	return p.Conn.Close()
+	p.Logger.Debug("Closing postgres connection pool")
+	p.Conn.Close()
+	for _, r := range p.replicas {
+		r.conn.Close()
+	}
+	return nil
 }
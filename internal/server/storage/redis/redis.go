@@ -0,0 +1,231 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// сколько ключей запрашивать за одну итерацию SCAN и один MGET
+	scanCount   = 1000
+	pingTimeout = 3 * time.Second
+)
+
+// RedisStorage хранит метрики в Redis: gauge по ключу prefix:gauge:name через SET,
+// counter по ключу prefix:counter:name через INCRBY. Сервер при этом не хранит состояние,
+// и несколько серверов могут работать с одной базой без потери обновлений counter метрик
+type RedisStorage struct {
+	Client *redis.Client
+	Logger *zap.SugaredLogger
+	prefix string
+}
+
+func NewRedisStorage(cfg *config.Config, log *zap.SugaredLogger) (*RedisStorage, error) {
+	opts, err := redis.ParseURL(cfg.RedisStorage.URL)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse redis URL: %v", err)
+	}
+	return &RedisStorage{
+		Client: redis.NewClient(opts),
+		Logger: log,
+		prefix: cfg.RedisStorage.Prefix,
+	}, nil
+}
+
+func (r *RedisStorage) key(mtype, name string) string {
+	return r.prefix + ":" + mtype + ":" + name
+}
+
+// parseKey возвращает тип и имя метрики из ключа. Имя может содержать ':'
+func (r *RedisStorage) parseKey(key string) (mtype, name string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, r.prefix+":"), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// queueMetric добавляет в транзакцию запись метрики и удаление ключа метрики с тем же именем, но другим типом.
+// Если increment, то counter прибавляется к сохраненному значению, иначе перезаписывается
+func (r *RedisStorage) queueMetric(ctx context.Context, pipe redis.Pipeliner, metric models.Metric, increment bool) (*redis.IntCmd, error) {
+	gaugeKey := r.key(models.Gauge.String(), metric.ID)
+	counterKey := r.key(models.Counter.String(), metric.ID)
+	switch {
+	case metric.MType == models.Gauge.String() && metric.Value != nil:
+		pipe.Set(ctx, gaugeKey, strconv.FormatFloat(*metric.Value, 'g', -1, 64), 0)
+		pipe.Del(ctx, counterKey)
+		return nil, nil
+	case metric.MType == models.Counter.String() && metric.Delta != nil:
+		pipe.Del(ctx, gaugeKey)
+		if increment {
+			return pipe.IncrBy(ctx, counterKey, *metric.Delta), nil
+		}
+		pipe.Set(ctx, counterKey, *metric.Delta, 0)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("incorrect metric '%v' with type '%v'", metric.ID, metric.MType)
+}
+
+func (r *RedisStorage) save(ctx context.Context, metrics []models.Metric, increment bool) ([]*redis.IntCmd, error) {
+	counters := make([]*redis.IntCmd, len(metrics))
+	var queueErr error
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, metric := range metrics {
+			counters[i], queueErr = r.queueMetric(ctx, pipe, metric, increment)
+			if queueErr != nil {
+				return queueErr
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+func (r *RedisStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
+	_, err := r.save(ctx, []models.Metric{metric}, false)
+	return err
+}
+
+func (r *RedisStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	_, err := r.save(ctx, metrics, false)
+	return err
+}
+
+func (r *RedisStorage) IncrementMetrics(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	counters, err := r.save(ctx, metrics, true)
+	if err != nil {
+		return nil, err
+	}
+	// для повторяющихся counter итоговое значение дает последний INCRBY
+	final := make(map[string]int64, len(metrics))
+	for i, metric := range metrics {
+		if counters[i] != nil {
+			final[metric.ID] = counters[i].Val()
+		}
+	}
+	result := make([]models.Metric, len(metrics))
+	for i, metric := range metrics {
+		if delta, ok := final[metric.ID]; ok && counters[i] != nil {
+			metric.Delta = &delta
+		}
+		result[i] = metric
+	}
+	return result, nil
+}
+
+func parseMetric(name, mtype, value string) (models.Metric, error) {
+	metric := models.Metric{ID: name, MType: mtype}
+	switch mtype {
+	case models.Gauge.String():
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return metric, fmt.Errorf("incorrect value '%v' of gauge '%v': %v", value, name, err)
+		}
+		metric.Value = &v
+	case models.Counter.String():
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return metric, fmt.Errorf("incorrect value '%v' of counter '%v': %v", value, name, err)
+		}
+		metric.Delta = &d
+	default:
+		return metric, fmt.Errorf("unknown type '%v' of metric '%v'", mtype, name)
+	}
+	return metric, nil
+}
+
+func (r *RedisStorage) GetMetric(ctx context.Context, metricName string) (*models.Metric, error) {
+	values, err := r.Client.MGet(ctx, r.key(models.Gauge.String(), metricName), r.key(models.Counter.String(), metricName)).Result()
+	if err != nil {
+		return &models.Metric{}, err
+	}
+	for i, mtype := range []string{models.Gauge.String(), models.Counter.String()} {
+		value, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+		metric, err := parseMetric(metricName, mtype, value)
+		if err != nil {
+			return &models.Metric{}, err
+		}
+		return &metric, nil
+	}
+	return &models.Metric{}, storage.ErrMetricNotExist
+}
+
+// GetAllMetrics обходит ключи с префиксом через SCAN, чтобы не блокировать Redis командой KEYS
+func (r *RedisStorage) GetAllMetrics(ctx context.Context) (map[string]models.Metric, error) {
+	allMetrics := make(map[string]models.Metric)
+	var cursor uint64
+	for {
+		keys, next, err := r.Client.Scan(ctx, cursor, r.prefix+":*", scanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			values, err := r.Client.MGet(ctx, keys...).Result()
+			if err != nil {
+				return nil, err
+			}
+			for i, key := range keys {
+				value, ok := values[i].(string)
+				if !ok {
+					// ключ удалили между SCAN и MGET
+					continue
+				}
+				mtype, name, ok := r.parseKey(key)
+				if !ok {
+					r.Logger.Warnf("Skipping unknown redis key '%v'", key)
+					continue
+				}
+				metric, err := parseMetric(name, mtype, value)
+				if err != nil {
+					r.Logger.Warnf("Skipping redis key '%v': %v", key, err)
+					continue
+				}
+				allMetrics[name] = metric
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return allMetrics, nil
+}
+
+func (r *RedisStorage) StartupRestore(ctx context.Context) error {
+	return nil
+}
+
+func (r *RedisStorage) FlushMetrics() error {
+	return nil
+}
+
+func (r *RedisStorage) Status(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return r.Client.Ping(pingCtx).Err()
+}
+
+func (r *RedisStorage) Close() error {
+	r.Logger.Debug("Closing redis connection")
+	return r.Client.Close()
+}
@@ -0,0 +1,212 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/storagetest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func CreateTestStorage(t *testing.T) (*RedisStorage, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	cfg := &config.Config{
+		Storage: storage.RedisStorage,
+		RedisStorage: config.RedisConfig{
+			URL:    "redis://" + mr.Addr(),
+			Prefix: "metrics",
+		},
+	}
+	db, err := NewRedisStorage(cfg, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db, mr
+}
+
+func TestRedisStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		db, _ := CreateTestStorage(t)
+		return db
+	})
+}
+
+func TestRedisStorage_Status(t *testing.T) {
+	t.Run("check status function", func(t *testing.T) {
+		db, _ := CreateTestStorage(t)
+		assert.NoError(t, db.Status(context.TODO()))
+	})
+
+	t.Run("check status function (server is down)", func(t *testing.T) {
+		db, mr := CreateTestStorage(t)
+		mr.Close()
+		assert.Error(t, db.Status(context.TODO()))
+	})
+}
+
+func TestNewRedisStorage(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	t.Run("test new redis storage", func(t *testing.T) {
+		var got any
+		cfg := config.Config{RedisStorage: config.RedisConfig{URL: "redis://localhost:6379/0"}}
+		got, err = NewRedisStorage(&cfg, log)
+		require.NoError(t, err)
+		if _, ok := got.(*RedisStorage); !ok {
+			t.Fatalf("Resulting object have incorrect type (not equal *RedisStorage struct)")
+		}
+	})
+
+	t.Run("invalid URL", func(t *testing.T) {
+		cfg := config.Config{RedisStorage: config.RedisConfig{URL: "dummy"}}
+		_, err = NewRedisStorage(&cfg, log)
+		assert.Error(t, err)
+	})
+}
+
+func TestRedisStorage_GetMetric(t *testing.T) {
+	t.Run("metric exist", func(t *testing.T) {
+		db, mr := CreateTestStorage(t)
+		checkMetric, err := models.NewMetric("test_metric", "counter", 1)
+		require.NoError(t, err)
+		require.NoError(t, db.SaveMetric(context.TODO(), checkMetric))
+		assert.True(t, mr.Exists("metrics:counter:test_metric"))
+
+		gotMetric, err := db.GetMetric(context.TODO(), checkMetric.ID)
+		require.NoError(t, err)
+		assert.Equal(t, checkMetric, *gotMetric)
+	})
+
+	t.Run("metric not exist", func(t *testing.T) {
+		db, _ := CreateTestStorage(t)
+		gotMetric, err := db.GetMetric(context.TODO(), "test_metric")
+		assert.ErrorIs(t, err, storage.ErrMetricNotExist)
+		assert.Equal(t, &models.Metric{}, gotMetric)
+	})
+}
+
+func TestRedisStorage_SaveMetric(t *testing.T) {
+	t.Run("switch metric type", func(t *testing.T) {
+		db, mr := CreateTestStorage(t)
+		counter, err := models.NewMetric("test_metric", "counter", 11)
+		require.NoError(t, err)
+		require.NoError(t, db.SaveMetric(context.TODO(), counter))
+
+		gauge, err := models.NewMetric("test_metric", "gauge", 1.5)
+		require.NoError(t, err)
+		require.NoError(t, db.SaveMetric(context.TODO(), gauge))
+		assert.False(t, mr.Exists("metrics:counter:test_metric"))
+
+		gotMetric, err := db.GetMetric(context.TODO(), "test_metric")
+		require.NoError(t, err)
+		assert.Equal(t, gauge, *gotMetric)
+	})
+
+	t.Run("incorrect metric", func(t *testing.T) {
+		db, _ := CreateTestStorage(t)
+		err := db.SaveMetric(context.TODO(), models.Metric{ID: "test_metric", MType: "gauge"})
+		assert.Error(t, err)
+	})
+}
+
+func TestRedisStorage_GetAllMetrics(t *testing.T) {
+	t.Run("get all metrics", func(t *testing.T) {
+		db, mr := CreateTestStorage(t)
+		// ключи с другим префиксом не должны попасть в выборку
+		require.NoError(t, mr.Set("other:gauge:test3", "1"))
+		var metrics []models.Metric
+		for i := 0; i < 2500; i++ {
+			m, err := models.NewMetric(fmt.Sprintf("test:%v", i), "gauge", i)
+			require.NoError(t, err)
+			metrics = append(metrics, m)
+		}
+		counter, err := models.NewMetric("test2", "counter", 2)
+		require.NoError(t, err)
+		metrics = append(metrics, counter)
+		require.NoError(t, db.SaveBatchMetrics(context.TODO(), metrics))
+
+		gotMetrics, err := db.GetAllMetrics(context.TODO())
+		require.NoError(t, err)
+		require.Len(t, gotMetrics, len(metrics))
+		assert.EqualValues(t, 7, *gotMetrics["test:7"].Value)
+		assert.Equal(t, "counter", gotMetrics["test2"].MType)
+		assert.EqualValues(t, 2, *gotMetrics["test2"].Delta)
+	})
+}
+
+func TestRedisStorage_SaveBatchMetric(t *testing.T) {
+	t.Run("successfully", func(t *testing.T) {
+		db, _ := CreateTestStorage(t)
+		counter, err := models.NewMetric("test_metric", "counter", 11)
+		require.NoError(t, err)
+		gauge, err := models.NewMetric("test_metric2", "gauge", 1)
+		require.NoError(t, err)
+
+		require.NoError(t, db.SaveBatchMetrics(context.TODO(), []models.Metric{counter, gauge}))
+
+		gotMetrics, err := db.GetAllMetrics(context.TODO())
+		require.NoError(t, err)
+		assert.Equal(t, counter, gotMetrics["test_metric"])
+		assert.Equal(t, gauge, gotMetrics["test_metric2"])
+	})
+
+	t.Run("incorrect metric discards batch", func(t *testing.T) {
+		db, _ := CreateTestStorage(t)
+		gauge, err := models.NewMetric("test_metric", "gauge", 1)
+		require.NoError(t, err)
+
+		err = db.SaveBatchMetrics(context.TODO(), []models.Metric{gauge, {ID: "broken", MType: "counter"}})
+		assert.Error(t, err)
+
+		gotMetrics, err := db.GetAllMetrics(context.TODO())
+		require.NoError(t, err)
+		assert.Empty(t, gotMetrics)
+	})
+}
+
+func TestRedisStorage_IncrementMetrics(t *testing.T) {
+	t.Run("concurrent increments are not lost", func(t *testing.T) {
+		db, _ := CreateTestStorage(t)
+		counter, err := models.NewMetric("test_counter", "counter", 1)
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := db.IncrementMetrics(context.TODO(), []models.Metric{counter})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		gotMetric, err := db.GetMetric(context.TODO(), "test_counter")
+		require.NoError(t, err)
+		assert.EqualValues(t, 50, *gotMetric.Delta)
+	})
+
+	t.Run("returns resulting values", func(t *testing.T) {
+		db, _ := CreateTestStorage(t)
+		counter, err := models.NewMetric("test_counter", "counter", 5)
+		require.NoError(t, err)
+		gauge, err := models.NewMetric("test_gauge", "gauge", 2.5)
+		require.NoError(t, err)
+		_, err = db.IncrementMetrics(context.TODO(), []models.Metric{counter})
+		require.NoError(t, err)
+
+		result, err := db.IncrementMetrics(context.TODO(), []models.Metric{counter, gauge})
+		require.NoError(t, err)
+		require.Len(t, result, 2)
+		assert.EqualValues(t, 10, *result[0].Delta)
+		assert.Equal(t, gauge, result[1])
+	})
+}
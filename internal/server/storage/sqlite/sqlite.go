@@ -0,0 +1,242 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/retry"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/migrator"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
+	"go.uber.org/zap"
+	sqlitedriver "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"time"
+)
+
+const (
+	saveMetricQuery = "INSERT INTO metrics (name, type, value, delta) " +
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (name) DO UPDATE SET type=$2, value=$3, delta=$4"
+	// counter прибавляется на стороне базы, если метрика и раньше была counter
+	incrementMetricQuery = "INSERT INTO metrics (name, type, value, delta) VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT (name) DO UPDATE SET type = excluded.type, value = excluded.value, " +
+		"delta = CASE WHEN metrics.type = 'counter' AND excluded.type = 'counter' THEN metrics.delta + excluded.delta ELSE excluded.delta END " +
+		"RETURNING name, type, value, delta"
+	// сколько ждать освобождения блокировки базы, занятой другим процессом
+	busyTimeout = 5 * time.Second
+)
+
+// Migrator мигратор базы SQLite
+type Migrator = migrator.Migrator
+
+func NewMigrator(conn *sql.DB, cfg *config.Config, log *zap.SugaredLogger) *Migrator {
+	return migrator.New(conn, "sqlite", func(conn *sql.DB) (database.Driver, error) {
+		return sqlite.WithInstance(conn, &sqlite.Config{})
+	}, cfg.SQLiteStorage.MigrationsDir, log)
+}
+
+// SQLiteStorage хранит метрики во встроенной базе SQLite (pure-Go драйвер, cgo не нужен)
+type SQLiteStorage struct {
+	Conn   *sql.DB
+	Logger *zap.SugaredLogger
+	cfg    *config.Config
+}
+
+func NewSQLiteStorage(cfg *config.Config, log *zap.SugaredLogger) (*SQLiteStorage, error) {
+	if cfg.SQLiteStorage.FileName == "" {
+		return nil, fmt.Errorf("SQLiteStorage.NewSQLiteStorage: file name is empty")
+	}
+	dsn := fmt.Sprintf("file:%v?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)",
+		cfg.SQLiteStorage.FileName, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// у SQLite только один писатель, поэтому все запросы идут через одно соединение
+	db.SetMaxOpenConns(1)
+	return &SQLiteStorage{
+		Conn:   db,
+		Logger: log,
+		cfg:    cfg,
+	}, nil
+}
+
+// isBusy база занята другим процессом дольше busyTimeout. Транзакция при этом не применена, ее можно повторить
+func isBusy(err error) bool {
+	var sqliteErr *sqlitedriver.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// младший байт расширенного кода ошибки - основной код
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// withRetry выполняет f, повторяя его, пока база занята другим процессом. Остальные ошибки не повторяются
+func (s *SQLiteStorage) withRetry(ctx context.Context, f func(ctx context.Context) error) error {
+	retryer := retry.NewRetryer(s.Logger, s.cfg.RetryConfig.RetryAttempts, time.Duration(s.cfg.RetryConfig.RetryWaitTime), func(ctx context.Context) (bool, error) {
+		err := f(ctx)
+		if isBusy(err) {
+			s.Logger.Errorf("Database is busy: %v", err)
+			return false, err
+		}
+		return true, err
+	})
+	return retryer.Do(ctx)
+}
+
+func (s *SQLiteStorage) SaveMetric(ctx context.Context, metric models.Metric) error {
+	return s.withRetry(ctx, func(ctx context.Context) error {
+		_, err := s.Conn.ExecContext(ctx, saveMetricQuery, metric.ID, metric.MType, metric.Value, metric.Delta)
+		return err
+	})
+}
+
+func (s *SQLiteStorage) SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error {
+	return s.saveBatch(ctx, metrics, false)
+}
+
+// ReplaceAllMetrics удаляет все метрики и сохраняет переданные в одной транзакции
+func (s *SQLiteStorage) ReplaceAllMetrics(ctx context.Context, metrics []models.Metric) error {
+	return s.saveBatch(ctx, metrics, true)
+}
+
+func (s *SQLiteStorage) saveBatch(ctx context.Context, metrics []models.Metric, replace bool) error {
+	return s.withRetry(ctx, func(ctx context.Context) error {
+		return s.saveBatchTx(ctx, metrics, replace)
+	})
+}
+
+func (s *SQLiteStorage) saveBatchTx(ctx context.Context, metrics []models.Metric, replace bool) error {
+	tx, err := s.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if replace {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM metrics"); err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.PrepareContext(ctx, saveMetricQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, metric := range metrics {
+		if _, err = stmt.ExecContext(ctx, metric.ID, metric.MType, metric.Value, metric.Delta); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// IncrementMetrics сохраняет метрики одной транзакцией, прибавляя counter к значениям в базе (storage.Incrementer)
+func (s *SQLiteStorage) IncrementMetrics(ctx context.Context, metrics []models.Metric) ([]models.Metric, error) {
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	saved := make(map[string]models.Metric, len(metrics))
+	err := s.withRetry(ctx, func(ctx context.Context) error {
+		clear(saved)
+		return s.incrementTx(ctx, metrics, saved)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]models.Metric, len(metrics))
+	for i, metric := range metrics {
+		result[i] = saved[metric.ID]
+	}
+	return result, nil
+}
+
+// incrementTx выполняет IncrementMetrics и складывает итоговые значения в saved. Повторяющиеся метрики
+// применяются по очереди, поэтому counter с одинаковым именем суммируются
+func (s *SQLiteStorage) incrementTx(ctx context.Context, metrics []models.Metric, saved map[string]models.Metric) error {
+	tx, err := s.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, incrementMetricQuery)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, metric := range metrics {
+		var m models.Metric
+		err = stmt.QueryRowContext(ctx, metric.ID, metric.MType, metric.Value, metric.Delta).
+			Scan(&m.ID, &m.MType, &m.Value, &m.Delta)
+		if err != nil {
+			return err
+		}
+		saved[m.ID] = m
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) GetMetric(ctx context.Context, metricName string) (*models.Metric, error) {
+	var metric models.Metric
+	err := s.withRetry(ctx, func(ctx context.Context) error {
+		return s.Conn.QueryRowContext(ctx, "SELECT name, type, value, delta FROM metrics WHERE name = $1", metricName).
+			Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return &models.Metric{}, storage.ErrMetricNotExist
+	}
+	if err != nil {
+		return &models.Metric{}, err
+	}
+	return &metric, nil
+}
+
+func (s *SQLiteStorage) GetAllMetrics(ctx context.Context) (map[string]models.Metric, error) {
+	var allMetrics map[string]models.Metric
+	err := s.withRetry(ctx, func(ctx context.Context) error {
+		var err error
+		allMetrics, err = s.getAllMetrics(ctx)
+		return err
+	})
+	return allMetrics, err
+}
+
+func (s *SQLiteStorage) getAllMetrics(ctx context.Context) (map[string]models.Metric, error) {
+	allMetrics := make(map[string]models.Metric)
+	rows, err := s.Conn.QueryContext(ctx, "SELECT name, type, value, delta FROM metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metric models.Metric
+		if err = rows.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta); err != nil {
+			return nil, err
+		}
+		allMetrics[metric.ID] = metric
+	}
+	return allMetrics, rows.Err()
+}
+
+func (s *SQLiteStorage) StartupRestore(ctx context.Context) error {
+	return nil
+}
+
+func (s *SQLiteStorage) FlushMetrics() error {
+	return nil
+}
+
+func (s *SQLiteStorage) Status(ctx context.Context) error {
+	DBCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	return s.Conn.PingContext(DBCtx)
+}
+
+func (s *SQLiteStorage) Close() error {
+	s.Logger.Debug("Closing sqlite database")
+	return s.Conn.Close()
+}
@@ -0,0 +1,127 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/aksenk/go-yandex-metrics/internal/logger"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/config"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func CreateTestStorage(t *testing.T) *SQLiteStorage {
+	log, err := logger.NewLogger("debug")
+	require.NoError(t, err)
+	cfg := &config.Config{
+		Storage:  storage.SQLiteStorage,
+		LogLevel: "debug",
+		SQLiteStorage: config.SQLiteConfig{
+			FileName:      filepath.Join(t.TempDir(), "metrics.db"),
+			MigrationsDir: "../../../../migrations/sqlite",
+		},
+	}
+	db, err := NewSQLiteStorage(cfg, log)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	migrator := NewMigrator(db.Conn, cfg, log)
+	migrator.Run()
+	require.NoError(t, migrator.Err())
+	require.False(t, migrator.Dirty())
+	return db
+}
+
+func TestSQLiteStorage_Status(t *testing.T) {
+	t.Run("check status function", func(t *testing.T) {
+		db := CreateTestStorage(t)
+		assert.NoError(t, db.Status(context.TODO()))
+	})
+
+	t.Run("check status function (closed database)", func(t *testing.T) {
+		db := CreateTestStorage(t)
+		require.NoError(t, db.Close())
+		assert.Error(t, db.Status(context.TODO()))
+	})
+}
+
+func TestNewSQLiteStorage(t *testing.T) {
+	log, err := logger.NewLogger("info")
+	require.NoError(t, err)
+	t.Run("test new sqlite storage", func(t *testing.T) {
+		var got any
+		cfg := config.Config{
+			Storage:       storage.SQLiteStorage,
+			SQLiteStorage: config.SQLiteConfig{FileName: filepath.Join(t.TempDir(), "metrics.db")},
+		}
+		got, err = NewSQLiteStorage(&cfg, log)
+		require.NoError(t, err)
+		if _, ok := got.(*SQLiteStorage); !ok {
+			t.Fatalf("Resulting object have incorrect type (not equal *SQLiteStorage struct)")
+		}
+	})
+
+	t.Run("empty file name", func(t *testing.T) {
+		_, err = NewSQLiteStorage(&config.Config{Storage: storage.SQLiteStorage}, log)
+		assert.Error(t, err)
+	})
+}
+
+func TestSQLiteStorage_Close(t *testing.T) {
+	t.Run("test sqlite storage close function", func(t *testing.T) {
+		db := CreateTestStorage(t)
+		assert.NoError(t, db.Close())
+	})
+}
+
+func TestSQLiteStorage_Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storager {
+		return CreateTestStorage(t)
+	})
+}
+
+func TestIsBusy(t *testing.T) {
+	db := CreateTestStorage(t)
+	conn, err := db.Conn.Conn(context.TODO())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.ExecContext(context.TODO(), "BEGIN EXCLUSIVE")
+	require.NoError(t, err)
+	defer conn.ExecContext(context.TODO(), "ROLLBACK")
+
+	// второй процесс не ждет освобождения блокировки
+	other, err := sql.Open("sqlite", "file:"+db.cfg.SQLiteStorage.FileName+"?_pragma=busy_timeout(0)")
+	require.NoError(t, err)
+	defer other.Close()
+	_, err = other.ExecContext(context.TODO(), saveMetricQuery, "test", "gauge", 1, nil)
+	require.Error(t, err)
+	assert.True(t, isBusy(err))
+
+	assert.False(t, isBusy(errors.New("test")))
+	assert.False(t, isBusy(sql.ErrNoRows))
+}
+
+func TestSQLiteStorage_SaveBatchMetric(t *testing.T) {
+	t.Run("rollback on error", func(t *testing.T) {
+		db := CreateTestStorage(t)
+		good, err := models.NewMetric("test_metric", "gauge", 1)
+		require.NoError(t, err)
+		// вставка второй метрики падает на триггере, и вся пачка должна откатиться
+		bad := models.Metric{ID: "broken"}
+		_, err = db.Conn.ExecContext(context.TODO(), "CREATE TRIGGER reject_broken BEFORE INSERT ON metrics "+
+			"WHEN NEW.name = 'broken' BEGIN SELECT RAISE(ABORT, 'broken metric'); END")
+		require.NoError(t, err)
+
+		err = db.SaveBatchMetrics(context.TODO(), []models.Metric{good, bad})
+		assert.Error(t, err)
+
+		gotMetrics, err := db.GetAllMetrics(context.TODO())
+		require.NoError(t, err)
+		assert.Empty(t, gotMetrics)
+	})
+}
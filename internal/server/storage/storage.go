@@ -12,10 +12,18 @@ const (
 	MemoryStorage   SType = "memory"
 	FileStorage     SType = "file"
 	PostgresStorage SType = "postgres"
+	SQLiteStorage   SType = "sqlite"
+	RedisStorage    SType = "redis"
 )
 
 var ErrMetricNotExist = errors.New("metric not found")
 
+var ErrReplaceNotSupported = errors.New("storage does not support replacing all metrics")
+
+// ErrPartiallySaved метрики записаны в основное хранилище, но не во все дополнительные.
+// Повторять такой запрос нельзя: counter будут прибавлены второй раз
+var ErrPartiallySaved = errors.New("metrics are saved to the primary storage only")
+
 type Storager interface {
 	SaveMetric(ctx context.Context, metric models.Metric) error
 	SaveBatchMetrics(ctx context.Context, metrics []models.Metric) error
@@ -26,3 +34,32 @@ type Storager interface {
 	Close() error
 	Status(ctx context.Context) error
 }
+
+// Incrementer реализуют хранилища, которые сами атомарно прибавляют delta к counter метрикам.
+// IncrementMetrics сохраняет gauge метрики как есть, прибавляет delta counter метрик к сохраненным значениям
+// и возвращает итоговые значения метрик в том же порядке
+type Incrementer interface {
+	IncrementMetrics(ctx context.Context, metrics []models.Metric) ([]models.Metric, error)
+}
+
+// Replacer реализуют хранилища, которые умеют заменить все метрики одной операцией.
+// После ReplaceAllMetrics в хранилище остаются только переданные метрики
+type Replacer interface {
+	ReplaceAllMetrics(ctx context.Context, metrics []models.Metric) error
+}
+
+type ctxKey int
+
+const keyReadPrimary ctxKey = iota
+
+// WithPrimary помечает контекст: хранилища с репликами читают метрики с основной базы.
+// Нужно, чтобы прочитать только что записанные данные (read-your-writes)
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, keyReadPrimary, true)
+}
+
+// ReadFromPrimary возвращает true, если контекст помечен через WithPrimary
+func ReadFromPrimary(ctx context.Context) bool {
+	v, _ := ctx.Value(keyReadPrimary).(bool)
+	return v
+}
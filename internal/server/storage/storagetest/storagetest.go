@@ -0,0 +1,137 @@
+// Package storagetest общий набор тестов, которому должна соответствовать любая реализация storage.Storager.
+// Тесты для storage.Incrementer и storage.Replacer запускаются, только если хранилище их реализует
+package storagetest
+
+import (
+	"context"
+	"github.com/aksenk/go-yandex-metrics/internal/models"
+	"github.com/aksenk/go-yandex-metrics/internal/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// Factory создает пустое хранилище для одного теста. Закрывать его должна сама фабрика через t.Cleanup
+type Factory func(t *testing.T) storage.Storager
+
+func metric(t *testing.T, name, mtype string, value any) models.Metric {
+	m, err := models.NewMetric(name, mtype, value)
+	require.NoError(t, err)
+	return m
+}
+
+// Run запускает набор тестов для хранилищ, создаваемых newStorage
+func Run(t *testing.T, newStorage Factory) {
+	ctx := context.TODO()
+
+	t.Run("metric not exist", func(t *testing.T) {
+		s := newStorage(t)
+		_, err := s.GetMetric(ctx, "missing")
+		assert.ErrorIs(t, err, storage.ErrMetricNotExist)
+		all, err := s.GetAllMetrics(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, all)
+	})
+
+	t.Run("save and get metric", func(t *testing.T) {
+		s := newStorage(t)
+		gauge := metric(t, "test_gauge", "gauge", 1.5)
+		counter := metric(t, "test_counter", "counter", 11)
+		require.NoError(t, s.SaveMetric(ctx, gauge))
+		require.NoError(t, s.SaveMetric(ctx, counter))
+
+		got, err := s.GetMetric(ctx, "test_gauge")
+		require.NoError(t, err)
+		assert.Equal(t, gauge, *got)
+		got, err = s.GetMetric(ctx, "test_counter")
+		require.NoError(t, err)
+		assert.Equal(t, counter, *got)
+	})
+
+	t.Run("save overwrites value", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.SaveMetric(ctx, metric(t, "test_counter", "counter", 11)))
+		require.NoError(t, s.SaveMetric(ctx, metric(t, "test_counter", "counter", 5)))
+
+		got, err := s.GetMetric(ctx, "test_counter")
+		require.NoError(t, err)
+		assert.Equal(t, metric(t, "test_counter", "counter", 5), *got)
+	})
+
+	t.Run("save batch and get all metrics", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.SaveBatchMetrics(ctx, nil))
+		batch := []models.Metric{
+			metric(t, "test1", "gauge", 1),
+			metric(t, "test2", "counter", 2),
+			metric(t, "test1", "gauge", 3),
+		}
+		require.NoError(t, s.SaveBatchMetrics(ctx, batch))
+
+		all, err := s.GetAllMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]models.Metric{
+			"test1": metric(t, "test1", "gauge", 3),
+			"test2": metric(t, "test2", "counter", 2),
+		}, all)
+	})
+
+	t.Run("increment metrics", func(t *testing.T) {
+		s := newStorage(t)
+		incrementer, ok := s.(storage.Incrementer)
+		if !ok {
+			t.Skip("storage does not implement storage.Incrementer")
+		}
+		require.NoError(t, s.SaveBatchMetrics(ctx, []models.Metric{
+			metric(t, "test_counter", "counter", 10),
+			metric(t, "test_gauge", "gauge", 1),
+		}))
+
+		got, err := incrementer.IncrementMetrics(ctx, []models.Metric{
+			metric(t, "test_counter", "counter", 5),
+			metric(t, "new_counter", "counter", 1),
+			metric(t, "test_gauge", "gauge", 2.5),
+			metric(t, "new_counter", "counter", 2),
+		})
+		require.NoError(t, err)
+		// итоговые значения в порядке переданных метрик
+		assert.Equal(t, []models.Metric{
+			metric(t, "test_counter", "counter", 15),
+			metric(t, "new_counter", "counter", 3),
+			metric(t, "test_gauge", "gauge", 2.5),
+			metric(t, "new_counter", "counter", 3),
+		}, got)
+
+		all, err := s.GetAllMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]models.Metric{
+			"test_counter": metric(t, "test_counter", "counter", 15),
+			"new_counter":  metric(t, "new_counter", "counter", 3),
+			"test_gauge":   metric(t, "test_gauge", "gauge", 2.5),
+		}, all)
+
+		got, err = incrementer.IncrementMetrics(ctx, nil)
+		require.NoError(t, err)
+		assert.Empty(t, got)
+	})
+
+	t.Run("replace all metrics", func(t *testing.T) {
+		s := newStorage(t)
+		replacer, ok := s.(storage.Replacer)
+		if !ok {
+			t.Skip("storage does not implement storage.Replacer")
+		}
+		require.NoError(t, s.SaveMetric(ctx, metric(t, "old_counter", "counter", 1)))
+		gauge := metric(t, "test_gauge", "gauge", 1.5)
+		require.NoError(t, replacer.ReplaceAllMetrics(ctx, []models.Metric{gauge}))
+
+		all, err := s.GetAllMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]models.Metric{"test_gauge": gauge}, all)
+
+		require.NoError(t, replacer.ReplaceAllMetrics(ctx, nil))
+		all, err = s.GetAllMetrics(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, all)
+	})
+}
@@ -0,0 +1,5 @@
+CREATE TABLE server.tokens (
+    id VARCHAR(256) NOT NULL PRIMARY KEY,
+    hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(256) NOT NULL
+);
@@ -0,0 +1,15 @@
+CREATE TABLE server.audit (
+    id BIGSERIAL NOT NULL PRIMARY KEY,
+    time TIMESTAMPTZ NOT NULL,
+    client_ip VARCHAR(64) NOT NULL,
+    key_id VARCHAR(256) NOT NULL,
+    metric_id VARCHAR(256) NOT NULL,
+    type VARCHAR(256) NOT NULL,
+    old_type VARCHAR(256) NOT NULL,
+    old_value TEXT,
+    new_value TEXT NOT NULL
+);
+
+CREATE INDEX audit_metric_id_idx ON server.audit (metric_id);
+CREATE INDEX audit_client_ip_idx ON server.audit (client_ip);
+CREATE INDEX audit_key_id_idx ON server.audit (key_id);
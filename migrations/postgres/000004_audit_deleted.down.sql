@@ -0,0 +1 @@
+ALTER TABLE server.audit DROP COLUMN IF EXISTS deleted;
@@ -0,0 +1 @@
+ALTER TABLE server.audit ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,7 @@
+CREATE TABLE metrics (
+    id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(256) NOT NULL UNIQUE,
+    type VARCHAR(256) NOT NULL,
+    value DOUBLE PRECISION,
+    delta BIGINT
+);